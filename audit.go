@@ -0,0 +1,194 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// below reports whether p is dir or a path below it
+func below(p string, dir string) bool {
+	dir = cleanPath(dir)
+	return p == dir || dir == "/" || strings.HasPrefix(p, dir+"/")
+}
+
+// WorldWritableFiles returns every file and directory of the merged filesystem that anyone may write to,
+// except for the paths allowed by Options.WorldWritableAllowed. Symlinks are not reported, their mode has no
+// meaning.
+func (i *Image) WorldWritableFiles() ([]FileInfo, error) {
+
+	fs, err := i.mergedFS()
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]FileInfo, 0)
+
+	for p, e := range fs {
+
+		if e.header.Typeflag == tar.TypeSymlink || e.header.Mode&0002 == 0 {
+			continue
+		}
+
+		allowed := false
+		for _, a := range i.options.WorldWritableAllowed {
+			allowed = allowed || below(p, a)
+		}
+
+		if !allowed {
+			found = append(found, e.fileInfo(p))
+		}
+
+	}
+
+	sort.Slice(found, func(a, b int) bool { return found[a].Path < found[b].Path })
+
+	return found, nil
+
+}
+
+// CacheMountArtifacts returns the paths of the merged filesystem that look like leftovers of build cache
+// mounts, each as "path (layer)". Options.CacheMountPatterns overrides the patterns looked for.
+func (i *Image) CacheMountArtifacts() ([]string, error) {
+
+	patterns := i.options.CacheMountPatterns
+	if len(patterns) == 0 {
+		patterns = DefaultCacheMountPatterns
+	}
+
+	found := make([]string, 0)
+
+	for _, pattern := range patterns {
+
+		matches, err := i.Find(cleanPath(pattern))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range matches {
+			found = append(found, fmt.Sprintf("%s (%s)", m.Path, m.Layer))
+		}
+
+	}
+
+	sort.Strings(found)
+
+	return found, nil
+
+}
+
+// SuspiciousEnv returns the names of the environment variables of the image that look like secrets and have a
+// value baked into the image, sorted. The values are not returned so they do not end up in logs. Names are
+// matched case insensitively against Options.SecretEnvPatterns, DefaultSecretEnvPatterns if empty.
+func (i *Image) SuspiciousEnv() ([]string, error) {
+
+	env, err := i.EnvMap()
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := i.options.SecretEnvPatterns
+	if len(patterns) == 0 {
+		patterns = DefaultSecretEnvPatterns
+	}
+
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern %q: %s", pattern, err)
+		}
+	}
+
+	found := make([]string, 0)
+
+	for name, value := range env {
+
+		if value == "" {
+			continue
+		}
+
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(strings.ToUpper(pattern), strings.ToUpper(name)); ok {
+				found = append(found, name)
+				break
+			}
+		}
+
+	}
+
+	sort.Strings(found)
+
+	return found, nil
+
+}
+
+// shellHistoryNames are the file names shells keep their command history in
+var shellHistoryNames = []string{".bash_history", ".zsh_history", ".sh_history", ".ash_history", ".history", "fish_history"}
+
+// ShellHistoryFiles returns the shell history files of the merged filesystem, such as /root/.bash_history left
+// behind by a build step, each as "path (layer)"
+func (i *Image) ShellHistoryFiles() ([]string, error) {
+
+	found := make([]string, 0)
+
+	for _, name := range shellHistoryNames {
+
+		matches, err := i.Find(name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range matches {
+			if !m.Mode.IsDir() {
+				found = append(found, fmt.Sprintf("%s (%s)", m.Path, m.Layer))
+			}
+		}
+
+	}
+
+	sort.Strings(found)
+
+	return found, nil
+
+}
+
+// gitDirectory is the directory git keeps the history and configuration of a working tree in
+const gitDirectory = ".git"
+
+// GitArtifacts returns every .git directory of the merged filesystem, each as "path (layer)". Besides the
+// directory, a copied .git/config alone reveals the remote and possibly its credentials, so a .git directory
+// that is only implied by the files below it is reported with the layer of the first of them.
+func (i *Image) GitArtifacts() ([]string, error) {
+
+	layers := make(map[string]string)
+
+	err := i.WalkFS(func(info FileInfo) error {
+
+		for p := info.Path; p != "/"; p = path.Dir(p) {
+			if path.Base(p) == gitDirectory {
+				if _, found := layers[p]; !found {
+					layers[p] = info.Layer
+				}
+			}
+		}
+
+		return nil
+
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	found := make([]string, 0, len(layers))
+
+	for p, layer := range layers {
+		found = append(found, fmt.Sprintf("%s (%s)", p, layer))
+	}
+
+	sort.Strings(found)
+
+	return found, nil
+
+}
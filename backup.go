@@ -0,0 +1,55 @@
+package dockerscope
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+const backupSuffix = ".bak"
+
+// SetNameWithBackup copies the image tarball to a .bak file next to it and then changes the name of the image
+// in place like SetName does. It returns the location of the backup, which is kept until the caller removes it.
+func (i *Image) SetNameWithBackup(newName string) (backupPath string, err error) {
+
+	backupPath = i.PathToSource + backupSuffix
+
+	if err := copyFile(i.PathToSource, backupPath); err != nil {
+		return "", fmt.Errorf("Error renaming image: Backup failed) %s", backupPath)
+	}
+
+	if err := i.SetName(newName); err != nil {
+		return backupPath, err
+	}
+
+	return backupPath, nil
+
+}
+
+// copyFile copies the file at source to target, replacing target if it exists
+func copyFile(source, target string) error {
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+
+}
@@ -0,0 +1,46 @@
+package dockerscope
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSetNameWithBackup(t *testing.T) {
+
+	path := saveArchive{
+		layers:       []testLayer{{id: "a", files: []testFile{{name: "a", body: "a"}}}},
+		repositories: map[string]map[string]string{"old": {"latest": "a"}},
+		manifest:     true,
+	}.write(t)
+
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := openImage(t, path).SetNameWithBackup("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if backup != path+".bak" {
+		t.Fatalf("SetNameWithBackup() = %s, want %s.bak", backup, path)
+	}
+
+	saved, err := ioutil.ReadFile(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(saved, original) {
+		t.Fatal("backup differs from the archive before the edit")
+	}
+
+	for p, name := range map[string]string{path: "new", backup: "old"} {
+		if repos, err := openImage(t, p).Repositories(); err != nil || repos[name]["latest"] != "a" || len(repos) != 1 {
+			t.Fatalf("Repositories() of %s = %v (%v), want %s:latest only", p, repos, err, name)
+		}
+	}
+
+}
@@ -0,0 +1,67 @@
+package dockerscope
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	baseNameAnnotation   = "org.opencontainers.image.base.name"
+	baseDigestAnnotation = "org.opencontainers.image.base.digest"
+)
+
+// baseImage returns the reference and digest of the base image as recorded in the labels of the image or, for
+// OCI images, the annotations of its manifest
+func (i *Image) baseImage() (name, digest string, err error) {
+
+	labels, err := i.Labels()
+	if err != nil {
+		return "", "", err
+	}
+
+	name, digest = labels[baseNameAnnotation], labels[baseDigestAnnotation]
+
+	if i.isOCI() {
+
+		m, err := i.ociManifest()
+		if err != nil {
+			return "", "", err
+		}
+
+		if name == "" {
+			name = m.Annotations[baseNameAnnotation]
+		}
+
+		if digest == "" {
+			digest = m.Annotations[baseDigestAnnotation]
+		}
+
+	}
+
+	return name, digest, nil
+
+}
+
+// UsesFloatingBase reports whether the image was built on a base image referenced without a digest and with
+// no tag or the latest tag, so that rebuilding it may pick up a different base. The base image is read from the
+// org.opencontainers.image.base.name and .digest labels or manifest annotations.
+func (i *Image) UsesFloatingBase() (bool, error) {
+
+	name, digest, err := i.baseImage()
+	if err != nil {
+		return false, err
+	}
+
+	if name == "" && digest == "" {
+		return false, fmt.Errorf("No base image recorded in image %s", i.PathToSource)
+	}
+
+	if digest != "" || strings.Contains(name, "@") {
+		return false, nil
+	}
+
+	_, tag := splitTag(name)
+
+	return tag == "" || tag == defaultTag, nil
+
+}
@@ -0,0 +1,42 @@
+package dockerscope
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUsesFloatingBase(t *testing.T) {
+
+	digest := "sha256:" + strings.Repeat("ab", 32)
+
+	for _, tc := range []struct {
+		labels   map[string]string
+		floating bool
+	}{
+		{map[string]string{baseNameAnnotation: "docker.io/library/alpine:latest"}, true},
+		{map[string]string{baseNameAnnotation: "alpine"}, true},
+		{map[string]string{baseNameAnnotation: "localhost:5000/alpine"}, true},
+		{map[string]string{baseNameAnnotation: "alpine:3.19"}, false},
+		{map[string]string{baseNameAnnotation: "alpine@" + digest}, false},
+		{map[string]string{baseNameAnnotation: "alpine:latest", baseDigestAnnotation: digest}, false},
+	} {
+
+		img := openImage(t, saveArchive{layers: []testLayer{{id: "a", config: map[string]interface{}{"Labels": tc.labels}}}}.write(t))
+
+		floating, err := img.UsesFloatingBase()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if floating != tc.floating {
+			t.Fatalf("UsesFloatingBase() with labels %v = %v, want %v", tc.labels, floating, tc.floating)
+		}
+	}
+
+	img := openImage(t, ociArchive{layers: [][]testFile{{{name: "a"}}}}.write(t))
+
+	if _, err := img.UsesFloatingBase(); err == nil {
+		t.Fatal("UsesFloatingBase() succeeded on an image without a recorded base")
+	}
+
+}
@@ -0,0 +1,279 @@
+package dockerscope
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	dockerConfigMediaType = "application/vnd.docker.container.image.v1+json"
+	dockerLayerMediaType  = "application/vnd.docker.image.rootfs.diff.tar"
+	ociLayerMediaType     = "application/vnd.oci.image.layer.v1.tar"
+)
+
+// BlobInfo describes a content addressed file of an image archive
+type BlobInfo struct {
+	Digest    string
+	Size      int64
+	MediaType string
+	// RefCount is the number of manifests, indexes or manifest.json entries referring to the blob, blobs no
+	// longer referred to have a RefCount of 0
+	RefCount int
+}
+
+// Blobs returns every blob of the image archive sorted by digest. For OCI images these are the manifests,
+// configs and layers stored in the blob directory, for docker save archives with a manifest.json the configs
+// and layers it lists. The layers of v1 images are returned with a RefCount of 1.
+func (i *Image) Blobs() ([]BlobInfo, error) {
+
+	if err := i.loadLayers(); err != nil {
+		return nil, err
+	}
+
+	blobs := make(map[string]*BlobInfo)
+	var err error
+
+	switch {
+	case i.isOCI():
+		err = i.collectOCIBlobs(blobs)
+	case i.hasManifest():
+		err = i.collectManifestBlobs(blobs)
+	default:
+		for _, l := range i.Layers {
+			if err = addBlob(blobs, l.path, l.mediaType, 1); err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]BlobInfo, 0, len(blobs))
+
+	for _, b := range blobs {
+		list = append(list, *b)
+	}
+
+	sort.Slice(list, func(a, b int) bool { return list[a].Digest < list[b].Digest })
+
+	return list, nil
+
+}
+
+// addBlob counts refs references to the file at path, keyed by the digest of its content
+func addBlob(blobs map[string]*BlobInfo, path string, mediaType string, refs int) error {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("No blob %s found", path)
+	}
+
+	digest, err := fileDigest(path)
+	if err != nil {
+		return fmt.Errorf("Error reading blob %s: %s", path, err)
+	}
+
+	b, ok := blobs[digest]
+	if !ok {
+		b = &BlobInfo{Digest: digest, Size: info.Size(), MediaType: mediaType}
+		blobs[digest] = b
+	}
+
+	b.RefCount += refs
+
+	if b.MediaType == "" {
+		b.MediaType = mediaType
+	}
+
+	return nil
+
+}
+
+// collectManifestBlobs adds the configs and layers listed by manifest.json
+func (i *Image) collectManifestBlobs(blobs map[string]*BlobInfo) error {
+
+	entries, err := i.readManifest()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+
+		if err := addBlob(blobs, i.manifestConfigPath(entry), dockerConfigMediaType, 1); err != nil {
+			return err
+		}
+
+		for _, l := range entry.Layers {
+			if err := addBlob(blobs, filepath.Join(i.pathToWorkingCopy, filepath.FromSlash(l)), dockerLayerMediaType, 1); err != nil {
+				return err
+			}
+		}
+
+	}
+
+	return nil
+
+}
+
+// collectOCIBlobs adds every blob reachable from the top level index, then the blobs nothing refers to
+func (i *Image) collectOCIBlobs(blobs map[string]*BlobInfo) error {
+
+	index, err := i.ociIndex()
+	if err != nil {
+		return err
+	}
+
+	if err := i.collectReferencedBlobs(index, blobs, 0); err != nil {
+		return err
+	}
+
+	// blobs are stored under the hex part of their digest, next to each other
+	dir := filepath.Dir(i.blobPath(digestPrefix + "0"))
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("Failed to read blobs of image %s", i.PathToSource)
+	}
+
+	for _, f := range files {
+
+		digest := digestPrefix + f.Name()
+
+		if f.IsDir() || !validDigest(digest) || blobs[digest] != nil {
+			continue
+		}
+
+		if err := addBlob(blobs, filepath.Join(dir, f.Name()), "", 0); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// collectReferencedBlobs counts the references of the manifest or index m, descending into every manifest it
+// refers to the first time it is seen
+func (i *Image) collectReferencedBlobs(m *ociManifest, blobs map[string]*BlobInfo, depth int) error {
+
+	if depth > maxLinkDepth {
+		return fmt.Errorf("OCI index nesting too deep in image %s", i.PathToSource)
+	}
+
+	descriptors := m.Manifests
+	if !m.isIndex() {
+		descriptors = append([]ociDescriptor{m.Config}, m.Layers...)
+	}
+
+	for _, d := range descriptors {
+
+		_, seen := blobs[d.Digest]
+
+		if err := addBlob(blobs, i.blobPath(d.Digest), d.MediaType, 1); err != nil {
+			return err
+		}
+
+		if !m.isIndex() || seen {
+			continue
+		}
+
+		child, err := i.readManifestBlob(d.Digest)
+		if err != nil {
+			return err
+		}
+
+		if err := i.collectReferencedBlobs(child, blobs, depth+1); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// locateBlob returns the location in the working copy of the blob with the given digest
+func (i *Image) locateBlob(digest string) (string, error) {
+
+	if err := i.loadLayers(); err != nil {
+		return "", err
+	}
+
+	if i.isOCI() {
+		if _, err := os.Stat(i.blobPath(digest)); err == nil {
+			return i.blobPath(digest), nil
+		}
+		return "", fmt.Errorf("No blob %s found in image %s", digest, i.PathToSource)
+	}
+
+	candidates := make([]string, 0)
+
+	if i.hasManifest() {
+
+		entries, err := i.readManifest()
+		if err != nil {
+			return "", err
+		}
+
+		for _, entry := range entries {
+			candidates = append(candidates, i.manifestConfigPath(entry))
+		}
+
+	}
+
+	for _, l := range i.Layers {
+		candidates = append(candidates, l.path)
+	}
+
+	for _, path := range candidates {
+		if d, err := fileDigest(path); err == nil && d == digest {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("No blob %s found in image %s", digest, i.PathToSource)
+
+}
+
+// ExportBlob copies the layer or config blob with the given digest to destDir/blobs/sha256/<hex>, where an OCI
+// layout or content store expects it. The content is checked against the digest before it is written.
+func (i *Image) ExportBlob(digest string, destDir string) error {
+
+	if !validDigest(digest) {
+		return fmt.Errorf("Invalid digest %q", digest)
+	}
+
+	source, err := i.locateBlob(digest)
+	if err != nil {
+		return err
+	}
+
+	actual, err := fileDigest(source)
+	if err != nil {
+		return fmt.Errorf("Error reading blob %s: %s", digest, err)
+	}
+
+	if actual != digest {
+		return fmt.Errorf("%w: blob %s has digest %s", ErrDigestMismatch, digest, actual)
+	}
+
+	target := filepath.Join(destDir, ociBlobDirectory, "sha256", strings.TrimPrefix(digest, digestPrefix))
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("Error exporting blob: Mkdir failed) %s", target)
+	}
+
+	if err := copyFile(source, target); err != nil {
+		return fmt.Errorf("Error exporting blob: Blob write failed) %s", target)
+	}
+
+	return nil
+
+}
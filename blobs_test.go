@@ -0,0 +1,132 @@
+package dockerscope
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBlobs(t *testing.T) {
+
+	files := []testFile{{name: "bin/busybox", body: "busybox"}}
+	layer := layerTar(files)
+
+	// an arm64 image sharing its only layer with the amd64 image the fixture writes
+	config := mustJSON(map[string]interface{}{"architecture": "arm64", "os": "linux", "rootfs": map[string]interface{}{"type": "layers", "diff_ids": []string{digestOf(layer)}}})
+	manifest := mustJSON(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        descriptor("application/vnd.oci.image.config.v1+json", config),
+		"layers":        []interface{}{descriptor("application/vnd.oci.image.layer.v1.tar", layer)},
+	})
+	garbage := []byte("left behind")
+
+	img := openImage(t, ociArchive{
+		layers:    [][]testFile{files},
+		manifests: []map[string]interface{}{descriptor("application/vnd.oci.image.manifest.v1+json", manifest)},
+		blobs:     [][]byte{config, manifest, garbage},
+	}.write(t))
+
+	blobs, err := img.Blobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs := make(map[string]int)
+	for _, b := range blobs {
+		refs[b.Digest] = b.RefCount
+	}
+
+	// the layer, the manifests and configs of both images and the garbage
+	if len(blobs) != 6 {
+		t.Fatalf("Blobs() = %+v, want 6 blobs", blobs)
+	}
+
+	if refs[digestOf(layer)] != 2 || refs[digestOf(manifest)] != 1 || refs[digestOf(config)] != 1 || refs[digestOf(garbage)] != 0 {
+		t.Fatalf("Blobs() counts references %v, want 2 for the shared layer and 0 for the garbage", refs)
+	}
+
+	for _, b := range blobs {
+		if b.Digest == digestOf(layer) && (b.Size != int64(len(layer)) || b.MediaType != "application/vnd.oci.image.layer.v1.tar") {
+			t.Fatalf("Blobs() describes the layer as %+v", b)
+		}
+	}
+
+	img = openImage(t, saveArchive{layers: []testLayer{{id: "a"}, {id: "b", files: files}}, manifest: true}.write(t))
+
+	// the config and two layers
+	if blobs, err := img.Blobs(); err != nil || len(blobs) != 3 {
+		t.Fatalf("Blobs() of a docker save archive = %+v (%v), want 3 blobs", blobs, err)
+	}
+
+	img = openImage(t, saveArchive{layers: []testLayer{{id: "a"}, {id: "b", files: files}}}.write(t))
+
+	if blobs, err := img.Blobs(); err != nil || len(blobs) != 2 || blobs[0].RefCount != 1 {
+		t.Fatalf("Blobs() of a v1 image = %+v (%v), want its 2 layers", blobs, err)
+	}
+
+}
+
+func TestExportBlob(t *testing.T) {
+
+	files := []testFile{{name: "app", body: "app"}}
+
+	for name, path := range map[string]string{
+		"oci":         ociArchive{layers: [][]testFile{files}, gzip: true}.write(t),
+		"docker save": saveArchive{layers: []testLayer{{id: "a", files: files}}, manifest: true}.write(t),
+	} {
+
+		img := openImage(t, path)
+
+		blobs, err := img.Blobs()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dest := t.TempDir()
+
+		for _, b := range blobs {
+
+			if err := img.ExportBlob(b.Digest, dest); err != nil {
+				t.Fatal(name, err)
+			}
+
+			exported := filepath.Join(dest, "blobs", "sha256", strings.TrimPrefix(b.Digest, "sha256:"))
+
+			if d, err := fileDigest(exported); err != nil || d != b.Digest {
+				t.Fatalf("ExportBlob(%s) of %s wrote content with digest %s (%v)", b.Digest, name, d, err)
+			}
+		}
+
+		if err := img.ExportBlob(digestOf([]byte("missing")), dest); err == nil {
+			t.Fatalf("ExportBlob() of %s succeeded for a blob the image lacks", name)
+		}
+
+		if err := img.ExportBlob("sha256:../../etc", dest); err == nil {
+			t.Fatalf("ExportBlob() of %s accepted an invalid digest", name)
+		}
+	}
+
+	img := openImage(t, ociArchive{layers: [][]testFile{files}}.write(t))
+
+	layers, err := img.orderedLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := fileDigest(layers[0].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(layers[0].path, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := img.ExportBlob(digest, t.TempDir()); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("ExportBlob() of a tampered blob = %v, want ErrDigestMismatch", err)
+	}
+
+}
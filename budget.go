@@ -0,0 +1,65 @@
+package dockerscope
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrSizeBudgetExceeded is returned by CheckSizeBudget when the image is larger than the budget
+var ErrSizeBudgetExceeded = errors.New("Size budget exceeded")
+
+// CheckSizeBudget fails with ErrSizeBudgetExceeded, stating the actual size and the budget, if the image is
+// larger than maxBytes. The size checked is the total size as docker images reports it or, with
+// Options.BudgetTransferSize, the transfer size with every distinct layer blob counted once. Run in CI, it keeps
+// an image from growing unnoticed.
+func (i *Image) CheckSizeBudget(maxBytes int64) error {
+
+	var size int64
+	var err error
+	kind := "total"
+
+	if i.options.BudgetTransferSize {
+		kind = "transfer"
+		size, err = i.transferSize()
+	} else {
+		size, err = i.DockerReportedSize()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if size > maxBytes {
+		return fmt.Errorf("%w: %s size of image %s is %d bytes, budget is %d bytes", ErrSizeBudgetExceeded, kind, i.PathToSource, size, maxBytes)
+	}
+
+	return nil
+
+}
+
+// transferSize returns the stored size of the distinct layer blobs of the image
+func (i *Image) transferSize() (int64, error) {
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return 0, err
+	}
+
+	digests, err := i.layerBlobDigests()
+	if err != nil {
+		return 0, err
+	}
+
+	seen := make(map[string]bool)
+	var total int64
+
+	for k, l := range layers {
+		if !seen[digests[k]] {
+			seen[digests[k]] = true
+			total += l.size()
+		}
+	}
+
+	return total, nil
+
+}
@@ -0,0 +1,34 @@
+package dockerscope
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckSizeBudget(t *testing.T) {
+
+	path := ociArchive{layers: [][]testFile{{{name: "data", body: strings.Repeat("x", 100000)}}}, gzip: true}.write(t)
+
+	img := openImage(t, path)
+
+	if err := img.CheckSizeBudget(100000); err != nil {
+		t.Fatalf("CheckSizeBudget(100000) of a 100000 byte image = %v, want nil", err)
+	}
+
+	if err := img.CheckSizeBudget(99999); !errors.Is(err, ErrSizeBudgetExceeded) || !strings.Contains(err.Error(), "total") {
+		t.Fatalf("CheckSizeBudget(99999) of a 100000 byte image = %v, want ErrSizeBudgetExceeded for the total size", err)
+	}
+
+	// the gzipped layer is a few hundred bytes
+	img = openImageWithOptions(t, path, Options{BudgetTransferSize: true})
+
+	if err := img.CheckSizeBudget(5000); err != nil {
+		t.Fatalf("CheckSizeBudget(5000) of the transfer size = %v, want nil", err)
+	}
+
+	if err := img.CheckSizeBudget(10); !errors.Is(err, ErrSizeBudgetExceeded) || !strings.Contains(err.Error(), "transfer") {
+		t.Fatalf("CheckSizeBudget(10) of the transfer size = %v, want ErrSizeBudgetExceeded for the transfer size", err)
+	}
+
+}
@@ -0,0 +1,273 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Builder assembles an image from scratch, without a Dockerfile or a docker daemon. The archive Build writes is
+// in docker save format and loads with docker load.
+type Builder struct {
+	name    string
+	layers  [][]*builderFile
+	env     []string
+	cmd     []string
+	created time.Time
+}
+
+// builderFile is a file added to a layer of a Builder
+type builderFile struct {
+	path    string
+	content []byte
+	mode    os.FileMode
+}
+
+// NewBuilder returns a builder for an image named name, such as app:1.0 or app for app:latest, with a single
+// empty layer
+func NewBuilder(name string) *Builder {
+	return &Builder{name: name, layers: [][]*builderFile{{}}, created: time.Now().UTC()}
+}
+
+// AddFile adds a regular file at filePath with content and mode to the top layer. The directories above the
+// file are created as needed.
+func (b *Builder) AddFile(filePath string, content []byte, mode os.FileMode) {
+	top := len(b.layers) - 1
+	b.layers[top] = append(b.layers[top], &builderFile{path: filePath, content: content, mode: mode})
+}
+
+// AddLayer starts a new layer on top of the previous ones, later files are added to it
+func (b *Builder) AddLayer() {
+	b.layers = append(b.layers, []*builderFile{})
+}
+
+// SetCmd sets the default command of the image
+func (b *Builder) SetCmd(cmd []string) {
+	b.cmd = cmd
+}
+
+// SetEnv sets the environment variable key of the image to value
+func (b *Builder) SetEnv(key, value string) {
+
+	for k, e := range b.env {
+		if strings.HasPrefix(e, key+"=") {
+			b.env[k] = key + "=" + value
+			return
+		}
+	}
+
+	b.env = append(b.env, key+"="+value)
+
+}
+
+// SetCreated sets the creation time recorded for the image and the time stamp of its files, the time NewBuilder
+// was called if not set
+func (b *Builder) SetCreated(t time.Time) {
+	b.created = t.UTC()
+}
+
+// builtLayer is a layer tarball Build assembled
+type builtLayer struct {
+	id      string
+	diffId  string
+	tarball []byte
+}
+
+// Build writes the image to w as a tar archive in docker save format: a v1 directory per layer, the image
+// config, manifest.json and a repositories file
+func (b *Builder) Build(w io.Writer) error {
+
+	name, tag := splitTag(b.name)
+	if name == "" {
+		return fmt.Errorf("Invalid image name %s", b.name)
+	}
+	if tag == "" {
+		tag = defaultTag
+	}
+
+	layers := make([]*builtLayer, 0, len(b.layers))
+	parent := ""
+
+	for _, files := range b.layers {
+
+		tarball, err := b.layerTarball(files)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(tarball)
+		diffId := digestPrefix + hex.EncodeToString(sum[:])
+
+		// v1 layer ids only need to be unique, derive them from the chain of layers below
+		chain := sha256.Sum256([]byte(parent + " " + diffId))
+		id := hex.EncodeToString(chain[:])
+
+		layers = append(layers, &builtLayer{id: id, diffId: diffId, tarball: tarball})
+		parent = id
+
+	}
+
+	runtimeConfig := map[string]interface{}{}
+	if b.env != nil {
+		runtimeConfig["Env"] = b.env
+	}
+	if b.cmd != nil {
+		runtimeConfig["Cmd"] = b.cmd
+	}
+
+	config, err := b.imageConfig(layers, runtimeConfig)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(config)
+	configFile := hex.EncodeToString(sum[:]) + ".json"
+
+	tarball := tar.NewWriter(w)
+
+	write := func(name string, data []byte) error {
+		header := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data)), ModTime: b.created}
+		if err := tarball.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := tarball.Write(data)
+		return err
+	}
+
+	layerPaths := make([]string, 0, len(layers))
+	parent = ""
+
+	for k, l := range layers {
+
+		if err := tarball.WriteHeader(&tar.Header{Name: l.id + "/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: b.created}); err != nil {
+			return fmt.Errorf("Error building image: %s", err)
+		}
+
+		layerConfig := map[string]interface{}{"id": l.id, "created": b.created}
+		if parent != "" {
+			layerConfig["parent"] = parent
+		}
+
+		// like docker save, the latest layer carries the runtime configuration for tools reading v1 layers only
+		if k == len(layers)-1 {
+			layerConfig["architecture"], layerConfig["os"], layerConfig["config"] = runtime.GOARCH, "linux", runtimeConfig
+		}
+
+		data, _ := json.Marshal(layerConfig)
+
+		for _, f := range []struct {
+			name string
+			data []byte
+		}{{"VERSION", []byte("1.0")}, {layerConfigFile, data}, {layerTarFile, l.tarball}} {
+			if err := write(l.id+"/"+f.name, f.data); err != nil {
+				return fmt.Errorf("Error building image: %s", err)
+			}
+		}
+
+		layerPaths = append(layerPaths, l.id+"/"+layerTarFile)
+		parent = l.id
+
+	}
+
+	manifest, _ := json.Marshal([]*manifestEntry{{Config: configFile, RepoTags: []string{name + ":" + tag}, Layers: layerPaths}})
+	repositories, _ := json.Marshal(map[string]map[string]string{name: {tag: parent}})
+
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{configFile, config}, {dockerManifestFile, manifest}, {imageConfigFile, repositories}} {
+		if err := write(f.name, f.data); err != nil {
+			return fmt.Errorf("Error building image: %s", err)
+		}
+	}
+
+	if err := tarball.Close(); err != nil {
+		return fmt.Errorf("Error building image: %s", err)
+	}
+
+	return nil
+
+}
+
+// layerTarball returns the tarball of a layer holding files, with an entry for every directory above them
+func (b *Builder) layerTarball(files []*builderFile) ([]byte, error) {
+
+	var buffer bytes.Buffer
+	tarball := tar.NewWriter(&buffer)
+	dirs := make(map[string]bool)
+
+	for _, f := range files {
+
+		name := strings.TrimPrefix(cleanPath(f.path), "/")
+		if name == "" {
+			return nil, fmt.Errorf("Invalid file path %s", f.path)
+		}
+
+		var parents []string
+		for dir := path.Dir(name); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+			parents = append([]string{dir}, parents...)
+		}
+
+		for _, dir := range parents {
+			if err := tarball.WriteHeader(&tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: b.created}); err != nil {
+				return nil, err
+			}
+		}
+
+		header := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: int64(f.mode.Perm()), Size: int64(len(f.content)), ModTime: b.created}
+
+		if err := tarball.WriteHeader(header); err != nil {
+			return nil, err
+		}
+
+		if _, err := tarball.Write(f.content); err != nil {
+			return nil, err
+		}
+
+	}
+
+	if err := tarball.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+
+}
+
+// imageConfig returns the config of the image built from layers with runtimeConfig
+func (b *Builder) imageConfig(layers []*builtLayer, runtimeConfig map[string]interface{}) ([]byte, error) {
+
+	diffIds := make([]string, len(layers))
+	history := make([]ociHistory, len(layers))
+
+	for k, l := range layers {
+		diffIds[k] = l.diffId
+		history[k] = ociHistory{Created: b.created, CreatedBy: "dockerscope builder"}
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"architecture": runtime.GOARCH,
+		"os":           "linux",
+		"created":      b.created,
+		"config":       runtimeConfig,
+		"rootfs":       rootfs{Type: "layers", DiffIds: diffIds},
+		"history":      history,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Error building image: Json failed %s", b.name)
+	}
+
+	return canonicalJSON(data)
+
+}
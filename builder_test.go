@@ -0,0 +1,69 @@
+package dockerscope
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+
+	b := NewBuilder("tools/hello")
+	b.AddFile("/usr/local/bin/hello", []byte("#!/bin/sh\necho hello\n"), 0755)
+	b.SetEnv("MODE", "debug")
+	b.SetEnv("MODE", "production")
+	b.AddLayer()
+	b.AddFile("etc/motd", []byte("hello"), 0644)
+	b.SetCmd([]string{"/usr/local/bin/hello"})
+
+	path := filepath.Join(t.TempDir(), "hello.tar")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Build(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	img := openImage(t, path)
+
+	if err := img.SelfTest(); err != nil {
+		t.Fatalf("SelfTest() of the built image = %v", err)
+	}
+
+	c, err := img.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c.Cmd, []string{"/usr/local/bin/hello"}) || !reflect.DeepEqual(c.Env, []string{"MODE=production"}) {
+		t.Fatalf("built image has Cmd %q and Env %q, want [/usr/local/bin/hello] and [MODE=production]", c.Cmd, c.Env)
+	}
+
+	if tags, err := img.ListTags(); err != nil || !reflect.DeepEqual(tags, []string{"tools/hello:latest"}) {
+		t.Fatalf("ListTags() of the built image = %q (%v), want [tools/hello:latest]", tags, err)
+	}
+
+	layers, err := img.orderedLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(layers) != 2 {
+		t.Fatalf("built image has %d layers, want 2", len(layers))
+	}
+
+	data, err := img.ReadFile("/usr/local/bin/hello")
+	if err != nil || string(data) != "#!/bin/sh\necho hello\n" {
+		t.Fatalf("ReadFile(/usr/local/bin/hello) = %q (%v), want the added script", data, err)
+	}
+
+	if s, err := img.Stat("/usr/local/bin/hello"); err != nil || s.Mode.Perm() != 0755 {
+		t.Fatalf("Stat(/usr/local/bin/hello) = %+v (%v), want mode 0755", s, err)
+	}
+
+}
@@ -0,0 +1,45 @@
+package dockerscope
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// canonicalJSON returns raw re-encoded with sorted object keys, without insignificant whitespace and with numbers
+// kept exactly as written
+func canonicalJSON(raw []byte) ([]byte, error) {
+
+	var v interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), nil
+
+}
+
+// marshalConfig encodes an image config or layer json in canonical form, so that writing back an unchanged
+// config produces the same bytes and therefore the same digest
+func marshalConfig(config map[string]json.RawMessage) ([]byte, error) {
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return canonicalJSON(data)
+
+}
@@ -0,0 +1,65 @@
+package dockerscope
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestMarshalConfig(t *testing.T) {
+
+	raw := []byte(`{"z": 1, "a": {"y": [{"b": 1e3, "a": "x<&>"}], "c": null}, "m": {"q": 2.50, "p": 1}}`)
+
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := marshalConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `{"a":{"c":null,"y":[{"a":"x<&>","b":1e3}]},"m":{"p":1,"q":2.50},"z":1}`; string(first) != want {
+		t.Fatalf("marshalConfig() = %s, want %s", first, want)
+	}
+
+	if err := json.Unmarshal(first, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := marshalConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(first, second) {
+		t.Fatalf("marshalConfig() of the unchanged config = %s, then %s", first, second)
+	}
+
+	for name, path := range map[string]string{
+		"oci":         ociArchive{layers: [][]testFile{{{name: "a"}}}}.write(t),
+		"docker save": saveArchive{layers: []testLayer{{id: "a", config: map[string]interface{}{"Cmd": []string{"sh"}}}}, manifest: true}.write(t),
+	} {
+
+		img := openImage(t, path)
+
+		if err := img.SetLabel("version", "1"); err != nil {
+			t.Fatal(err)
+		}
+
+		before, err := img.imageId()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := img.SetLabel("version", "1"); err != nil {
+			t.Fatal(err)
+		}
+
+		if after, err := img.imageId(); err != nil || after != before {
+			t.Fatalf("image id of %s changed from %s to %s (%v) setting a label to its value", name, before, after, err)
+		}
+	}
+
+}
@@ -0,0 +1,287 @@
+package dockerscope
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// layerDiffIds returns the diff ids of the layers of the image in stack order, computed from their content
+func (i *Image) layerDiffIds() ([]string, error) {
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	diffIds := make([]string, len(layers))
+
+	for k, l := range layers {
+		if diffIds[k], _, err = i.layerContent(l.Id); err != nil {
+			return nil, err
+		}
+	}
+
+	return diffIds, nil
+
+}
+
+// SameImage reports whether the archives at pathA and pathB hold the same image, even if they were saved in
+// different formats. Images with a config blob are the same if their image ids are. Otherwise they are the same
+// if their layers have the same content in the same order and they share the same runtime configuration.
+func SameImage(pathA, pathB string) (bool, error) {
+
+	a, err := NewImage(pathA)
+	if err != nil {
+		return false, err
+	}
+	defer a.Close()
+
+	b, err := NewImage(pathB)
+	if err != nil {
+		return false, err
+	}
+	defer b.Close()
+
+	if err := a.loadLayers(); err != nil {
+		return false, err
+	}
+
+	if err := b.loadLayers(); err != nil {
+		return false, err
+	}
+
+	if (a.isOCI() || a.hasManifest()) && (b.isOCI() || b.hasManifest()) {
+
+		idA, err := a.imageId()
+		if err != nil {
+			return false, err
+		}
+
+		idB, err := b.imageId()
+		if err != nil {
+			return false, err
+		}
+
+		if idA == idB {
+			return true, nil
+		}
+
+	}
+
+	diffA, err := a.layerDiffIds()
+	if err != nil {
+		return false, err
+	}
+
+	diffB, err := b.layerDiffIds()
+	if err != nil {
+		return false, err
+	}
+
+	if !equalStrings(diffA, diffB) {
+		return false, nil
+	}
+
+	configA, err := a.Config()
+	if err != nil {
+		return false, err
+	}
+
+	configB, err := b.Config()
+	if err != nil {
+		return false, err
+	}
+
+	jsonA, _ := json.Marshal(configA)
+	jsonB, _ := json.Marshal(configB)
+
+	return string(jsonA) == string(jsonB), nil
+
+}
+
+// DetectCommonBase returns the longest stack of base layers all images share, compared by content. The layers
+// are those of the first image, base layer first. Images without a shared base layer have an empty common base.
+func DetectCommonBase(images []*Image) ([]*Layer, error) {
+
+	if len(images) == 0 {
+		return []*Layer{}, nil
+	}
+
+	base, err := images[0].orderedLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	common, err := images[0].layerDiffIds()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, image := range images[1:] {
+
+		diffIds, err := image.layerDiffIds()
+		if err != nil {
+			return nil, err
+		}
+
+		n := 0
+		for n < len(common) && n < len(diffIds) && common[n] == diffIds[n] {
+			n++
+		}
+
+		common = common[:n]
+
+	}
+
+	return base[:len(common)], nil
+
+}
+
+// RebaseImpact describes what moving an image from one base image to another changes
+type RebaseImpact struct {
+	// ReplacedLayers are the lower layers of the image that belong to the old base, base layer first
+	ReplacedLayers []*Layer
+	// NewLayers are the layers of the new base that would take their place, base layer first
+	NewLayers []*Layer
+	// SizeDelta is the content size of the new base minus that of the old base, so negative if the image shrinks
+	SizeDelta int64
+}
+
+// EstimateRebaseImpact reports which layers of image would be replaced if it were rebuilt on newBase instead of
+// oldBase and how its size would change. image must be built on oldBase, that is start with its layers.
+func EstimateRebaseImpact(image, oldBase, newBase *Image) (*RebaseImpact, error) {
+
+	common, err := DetectCommonBase([]*Image{image, oldBase})
+	if err != nil {
+		return nil, err
+	}
+
+	oldLayers, err := oldBase.orderedLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(common) != len(oldLayers) {
+		return nil, fmt.Errorf("Image %s is not built on %s", image.PathToSource, oldBase.PathToSource)
+	}
+
+	newLayers, err := newBase.orderedLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	oldSize, err := oldBase.contentSize(oldLayers)
+	if err != nil {
+		return nil, err
+	}
+
+	newSize, err := newBase.contentSize(newLayers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RebaseImpact{ReplacedLayers: common, NewLayers: newLayers, SizeDelta: newSize - oldSize}, nil
+
+}
+
+// contentSize returns the summed size of the files the layers contain
+func (i *Image) contentSize(layers []*Layer) (int64, error) {
+
+	var total int64
+
+	for _, l := range layers {
+
+		_, size, err := i.layerContent(l.Id)
+		if err != nil {
+			return 0, err
+		}
+
+		total += size
+
+	}
+
+	return total, nil
+
+}
+
+// layerBlobDigests returns the digests of the stored layer blobs of the image in stack order
+func (i *Image) layerBlobDigests() ([]string, error) {
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	digests := make([]string, len(layers))
+
+	for k, l := range layers {
+		if digests[k], err = fileDigest(l.path); err != nil {
+			return nil, fmt.Errorf("Error reading layer %s: %s", l.Id, err)
+		}
+	}
+
+	return digests, nil
+
+}
+
+// LayersUnchangedSince reports whether the image has the same layer blobs in the same order as original, byte
+// for byte. Open original before editing the image to check that edits of the config, such as SetLabel, leave
+// the layers alone.
+func (i *Image) LayersUnchangedSince(original *Image) (bool, error) {
+
+	before, err := original.layerBlobDigests()
+	if err != nil {
+		return false, err
+	}
+
+	after, err := i.layerBlobDigests()
+	if err != nil {
+		return false, err
+	}
+
+	return equalStrings(before, after), nil
+
+}
+
+// DeltaSize returns the stored size of the layer blobs of newer that older does not have, compared by digest.
+// This is what pushing newer transfers to a registry that already holds older. A blob newer stores more than
+// once is counted once.
+func DeltaSize(older, newer *Image) (int64, error) {
+
+	cached, err := older.layerBlobDigests()
+	if err != nil {
+		return 0, err
+	}
+
+	seen := make(map[string]bool)
+
+	for _, d := range cached {
+		seen[d] = true
+	}
+
+	layers, err := newer.orderedLayers()
+	if err != nil {
+		return 0, err
+	}
+
+	digests, err := newer.layerBlobDigests()
+	if err != nil {
+		return 0, err
+	}
+
+	var delta int64
+
+	for k, l := range layers {
+
+		if seen[digests[k]] {
+			continue
+		}
+
+		seen[digests[k]] = true
+		delta += l.size()
+
+	}
+
+	return delta, nil
+
+}
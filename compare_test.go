@@ -0,0 +1,168 @@
+package dockerscope
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSameImage(t *testing.T) {
+
+	layers := []testLayer{
+		{id: "base", files: []testFile{{name: "etc/os-release", body: "alpine"}}},
+		{id: "app", config: map[string]interface{}{"Cmd": []string{"/app"}}, files: []testFile{{name: "app", body: "v1"}}},
+	}
+
+	v1 := saveArchive{layers: layers}.write(t)
+	manifest := saveArchive{layers: layers, repositories: map[string]map[string]string{"app": {"1": "app"}}, manifest: true}.write(t)
+
+	same, err := SameImage(v1, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !same {
+		t.Fatal("SameImage() = false for a v1 and a manifest save of one image, want true")
+	}
+
+	layers[1].files = []testFile{{name: "app", body: "v2"}}
+	changed := saveArchive{layers: layers, manifest: true}.write(t)
+
+	if same, err := SameImage(v1, changed); err != nil || same {
+		t.Fatalf("SameImage() = %v (%v) for images of different content, want false", same, err)
+	}
+
+	if _, err := SameImage(v1, v1+".missing"); err == nil {
+		t.Fatal("SameImage() succeeded on a missing archive")
+	}
+
+}
+
+func TestDetectCommonBase(t *testing.T) {
+
+	base := []testLayer{
+		{id: "os", files: []testFile{{name: "etc/os-release", body: "debian"}}},
+		{id: "runtime", files: []testFile{{name: "usr/bin/python3", body: "python"}}},
+	}
+
+	var images []*Image
+	for _, app := range []string{"api", "worker", "cron"} {
+		layers := append(append([]testLayer{}, base...), testLayer{id: app, files: []testFile{{name: "app/" + app, body: app}}})
+		images = append(images, openImage(t, saveArchive{layers: layers, manifest: app != "worker"}.write(t)))
+	}
+
+	common, err := DetectCommonBase(images)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(common) != 2 || common[0].Id != "os" || common[1].Id != "runtime" {
+		t.Fatalf("DetectCommonBase() returned %d layers, want os and runtime", len(common))
+	}
+
+	other := openImage(t, saveArchive{layers: []testLayer{{id: "os", files: []testFile{{name: "etc/os-release", body: "alpine"}}}}}.write(t))
+
+	if common, err := DetectCommonBase(append(images, other)); err != nil || len(common) != 0 {
+		t.Fatalf("DetectCommonBase() with a different base = %d layers (%v), want none", len(common), err)
+	}
+
+}
+
+func TestEstimateRebaseImpact(t *testing.T) {
+
+	debian := []testLayer{
+		{id: "debian", files: []testFile{{name: "usr/lib/libc.so", body: strings.Repeat("d", 1000)}}},
+		{id: "python", files: []testFile{{name: "usr/bin/python3", body: strings.Repeat("p", 500)}}},
+	}
+	slim := []testLayer{{id: "slim", files: []testFile{{name: "usr/lib/libc.so", body: strings.Repeat("s", 300)}, {name: "usr/bin/python3", body: strings.Repeat("p", 400)}}}}
+
+	app := append(append([]testLayer{}, debian...), testLayer{id: "app", files: []testFile{{name: "app/main.py", body: "print()"}}})
+
+	image := openImage(t, saveArchive{layers: app, manifest: true}.write(t))
+	oldBase := openImage(t, saveArchive{layers: debian}.write(t))
+	newBase := openImage(t, saveArchive{layers: slim}.write(t))
+
+	impact, err := EstimateRebaseImpact(image, oldBase, newBase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(impact.ReplacedLayers) != 2 || impact.ReplacedLayers[0].Id != "debian" || impact.ReplacedLayers[1].Id != "python" {
+		t.Fatalf("EstimateRebaseImpact() replaces %d layers, want debian and python", len(impact.ReplacedLayers))
+	}
+
+	if len(impact.NewLayers) != 1 || impact.NewLayers[0].Id != "slim" {
+		t.Fatalf("EstimateRebaseImpact() adds %d layers, want slim", len(impact.NewLayers))
+	}
+
+	if impact.SizeDelta != 700-1500 {
+		t.Fatalf("EstimateRebaseImpact().SizeDelta = %d, want %d", impact.SizeDelta, 700-1500)
+	}
+
+	if _, err := EstimateRebaseImpact(image, newBase, oldBase); err == nil {
+		t.Fatal("EstimateRebaseImpact() succeeded for an image not built on the old base")
+	}
+
+}
+
+func TestLayersUnchangedSince(t *testing.T) {
+
+	for name, path := range map[string]string{
+		"oci": ociArchive{layers: [][]testFile{{{name: "etc/motd", body: "hi"}}, {{name: "app", body: "app"}}}, gzip: true}.write(t),
+		"docker save": saveArchive{layers: []testLayer{
+			{id: "base", files: []testFile{{name: "etc/motd", body: "hi"}}},
+			{id: "app", files: []testFile{{name: "app", body: "app"}}},
+		}, manifest: true}.write(t),
+	} {
+
+		original := openImage(t, path)
+		if err := original.loadLayers(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := openImage(t, path).SetLabel("org.opencontainers.image.version", "2"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		edited := openImage(t, path)
+
+		if unchanged, err := edited.LayersUnchangedSince(original); err != nil || !unchanged {
+			t.Fatalf("LayersUnchangedSince() of %s after SetLabel() = %v (%v), want true", name, unchanged, err)
+		}
+
+		if err := edited.CoalesceLayers(1); err != nil {
+			t.Fatal(err)
+		}
+
+		if unchanged, err := openImage(t, path).LayersUnchangedSince(original); err != nil || unchanged {
+			t.Fatalf("LayersUnchangedSince() of %s after CoalesceLayers() = %v (%v), want false", name, unchanged, err)
+		}
+	}
+
+}
+
+func TestDeltaSize(t *testing.T) {
+
+	base := []testFile{{name: "usr/lib/libc.so", body: strings.Repeat("c", 4000)}}
+
+	older := openImage(t, ociArchive{layers: [][]testFile{base, {{name: "app", body: "v1"}}}, gzip: true}.write(t))
+	newer := openImage(t, ociArchive{layers: [][]testFile{base, {{name: "app", body: "v2, a little longer"}}}, gzip: true}.write(t))
+
+	delta, err := DeltaSize(older, newer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err := newer.orderedLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if delta == 0 || delta != layers[1].size() {
+		t.Fatalf("DeltaSize() = %d, want the %d compressed bytes of the changed top layer", delta, layers[1].size())
+	}
+
+	if delta, err := DeltaSize(newer, newer); err != nil || delta != 0 {
+		t.Fatalf("DeltaSize() of an image to itself = %d (%v), want 0", delta, err)
+	}
+
+}
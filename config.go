@@ -0,0 +1,726 @@
+package dockerscope
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alexflint/go-filemutex"
+)
+
+// ContainerConfig is the runtime configuration a container started from the image inherits.
+// Cmd and Entrypoint are nil when the image inherits them (null) and empty when they are explicitly cleared ([]).
+// Windows images that store them as a single escaped command line (ArgsEscaped) have it split into arguments.
+// StopTimeout is nil when the image does not declare one.
+type ContainerConfig struct {
+	User         string
+	ExposedPorts map[string]struct{}
+	Env          []string
+	Cmd          []string
+	Entrypoint   []string
+	WorkingDir   string
+	Labels       map[string]string
+	StopSignal   string
+	StopTimeout  *int
+	OnBuild      []string
+	Hostname     string
+	Domainname   string
+	ArgsEscaped  bool
+}
+
+// Expectations declares what the configuration of an image should look like. Zero values are not checked.
+type Expectations struct {
+	Labels       map[string]string
+	Env          map[string]string
+	User         string
+	ExposedPorts []string
+	Entrypoint   []string
+}
+
+// layerConfigPath returns the location of the json file of layerId in the working copy
+func (i *Image) layerConfigPath(layerId string) string {
+	return i.pathToWorkingCopy + string(filepath.Separator) + layerId + string(filepath.Separator) + layerConfigFile
+}
+
+// readLayerConfig returns the top level fields of the json file of layerId
+func (i *Image) readLayerConfig(layerId string) (map[string]json.RawMessage, error) {
+
+	path := i.layerConfigPath(layerId)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read layer config %s", path)
+	}
+
+	var layerConfig map[string]json.RawMessage
+
+	if err := json.Unmarshal(data, &layerConfig); err != nil {
+		return nil, fmt.Errorf("Unexpected data schema in image %s", path)
+	}
+
+	return layerConfig, nil
+
+}
+
+// imageConfig returns the top level fields of the image config. OCI images keep it in a config blob,
+// v1 images in the json file of the latest layer.
+func (i *Image) imageConfig() (map[string]json.RawMessage, error) {
+
+	if err := i.extract(); err != nil {
+		return nil, err
+	}
+
+	if !i.isOCI() {
+
+		l, err := i.latestLayer()
+		if err != nil {
+			return nil, err
+		}
+
+		return i.readLayerConfig(l.Id)
+
+	}
+
+	m, err := i.ociManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := i.readBlob(m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	var imageConfig map[string]json.RawMessage
+
+	if err := json.Unmarshal(data, &imageConfig); err != nil {
+		return nil, fmt.Errorf("Unexpected data schema for image config %s", m.Config.Digest)
+	}
+
+	return imageConfig, nil
+
+}
+
+// Config returns the runtime configuration of the image. Old v1 images that record no `config` in the json of
+// the latest layer fall back to its `container_config`, then to the layers below it, and have the ports of
+// their legacy PortSpecs reported as ExposedPorts.
+func (i *Image) Config() (*ContainerConfig, error) {
+
+	imageConfig, err := i.imageConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	raw := runtimeConfig(imageConfig)
+
+	if raw == nil && !i.isOCI() {
+		if raw, err = i.v1RuntimeConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &ContainerConfig{}
+
+	if raw == nil {
+		return c, nil
+	}
+
+	if err := json.Unmarshal(commandsAsLists(raw), c); err != nil {
+		return nil, fmt.Errorf("Unexpected schema for `config` field in image %s", i.PathToSource)
+	}
+
+	var osName string
+	json.Unmarshal(imageConfig["os"], &osName)
+
+	if c.ArgsEscaped && strings.EqualFold(osName, "windows") {
+		c.Cmd = splitEscapedCommand(c.Cmd)
+		c.Entrypoint = splitEscapedCommand(c.Entrypoint)
+	}
+
+	legacy := &struct{ PortSpecs []string }{}
+	json.Unmarshal(raw, legacy)
+
+	if len(c.ExposedPorts) == 0 && len(legacy.PortSpecs) > 0 {
+		c.ExposedPorts = make(map[string]struct{})
+		for _, p := range legacy.PortSpecs {
+			if !strings.Contains(p, "/") {
+				p += "/tcp"
+			}
+			c.ExposedPorts[p] = struct{}{}
+		}
+	}
+
+	return c, nil
+
+}
+
+// commandsAsLists returns the runtime configuration raw with a Cmd or Entrypoint given as a single string, as
+// some Windows tooling writes them, turned into a list of that string
+func commandsAsLists(raw json.RawMessage) json.RawMessage {
+
+	var config map[string]json.RawMessage
+
+	if json.Unmarshal(raw, &config) != nil {
+		return raw
+	}
+
+	changed := false
+
+	for _, field := range []string{"Cmd", "Entrypoint"} {
+		var command string
+		if raw := config[field]; len(raw) > 0 && raw[0] == '"' && json.Unmarshal(raw, &command) == nil {
+			config[field], _ = json.Marshal([]string{command})
+			changed = true
+		}
+	}
+
+	if !changed {
+		return raw
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return raw
+	}
+
+	return data
+
+}
+
+// splitEscapedCommand splits a command stored as a single escaped Windows command line into its arguments.
+// Commands of more than one element are already split and returned unchanged.
+func splitEscapedCommand(command []string) []string {
+
+	if len(command) != 1 {
+		return command
+	}
+
+	return splitWindowsCommandLine(command[0])
+
+}
+
+// splitWindowsCommandLine splits line into arguments the way CommandLineToArgvW does: arguments are separated by
+// whitespace outside of double quotes, 2n backslashes before a quote are n backslashes and the quote delimits,
+// 2n+1 backslashes before a quote are n backslashes and a literal quote, and "" within quotes is a literal quote
+func splitWindowsCommandLine(line string) []string {
+
+	args := make([]string, 0)
+	var arg strings.Builder
+	inArg, quoted := false, false
+
+	for k := 0; k < len(line); k++ {
+
+		c := line[k]
+
+		switch {
+		case c == '\\':
+			n := 0
+			for k < len(line) && line[k] == '\\' {
+				n++
+				k++
+			}
+			if k < len(line) && line[k] == '"' {
+				arg.WriteString(strings.Repeat("\\", n/2))
+				if n%2 == 1 {
+					arg.WriteByte('"')
+				} else {
+					quoted = !quoted
+				}
+			} else {
+				arg.WriteString(strings.Repeat("\\", n))
+				k--
+			}
+			inArg = true
+		case c == '"':
+			if quoted && k+1 < len(line) && line[k+1] == '"' {
+				arg.WriteByte('"')
+				k++
+			} else {
+				quoted = !quoted
+			}
+			inArg = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteByte(c)
+			inArg = true
+		}
+
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args
+
+}
+
+// runtimeConfig returns the runtime configuration recorded in imageConfig, the `config` field or for old v1
+// layers the `container_config` field, or nil if neither is set
+func runtimeConfig(imageConfig map[string]json.RawMessage) json.RawMessage {
+
+	for _, field := range []string{"config", "container_config"} {
+		if raw, ok := imageConfig[field]; ok && string(raw) != "null" {
+			return raw
+		}
+	}
+
+	return nil
+
+}
+
+// v1RuntimeConfig returns the runtime configuration of the topmost layer below the latest one that records
+// one, or nil if none does
+func (i *Image) v1RuntimeConfig() (json.RawMessage, error) {
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	for k := len(layers) - 2; k >= 0; k-- {
+
+		layerConfig, err := i.readLayerConfig(layers[k].Id)
+		if err != nil {
+			return nil, err
+		}
+
+		if raw := runtimeConfig(layerConfig); raw != nil {
+			return raw, nil
+		}
+
+	}
+
+	return nil, nil
+
+}
+
+// StopTimeout returns the seconds a container started from the image is given to stop before it is killed, ok
+// is false if the image does not declare a timeout. The signal sent to stop it is the StopSignal of the config.
+func (i *Image) StopTimeout() (seconds int, ok bool, err error) {
+
+	c, err := i.Config()
+	if err != nil {
+		return 0, false, err
+	}
+
+	if c.StopTimeout == nil {
+		return 0, false, nil
+	}
+
+	return *c.StopTimeout, true, nil
+
+}
+
+// OnBuild returns the ONBUILD instructions of the image, which run when another image is built on top of it
+func (i *Image) OnBuild() ([]string, error) {
+
+	c, err := i.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.OnBuild == nil {
+		return []string{}, nil
+	}
+
+	return c.OnBuild, nil
+
+}
+
+// EnvMap returns the environment variables of the image keyed by name
+func (i *Image) EnvMap() (map[string]string, error) {
+
+	c, err := i.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	return envMap(c.Env), nil
+
+}
+
+// envMap splits a list of NAME=value pairs into a map
+func envMap(list []string) map[string]string {
+
+	env := make(map[string]string)
+
+	for _, e := range list {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		} else {
+			env[kv[0]] = ""
+		}
+	}
+
+	return env
+
+}
+
+// equalStrings reports whether a and b hold the same elements in the same order
+func equalStrings(a, b []string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k := range a {
+		if a[k] != b[k] {
+			return false
+		}
+	}
+
+	return true
+
+}
+
+// sortedKeys returns the keys of m in ascending order
+func sortedKeys(m map[string]string) []string {
+
+	keys := make([]string, 0, len(m))
+
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+
+}
+
+// MatchesExpectations compares the configuration of the image with exp and returns every mismatch found
+func (i *Image) MatchesExpectations(exp Expectations) ([]string, error) {
+
+	c, err := i.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	mismatches := make([]string, 0)
+
+	// maps are walked by sorted key, so the same image always reports its mismatches in the same order
+	for _, k := range sortedKeys(exp.Labels) {
+		v := exp.Labels[k]
+		if actual, ok := c.Labels[k]; !ok {
+			mismatches = append(mismatches, fmt.Sprintf("Label %s is missing, expected %q", k, v))
+		} else if actual != v {
+			mismatches = append(mismatches, fmt.Sprintf("Label %s is %q, expected %q", k, actual, v))
+		}
+	}
+
+	env := envMap(c.Env)
+
+	for _, k := range sortedKeys(exp.Env) {
+		v := exp.Env[k]
+		if actual, ok := env[k]; !ok {
+			mismatches = append(mismatches, fmt.Sprintf("Env %s is missing, expected %q", k, v))
+		} else if actual != v {
+			mismatches = append(mismatches, fmt.Sprintf("Env %s is %q, expected %q", k, actual, v))
+		}
+	}
+
+	if exp.User != "" && exp.User != c.User {
+		mismatches = append(mismatches, fmt.Sprintf("User is %q, expected %q", c.User, exp.User))
+	}
+
+	for _, p := range exp.ExposedPorts {
+		if !strings.Contains(p, "/") {
+			p = p + "/tcp"
+		}
+		if _, ok := c.ExposedPorts[p]; !ok {
+			mismatches = append(mismatches, fmt.Sprintf("Port %s is not exposed", p))
+		}
+	}
+
+	if exp.Entrypoint != nil && !equalStrings(exp.Entrypoint, c.Entrypoint) {
+		mismatches = append(mismatches, fmt.Sprintf("Entrypoint is %q, expected %q", c.Entrypoint, exp.Entrypoint))
+	}
+
+	return mismatches, nil
+
+}
+
+// editConfig calls fn with the raw runtime configuration of the image and writes the result back to the image.
+// Fields fn does not touch are written back unchanged.
+func (i *Image) editConfig(fn func(config map[string]json.RawMessage) error) error {
+
+	m, err := filemutex.New(i.lockPath())
+	if err != nil {
+		return fmt.Errorf("Error editing image: Setting mutex failed) %s", i.PathToSource)
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	if err := i.extract(); err != nil {
+		return err
+	}
+
+	// old v1 images may only record the runtime configuration in a layer below, Config falls back to it
+	var fallback json.RawMessage
+	if !i.isOCI() {
+		if fallback, err = i.v1RuntimeConfig(); err != nil {
+			return err
+		}
+	}
+
+	edit := func(imageConfig map[string]json.RawMessage) error {
+		return editRuntimeConfig(imageConfig, fallback, fn)
+	}
+
+	if i.isOCI() {
+		err = i.editOCIConfig(edit)
+	} else {
+		err = i.editV1Config(edit)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// the config is content addressed, references pinning its old digest no longer hold
+	if err := i.dropDigestTags(); err != nil {
+		return err
+	}
+
+	if err = i.save(); err != nil {
+		return fmt.Errorf("Error creating image: Tar failed) %s", i.pathToWorkingCopy)
+	}
+
+	return nil
+
+}
+
+// editRuntimeConfig calls fn with the runtime configuration of imageConfig and stores the result back into its
+// `config` field. The configuration edited is the one Config reads: the `config` field, the `container_config`
+// field of old v1 layers or else fallback.
+func editRuntimeConfig(imageConfig map[string]json.RawMessage, fallback json.RawMessage, fn func(config map[string]json.RawMessage) error) error {
+
+	config := make(map[string]json.RawMessage)
+
+	raw := runtimeConfig(imageConfig)
+	if raw == nil {
+		raw = fallback
+	}
+
+	if raw != nil {
+		if err := json.Unmarshal(raw, &config); err != nil {
+			return fmt.Errorf("Unexpected schema for `config` field in image config")
+		}
+	}
+
+	if err := fn(config); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("Error editing image: Json failed for `config` field")
+	}
+
+	imageConfig["config"] = data
+
+	return nil
+
+}
+
+// editV1Config applies fn to the json of the latest layer and, for images saved with a manifest.json, to the
+// config file the manifest references
+func (i *Image) editV1Config(fn func(imageConfig map[string]json.RawMessage) error) error {
+
+	l, err := i.latestLayer()
+	if err != nil {
+		return err
+	}
+
+	layerConfig, err := i.readLayerConfig(l.Id)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(layerConfig); err != nil {
+		return err
+	}
+
+	data, err := marshalConfig(layerConfig)
+	if err != nil {
+		return fmt.Errorf("Error editing image: Json failed %s", i.pathToWorkingCopy)
+	}
+
+	if err = ioutil.WriteFile(i.layerConfigPath(l.Id), data, 0644); err != nil {
+		return fmt.Errorf("Error editing image: Layer config write failed) %s", i.pathToWorkingCopy)
+	}
+
+	if !i.hasManifest() {
+		return nil
+	}
+
+	entries, err := i.readManifest()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+
+		config, err := i.readManifestConfig(entry)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(config); err != nil {
+			return err
+		}
+
+		if err := i.writeManifestConfig(entry, config); err != nil {
+			return err
+		}
+
+	}
+
+	return i.writeManifest(entries)
+
+}
+
+// setConfigField replaces a single field of the runtime configuration with value
+func (i *Image) setConfigField(field string, value interface{}) error {
+
+	return i.editConfig(func(config map[string]json.RawMessage) error {
+
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("Error editing image: Json failed for field %s", field)
+		}
+
+		config[field] = data
+
+		return nil
+
+	})
+
+}
+
+// SetCmd replaces the default command of the image. A nil cmd is written as null so the command is inherited,
+// an empty cmd is written as [] so the command is explicitly cleared.
+func (i *Image) SetCmd(cmd []string) error {
+	return i.setConfigField("Cmd", cmd)
+}
+
+// SetEntrypoint replaces the entrypoint of the image. A nil entrypoint is written as null so the entrypoint is
+// inherited, an empty entrypoint is written as [] so the entrypoint is explicitly cleared.
+func (i *Image) SetEntrypoint(entrypoint []string) error {
+	return i.setConfigField("Entrypoint", entrypoint)
+}
+
+// SetLabel sets the label key of the image to value
+func (i *Image) SetLabel(key, value string) error {
+
+	return i.editConfig(func(config map[string]json.RawMessage) error {
+
+		labels := make(map[string]string)
+
+		if raw, ok := config["Labels"]; ok && string(raw) != "null" {
+			if err := json.Unmarshal(raw, &labels); err != nil {
+				return fmt.Errorf("Unexpected schema for `Labels` field in image config")
+			}
+		}
+
+		labels[key] = value
+
+		data, err := json.Marshal(labels)
+		if err != nil {
+			return fmt.Errorf("Error editing image: Json failed for label %s", key)
+		}
+
+		config["Labels"] = data
+
+		return nil
+
+	})
+
+}
+
+// ClearLabels removes every label from the image
+func (i *Image) ClearLabels() error {
+	return i.setConfigField("Labels", map[string]string{})
+}
+
+// Labels returns the labels of the image
+func (i *Image) Labels() (map[string]string, error) {
+
+	c, err := i.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Labels == nil {
+		return map[string]string{}, nil
+	}
+
+	return c.Labels, nil
+
+}
+
+// LabelOr returns the label key of the image, or def if the image has no such label or its config cannot be read
+func (i *Image) LabelOr(key, def string) string {
+
+	labels, err := i.Labels()
+	if err != nil {
+		return def
+	}
+
+	if value, ok := labels[key]; ok {
+		return value
+	}
+
+	return def
+
+}
+
+// ErrNoSourceURL is returned when the image does not record the URL of its source code
+var ErrNoSourceURL = errors.New("No source URL")
+
+// sourceURLLabels are the labels recording the source code URL of an image, preferred first
+var sourceURLLabels = []string{"org.opencontainers.image.source", "org.label-schema.vcs-url"}
+
+// SourceURL returns the URL of the source code repository the image was built from, as recorded in its
+// org.opencontainers.image.source label, the legacy org.label-schema.vcs-url label or, for OCI images, the
+// annotations of its manifest. Images recording none return ErrNoSourceURL.
+func (i *Image) SourceURL() (string, error) {
+
+	labels, err := i.Labels()
+	if err != nil {
+		return "", err
+	}
+
+	for _, key := range sourceURLLabels {
+		if url := strings.TrimSpace(labels[key]); url != "" {
+			return url, nil
+		}
+	}
+
+	if i.isOCI() {
+
+		m, err := i.ociManifest()
+		if err != nil {
+			return "", err
+		}
+
+		if url := strings.TrimSpace(m.Annotations[sourceURLLabels[0]]); url != "" {
+			return url, nil
+		}
+
+	}
+
+	return "", fmt.Errorf("%w recorded in image %s", ErrNoSourceURL, i.PathToSource)
+
+}
@@ -0,0 +1,383 @@
+package dockerscope
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchesExpectations(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base"},
+		{id: "app", config: map[string]interface{}{
+			"User":         "app",
+			"Env":          []string{"PATH=/usr/bin", "MODE=production"},
+			"Labels":       map[string]string{"version": "1.2"},
+			"ExposedPorts": map[string]interface{}{"8080/tcp": struct{}{}},
+			"Entrypoint":   []string{"/app/main"},
+		}},
+	}}.write(t))
+
+	mismatches, err := img.MatchesExpectations(Expectations{
+		Labels:       map[string]string{"version": "1.3"},
+		Env:          map[string]string{"MODE": "production"},
+		User:         "root",
+		ExposedPorts: []string{"8080"},
+		Entrypoint:   []string{"/app/main"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mismatches) != 2 || !strings.HasPrefix(mismatches[0], "Label version") || !strings.HasPrefix(mismatches[1], "User") {
+		t.Fatalf("MatchesExpectations() = %q, want the label and the user reported", mismatches)
+	}
+
+	want := []string{
+		`Label maintainer is missing, expected "ops"`,
+		`Label team is missing, expected "platform"`,
+		`Label version is "1.2", expected "1.3"`,
+		`Env DEBUG is missing, expected "0"`,
+		`Env MODE is "production", expected "staging"`,
+		`Env PATH is "/usr/bin", expected "/bin"`,
+	}
+
+	// map order changes from run to run, the mismatches must not
+	for k := 0; k < 10; k++ {
+
+		mismatches, err = img.MatchesExpectations(Expectations{
+			Labels: map[string]string{"version": "1.3", "team": "platform", "maintainer": "ops"},
+			Env:    map[string]string{"PATH": "/bin", "MODE": "staging", "DEBUG": "0"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(mismatches, want) {
+			t.Fatalf("MatchesExpectations() = %q, want %q", mismatches, want)
+		}
+	}
+
+	mismatches, err = img.MatchesExpectations(Expectations{User: "app", ExposedPorts: []string{"8080/tcp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mismatches) != 0 {
+		t.Fatalf("MatchesExpectations() = %q, want no mismatches", mismatches)
+	}
+
+}
+
+func TestEntrypointNullAndEmptyRoundTrip(t *testing.T) {
+
+	for _, entrypoint := range [][]string{nil, {}} {
+
+		path := saveArchive{layers: []testLayer{
+			{id: "base", config: map[string]interface{}{"Entrypoint": entrypoint, "Cmd": []string{"sh"}}},
+		}}.write(t)
+
+		img := openImage(t, path)
+
+		c, err := img.Config()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (c.Entrypoint == nil) != (entrypoint == nil) || len(c.Entrypoint) != 0 {
+			t.Fatalf("Config().Entrypoint = %#v, want %#v", c.Entrypoint, entrypoint)
+		}
+
+		if err := img.SetCmd([]string{"bash"}); err != nil {
+			t.Fatal(err)
+		}
+
+		c, err = openImage(t, path).Config()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (c.Entrypoint == nil) != (entrypoint == nil) || len(c.Entrypoint) != 0 {
+			t.Fatalf("Entrypoint after SetCmd = %#v, want %#v", c.Entrypoint, entrypoint)
+		}
+
+		if len(c.Cmd) != 1 || c.Cmd[0] != "bash" {
+			t.Fatalf("Cmd after SetCmd = %q, want [bash]", c.Cmd)
+		}
+	}
+
+}
+
+func TestSetEntrypointNullAndEmpty(t *testing.T) {
+
+	path := saveArchive{layers: []testLayer{
+		{id: "base", config: map[string]interface{}{"Entrypoint": []string{"/init"}}},
+	}}.write(t)
+
+	if err := openImage(t, path).SetEntrypoint([]string{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := openImage(t, path).Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Entrypoint == nil || len(c.Entrypoint) != 0 {
+		t.Fatalf("Entrypoint after SetEntrypoint([]) = %#v, want empty", c.Entrypoint)
+	}
+
+	if err := openImage(t, path).SetEntrypoint(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = openImage(t, path).Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Entrypoint != nil {
+		t.Fatalf("Entrypoint after SetEntrypoint(nil) = %#v, want nil", c.Entrypoint)
+	}
+
+}
+
+func TestClearLabels(t *testing.T) {
+
+	config := map[string]interface{}{
+		"User":   "app",
+		"Env":    []string{"MODE=production"},
+		"Cmd":    []string{"/app/main"},
+		"Labels": map[string]string{"vendor": "Example Corp", "com.example.build-host": "ci-17"},
+	}
+
+	for name, path := range map[string]string{
+		"docker save": saveArchive{layers: []testLayer{{id: "base", config: config}}, manifest: true}.write(t),
+		"oci":         ociArchive{layers: [][]testFile{{{name: "a"}}}, config: map[string]interface{}{"config": config}}.write(t),
+	} {
+
+		if err := openImage(t, path).ClearLabels(); err != nil {
+			t.Fatal(name, err)
+		}
+
+		c, err := openImage(t, path).Config()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		if len(c.Labels) != 0 {
+			t.Fatalf("%s: labels after ClearLabels = %v, want none", name, c.Labels)
+		}
+
+		if c.User != "app" || len(c.Env) != 1 || c.Env[0] != "MODE=production" || len(c.Cmd) != 1 || c.Cmd[0] != "/app/main" {
+			t.Fatalf("%s: config after ClearLabels = %+v, want user, env and cmd kept", name, c)
+		}
+	}
+
+}
+
+func TestConfigOfOldV1Images(t *testing.T) {
+
+	old := map[string]interface{}{
+		"Env":       []string{"PATH=/usr/bin", "MODE=production"},
+		"Cmd":       []string{"/bin/sh", "-c", "/app/start"},
+		"User":      "app",
+		"PortSpecs": []string{"80", "53/udp"},
+	}
+
+	for name, layers := range map[string][]testLayer{
+		"container_config of the latest layer": {
+			{id: "base"},
+			{id: "app", extra: map[string]interface{}{"container_config": old}},
+		},
+		"config of a layer below": {
+			{id: "base", extra: map[string]interface{}{"container_config": old}},
+			{id: "app", extra: map[string]interface{}{"config": nil}},
+		},
+	} {
+
+		path := saveArchive{layers: layers}.write(t)
+
+		c, err := openImage(t, path).Config()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		if c.User != "app" || !reflect.DeepEqual(c.Env, old["Env"]) || !reflect.DeepEqual(c.Cmd, old["Cmd"]) {
+			t.Fatalf("Config() from %s = %+v, want the old runtime config", name, c)
+		}
+
+		if want := map[string]struct{}{"80/tcp": {}, "53/udp": {}}; !reflect.DeepEqual(c.ExposedPorts, want) {
+			t.Fatalf("ExposedPorts from %s = %v, want the PortSpecs %v", name, c.ExposedPorts, want)
+		}
+
+		// edits start from the same runtime config
+		if err := openImage(t, path).SetLabel("version", "1.1"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		if c, err = openImage(t, path).Config(); err != nil {
+			t.Fatal(name, err)
+		}
+
+		if c.User != "app" || !reflect.DeepEqual(c.Env, old["Env"]) || !reflect.DeepEqual(c.Cmd, old["Cmd"]) || c.Labels["version"] != "1.1" {
+			t.Fatalf("Config() from %s after SetLabel = %+v, want the old runtime config with the label", name, c)
+		}
+	}
+
+	c, err := openImage(t, saveArchive{layers: []testLayer{{id: "a"}}}.write(t)).Config()
+	if err != nil || c.User != "" || len(c.Env) != 0 {
+		t.Fatalf("Config() of an image without runtime config = %+v (%v), want it empty", c, err)
+	}
+
+}
+
+func TestStopTimeout(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{{id: "a", config: map[string]interface{}{"StopTimeout": 30, "StopSignal": "SIGQUIT"}}}, manifest: true}.write(t))
+
+	seconds, set, err := img.StopTimeout()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seconds != 30 || !set {
+		t.Fatalf("StopTimeout() = %d, %v, want 30 and set", seconds, set)
+	}
+
+	if c, err := img.Config(); err != nil || c.StopSignal != "SIGQUIT" {
+		t.Fatalf("StopSignal = %q (%v), want SIGQUIT", c.StopSignal, err)
+	}
+
+	for name, config := range map[string]map[string]interface{}{
+		"unset": {"StopSignal": "SIGTERM"},
+		"zero":  {"StopTimeout": 0},
+	} {
+
+		seconds, set, err := openImage(t, saveArchive{layers: []testLayer{{id: "a", config: config}}}.write(t)).StopTimeout()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := name == "zero"; set != want || seconds != 0 {
+			t.Fatalf("StopTimeout() with %s timeout = %d, %v, want 0 and set %v", name, seconds, set, want)
+		}
+	}
+
+}
+
+func TestOnBuild(t *testing.T) {
+
+	triggers := []string{"COPY . /app/src", "RUN make -C /app/src"}
+
+	img := openImage(t, ociArchive{layers: [][]testFile{{{name: "usr/bin/make"}}}, config: map[string]interface{}{
+		"config": map[string]interface{}{"OnBuild": triggers},
+	}}.write(t))
+
+	if got, err := img.OnBuild(); err != nil || !reflect.DeepEqual(got, triggers) {
+		t.Fatalf("OnBuild() = %q (%v), want %q", got, err, triggers)
+	}
+
+	for _, config := range []map[string]interface{}{{"OnBuild": nil}, {"Cmd": []string{"sh"}}} {
+
+		got, err := openImage(t, saveArchive{layers: []testLayer{{id: "a", config: config}}}.write(t)).OnBuild()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got == nil || len(got) != 0 {
+			t.Fatalf("OnBuild() of an image with config %v = %#v, want an empty list", config, got)
+		}
+	}
+
+}
+
+func TestLabelOr(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{{id: "a", config: map[string]interface{}{"Labels": map[string]string{
+		"org.opencontainers.image.version": "1.2.3",
+		"com.example.empty":                "",
+	}}}}}.write(t))
+
+	for key, want := range map[string]string{
+		"org.opencontainers.image.version": "1.2.3",
+		"com.example.empty":                "",
+		"org.opencontainers.image.vendor":  "unknown",
+	} {
+		if got := img.LabelOr(key, "unknown"); got != want {
+			t.Fatalf("LabelOr(%s, unknown) = %q, want %q", key, got, want)
+		}
+	}
+
+	img = openImage(t, saveArchive{layers: []testLayer{{id: "a"}}}.write(t))
+
+	if got := img.LabelOr("org.opencontainers.image.version", "latest"); got != "latest" {
+		t.Fatalf("LabelOr() of an image without labels = %q, want the default", got)
+	}
+
+}
+
+func TestSourceURL(t *testing.T) {
+
+	for want, labels := range map[string]map[string]string{
+		"https://github.com/example/app":  {"org.opencontainers.image.source": "https://github.com/example/app", "org.label-schema.vcs-url": "https://old.example.com/app.git"},
+		"https://old.example.com/app.git": {"org.label-schema.vcs-url": "https://old.example.com/app.git"},
+	} {
+
+		img := openImage(t, ociArchive{layers: [][]testFile{{{name: "a"}}}, config: map[string]interface{}{"config": map[string]interface{}{"Labels": labels}}}.write(t))
+
+		if url, err := img.SourceURL(); err != nil || url != want {
+			t.Fatalf("SourceURL() with labels %v = %q (%v), want %s", labels, url, err, want)
+		}
+	}
+
+	img := openImage(t, saveArchive{layers: []testLayer{{id: "a", config: map[string]interface{}{"Labels": map[string]string{"vendor": "x"}}}}}.write(t))
+
+	if _, err := img.SourceURL(); !errors.Is(err, ErrNoSourceURL) {
+		t.Fatalf("SourceURL() without source label = %v, want ErrNoSourceURL", err)
+	}
+
+}
+
+func TestWindowsEscapedCommands(t *testing.T) {
+
+	img := openImage(t, ociArchive{
+		layers: [][]testFile{{{name: "Files/app.exe"}}},
+		config: map[string]interface{}{"os": "windows", "config": map[string]interface{}{
+			"ArgsEscaped": true,
+			"Cmd":         []string{`cmd /S /C "C:\Program Files\app.exe" --name "a b" \"quoted\" x\\y C:\dir\\ ""`},
+			"Entrypoint":  `powershell -Command`,
+		}},
+	}.write(t))
+
+	c, err := img.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"cmd", "/S", "/C", `C:\Program Files\app.exe`, "--name", "a b", `"quoted"`, `x\\y`, `C:\dir\\`, ""}
+	if !reflect.DeepEqual(c.Cmd, want) {
+		t.Fatalf("Cmd of a Windows image = %q, want %q", c.Cmd, want)
+	}
+
+	if want := []string{"powershell", "-Command"}; !reflect.DeepEqual(c.Entrypoint, want) {
+		t.Fatalf("Entrypoint of a Windows image = %q, want %q", c.Entrypoint, want)
+	}
+
+	// only Windows images store escaped command lines
+	img = openImage(t, ociArchive{
+		layers: [][]testFile{{{name: "app"}}},
+		config: map[string]interface{}{"config": map[string]interface{}{"ArgsEscaped": true, "Cmd": []string{"/app/main --name a"}}},
+	}.write(t))
+
+	if c, err = img.Config(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.Cmd) != 1 {
+		t.Fatalf("Cmd of a Linux image = %q, want it left as recorded", c.Cmd)
+	}
+
+}
@@ -7,7 +7,6 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
-	"sort"
 	"time"
 	"github.com/alexflint/go-filemutex"
 	"strconv"
@@ -15,13 +14,18 @@ import (
 
 const (
 	layerConfigFile  = "json"
+	layerTarFile     = "layer.tar"
 	imageConfigFile  = "repositories"
 	workingDirectory = "/tmp"
 )
 
 type Layer struct {
-	Id      string
-	Created time.Time
+	Id        string
+	Created   time.Time
+	path      string
+	mediaType string
+	parent    string
+	position  int
 }
 
 type Repository struct {
@@ -37,6 +41,12 @@ type Image struct {
 	PathToSource      string
 	Layers            []*Layer
 	pathToWorkingCopy string
+	extracted         bool
+	report            *Report
+	stats             *ExtractStats
+	index             *Index
+	options           Options
+	inPlace           bool
 }
 
 func randomFilename() string {
@@ -45,6 +55,12 @@ func randomFilename() string {
 
 // NewImage initalized the image located at pathToImage by untaring it
 func NewImage(pathToImage string) (*Image, error) {
+	return NewImageWithOptions(pathToImage, Options{})
+}
+
+// NewImageWithOptions initializes the image located at pathToImage like NewImage, using opts. Archives holding
+// more than one image are refused with ErrMultipleImages, ListImages and Select pick one of them.
+func NewImageWithOptions(pathToImage string, opts Options) (*Image, error) {
 
 	if _, err := os.Stat(pathToImage); os.IsNotExist(err) {
 		return nil, fmt.Errorf("No image found at path %s", pathToImage)
@@ -54,22 +70,134 @@ func NewImage(pathToImage string) (*Image, error) {
 		return nil, fmt.Errorf("Image must be an uncompressed tar file %s", pathToImage)
 	}
 
+	if images, err := ListImages(pathToImage); err == nil && len(images) > 1 {
+		return nil, fmt.Errorf("%w in %s, pick one with ListImages and Select", ErrMultipleImages, pathToImage)
+	}
+
+	return newImage(pathToImage, opts), nil
+
+}
+
+// newImage initializes the image located at pathToImage without looking at its content
+func newImage(pathToImage string, opts Options) *Image {
+
+	dirMode := opts.DirMode
+	if dirMode == 0 {
+		dirMode = defaultDirMode
+	}
+
 	tmpDirPath := workingDirectory + string(filepath.Separator) + randomFilename()
-	os.Mkdir(tmpDirPath, 0777)
+	os.Mkdir(tmpDirPath, dirMode)
+	// the umask may have taken away bits, the working copy must have exactly the mode asked for
+	os.Chmod(tmpDirPath, dirMode)
 
-	return &Image{PathToSource: pathToImage, pathToWorkingCopy: tmpDirPath}, nil
+	return &Image{PathToSource: pathToImage, pathToWorkingCopy: tmpDirPath, options: opts}
+
+}
+
+// NewImageFromDirLayout initializes the image stored the way skopeo's dir: transport writes it, as loose blobs
+// next to manifest.json and a version file in dir. The image is read and edited in place, there is no tarball
+// and no working copy.
+func NewImageFromDirLayout(dir string) (*Image, error) {
+
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("No image directory found at path %s", dir)
+	}
+
+	i := &Image{PathToSource: dir, pathToWorkingCopy: filepath.Clean(dir), extracted: true, inPlace: true}
+
+	if !i.isDirLayout() {
+		return nil, fmt.Errorf("Directory %s is not in skopeo dir: layout", dir)
+	}
+
+	i.report = &Report{Skipped: make([]string, 0)}
+
+	return i, nil
 
 }
 
 //Close removes any temporary data and updates the original image
 func (i *Image) Close() {
+	if i.inPlace {
+		return
+	}
 	os.RemoveAll(i.pathToWorkingCopy)
 }
 
+// save writes the working copy back to the image tarball. Images read in place have nothing to write back.
+func (i *Image) save() error {
+
+	if i.inPlace {
+		return nil
+	}
+
+	return tarit(i.pathToWorkingCopy, i.PathToSource)
+
+}
+
+// saveNormalized writes the working copy back like save, with the times and owners of the archive entries set
+// to t and root, so that the archive only depends on the content of the image
+func (i *Image) saveNormalized(t time.Time) error {
+
+	if i.inPlace {
+		return nil
+	}
+
+	return taritNormalized(i.pathToWorkingCopy, i.PathToSource, t)
+
+}
+
+// lockPath returns the file edits lock to keep other processes from editing the image at the same time. Images
+// read in place are directories, which cannot be locked, they are locked through their manifest.json.
+func (i *Image) lockPath() string {
+
+	if i.inPlace {
+		return i.pathToWorkingCopy + string(filepath.Separator) + dockerManifestFile
+	}
+
+	return i.PathToSource
+
+}
+
+// extract untars the image into the working copy unless this already happened
+func (i *Image) extract() error {
+
+	if i.extracted {
+		return nil
+	}
+
+	start := i.now()
+	report, err := untar(i.PathToSource, i.pathToWorkingCopy, i.options)
+	i.report = report
+	i.stats = newExtractStats(report, i.now().Sub(start))
+
+	if err != nil {
+		return fmt.Errorf("Error creating image: Untar failed) %s", i.pathToWorkingCopy)
+	}
+
+	i.extracted = true
+
+	return nil
+
+}
+
+// ExtractReport returns statistics about the extraction of the image into its working copy, extracting the
+// image first if that did not happen yet
+func (i *Image) ExtractReport() (*Report, error) {
+
+	if err := i.extract(); err != nil {
+		return i.report, err
+	}
+
+	return i.report, nil
+
+}
+
 //SetName changes the name of the image
 func (i *Image) SetName(newName string) error {
 
-	m, err := filemutex.New(i.PathToSource)
+	m, err := filemutex.New(i.lockPath())
 	if err != nil {
 		return fmt.Errorf("Error renaming image: Setting mutex failed) %s", i.PathToSource)
 	}
@@ -77,10 +205,42 @@ func (i *Image) SetName(newName string) error {
 	defer m.Unlock()
 
 	// untar image
-	if err := untar(i.PathToSource, i.pathToWorkingCopy); err != nil {
-		return fmt.Errorf("Error creating image: Untar failed) %s", i.pathToWorkingCopy)
+	if err := i.extract(); err != nil {
+		return err
+	}
+
+	repoPath := i.pathToWorkingCopy + string(filepath.Separator) + imageConfigFile
+
+	if i.isOCI() {
+
+		if err := i.setOCIName(newName); err != nil {
+			return err
+		}
+
+		// OCI archives only carry a repositories file for older tools, update it if it is there
+		if _, err := os.Stat(repoPath); err == nil {
+			if err := i.renameRepositories(newName); err != nil {
+				return err
+			}
+		}
+
+	} else if err := i.renameRepositories(newName); err != nil {
+		return err
+	}
+
+	// put everything together again
+	if err = i.save(); err != nil {
+		return fmt.Errorf("Error creating image: Tar failed) %s", i.pathToWorkingCopy)
 	}
 
+	return nil
+
+}
+
+// renameRepositories writes newName into the repositories file, creating one that tags the latest layer if the
+// image has none
+func (i *Image) renameRepositories(newName string) error {
+
 	repoPath := i.pathToWorkingCopy + string(filepath.Separator) + imageConfigFile
 
 	data := []byte{}
@@ -128,6 +288,10 @@ func (i *Image) SetName(newName string) error {
 		var newImageName = map[string]interface{}{}
 
 		for _, v := range repo {
+			// malformed exports map the name straight to the layer id, write the nested schema docker expects
+			if layerId, ok := v.(string); ok {
+				v = map[string]string{defaultTag: layerId}
+			}
 			newImageName[newName] = v
 		}
 
@@ -141,15 +305,10 @@ func (i *Image) SetName(newName string) error {
 
 	// write new repo file
 
-	if err = ioutil.WriteFile(repoPath, data, 0644); err != nil {
+	if err := ioutil.WriteFile(repoPath, data, 0644); err != nil {
 		return fmt.Errorf("Error renaming image: Repository write failed) %s", i.pathToWorkingCopy)
 	}
 
-	// put everything together again
-	if err = tarit(i.pathToWorkingCopy, i.PathToSource); err != nil {
-		return fmt.Errorf("Error creating image: Tar failed) %s", i.pathToWorkingCopy)
-	}
-
 	return nil
 
 }
@@ -157,20 +316,21 @@ func (i *Image) SetName(newName string) error {
 //latestLayer return the layer that was added last to the image
 func (i *Image) latestLayer() (*Layer, error) {
 
-	if len(i.Layers) == 0 {
-		if err := i.readLayers(); err != nil {
-			return nil, fmt.Errorf("Image has no layers")
-		}
+	l, err := i.orderedLayers()
+	if err != nil || len(l) == 0 {
+		return nil, fmt.Errorf("Image has no layers")
 	}
 
-	sort.Sort(ByCreated(i.Layers))
-
-	return i.Layers[0], nil
+	return l[len(l)-1], nil
 
 }
 
 func (i *Image) readLayers() error {
 
+	if i.isOCI() {
+		return i.readOCILayers()
+	}
+
 	l := make([]*Layer, 0)
 
 	err := filepath.Walk(i.pathToWorkingCopy, func(path string, info os.FileInfo, err error) error {
@@ -207,7 +367,9 @@ func (i *Image) readLayers() error {
 				return fmt.Errorf("Unexpected time schema in image layer %s", path)
 			}
 
-			l = append(l, &Layer{Id: layerId, Created: layerCreationTime})
+			parent, _ := layerConfig["parent"].(string)
+
+			l = append(l, &Layer{Id: layerId, Created: layerCreationTime, path: dir + layerTarFile, parent: parent})
 
 		}
 
@@ -219,6 +381,10 @@ func (i *Image) readLayers() error {
 		return err
 	}
 
+	if err := i.stackLayers(l); err != nil {
+		return err
+	}
+
 	i.Layers = l
 
 	return nil
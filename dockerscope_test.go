@@ -0,0 +1,84 @@
+package dockerscope
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWorkingCopyMode(t *testing.T) {
+
+	path := saveArchive{layers: []testLayer{{id: "a", files: []testFile{{name: "etc/shadow", body: "root:*"}}}}}.write(t)
+
+	for _, tc := range []struct {
+		mode os.FileMode
+		want os.FileMode
+	}{
+		{0, 0700},
+		{0750, 0750},
+	} {
+
+		img := openImageWithOptions(t, path, Options{DirMode: tc.mode})
+
+		if _, err := img.ExtractReport(); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := os.Stat(img.pathToWorkingCopy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode().Perm() != tc.want {
+			t.Fatalf("working copy created with mode %v for DirMode %v, want %v", info.Mode().Perm(), tc.mode, tc.want)
+		}
+	}
+
+}
+
+func TestNewImageFromDirLayout(t *testing.T) {
+
+	dir := t.TempDir()
+	if _, err := untar(ociArchive{layers: [][]testFile{{{name: "app", body: "v1"}}}, gzip: true, dir: true}.write(t), dir, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := NewImageFromDirLayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := img.ReadFile("/app"); err != nil || string(data) != "v1" {
+		t.Fatalf("ReadFile(/app) = %q (%v), want v1", data, err)
+	}
+
+	if err := img.SetCmd([]string{"/app", "serve"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := img.SelfTest(); err != nil {
+		t.Fatalf("SelfTest() after SetCmd() = %v", err)
+	}
+
+	img.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err != nil {
+		t.Fatalf("Close() removed the directory the image was read from: %v", err)
+	}
+
+	img, err = NewImageFromDirLayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	if c, err := img.Config(); err != nil || !reflect.DeepEqual(c.Cmd, []string{"/app", "serve"}) {
+		t.Fatalf("Cmd after SetCmd() in place = %q (%v), want [/app serve]", c.Cmd, err)
+	}
+
+	if _, err := NewImageFromDirLayout(t.TempDir()); err == nil {
+		t.Fatal("NewImageFromDirLayout() accepted a directory without a dir: layout")
+	}
+
+}
@@ -0,0 +1,35 @@
+package dockerscope
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestHighEntropyFiles(t *testing.T) {
+
+	random := make([]byte, 100<<10)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	img := openImage(t, saveArchive{layers: []testLayer{{id: "a", files: []testFile{
+		{name: "usr/bin/packed", body: string(random)},
+		{name: "usr/share/doc/README", body: strings.Repeat("the quick brown fox jumps over the lazy dog. ", 2000)},
+		{name: "empty"},
+	}}}}.write(t))
+
+	found, err := img.HighEntropyFiles(7.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 1 || found[0].Path != "/usr/bin/packed" || found[0].Layer != "a" {
+		t.Fatalf("HighEntropyFiles(7.5) = %+v, want only /usr/bin/packed", found)
+	}
+
+	if found, err := img.HighEntropyFiles(3); err != nil || len(found) != 2 {
+		t.Fatalf("HighEntropyFiles(3) = %+v (%v), want the packed file and the text", found, err)
+	}
+
+}
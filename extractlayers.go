@@ -0,0 +1,78 @@
+package dockerscope
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ExtractLayers unpacks every layer of the image on its own into destDir/<layer id>, without applying the layers
+// on top of each other. Whiteouts are kept as the files the layer contains. Up to Options.Concurrency layers are
+// unpacked at the same time, one at a time if it is not set. Entries escaping the directory of their layer
+// are skipped.
+func (i *Image) ExtractLayers(destDir string) error {
+
+	if err := i.loadLayers(); err != nil {
+		return err
+	}
+
+	workers := i.options.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	slots := make(chan struct{}, workers)
+
+	for _, l := range i.Layers {
+
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(l *Layer) {
+
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			if err := i.extractLayer(l, filepath.Join(destDir, l.Id)); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+
+		}(l)
+
+	}
+
+	wg.Wait()
+
+	return firstErr
+
+}
+
+// extractLayer unpacks the tarball of l into target
+func (i *Image) extractLayer(l *Layer, target string) error {
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("Error extracting layer %s: Mkdir failed) %s", l.Id, target)
+	}
+
+	r, err := i.openLayerContent(l)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if _, err := untarReader(r, target, i.options); err != nil {
+		return fmt.Errorf("Error extracting layer %s: %s", l.Id, err)
+	}
+
+	return nil
+
+}
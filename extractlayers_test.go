@@ -0,0 +1,94 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractLayers(t *testing.T) {
+
+	var layers []testLayer
+	for _, id := range []string{"l1", "l2", "l3", "l4"} {
+		layers = append(layers, testLayer{id: id, files: []testFile{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/" + id, body: id},
+		}})
+	}
+	layers[1].files = append(layers[1].files, testFile{name: "etc/.wh.l1"})
+	layers[2].files = append(layers[2].files, testFile{name: "../../escaped", body: "x"})
+
+	for _, concurrency := range []int{0, 3} {
+
+		img := openImageWithOptions(t, saveArchive{layers: layers}.write(t), Options{Concurrency: concurrency})
+
+		parent := t.TempDir()
+		dest := filepath.Join(parent, "a", "layers")
+
+		if err := img.ExtractLayers(dest); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, l := range layers {
+
+			entries, err := ioutil.ReadDir(filepath.Join(dest, l.id, "etc"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := len(l.files) - 1
+			if l.id == "l3" {
+				want--
+			}
+
+			if len(entries) != want {
+				t.Fatalf("layer %s unpacked %d files into etc, want only its own %d", l.id, len(entries), want)
+			}
+
+			if data, err := ioutil.ReadFile(filepath.Join(dest, l.id, "etc", l.id)); err != nil || string(data) != l.id {
+				t.Fatalf("etc/%s of layer %s = %q (%v), want %s", l.id, l.id, data, err, l.id)
+			}
+		}
+
+		if _, err := os.Lstat(filepath.Join(dest, "l2", "etc", ".wh.l1")); err != nil {
+			t.Fatalf("whiteout not kept in the layer directory: %v", err)
+		}
+
+		if _, err := os.Lstat(filepath.Join(parent, "a", "escaped")); err == nil {
+			t.Fatal("ExtractLayers() wrote an entry outside the directory of its layer")
+		}
+	}
+
+}
+
+func TestExtractLayersImpliedDirectories(t *testing.T) {
+
+	path := saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{{name: "app/x.txt", body: "x"}}},
+		{id: "app", files: []testFile{{name: "app/lib/y.txt", body: "y"}, {name: "app/.wh.x.txt"}}},
+	}}.write(t)
+
+	dest := t.TempDir()
+
+	if err := openImage(t, path).ExtractLayers(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	for p, want := range map[string]string{filepath.Join("base", "app", "x.txt"): "x", filepath.Join("app", "app", "lib", "y.txt"): "y"} {
+		if data, err := ioutil.ReadFile(filepath.Join(dest, p)); err != nil || string(data) != want {
+			t.Fatalf("ExtractLayers() wrote %s as %q (%v), want %q", p, data, err, want)
+		}
+	}
+
+	dirs, err := openImage(t, path).ExtractForOverlay(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dirs[0], "app", ".wh.x.txt")); err != nil {
+		t.Fatalf("ExtractForOverlay() did not unpack a layer without directory entries: %v", err)
+	}
+
+}
@@ -0,0 +1,50 @@
+package dockerscope
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// fingerprintFields are the fields of the image config that describe how the image runs, rather than how and
+// from what it was built
+var fingerprintFields = []string{"architecture", "os", "variant", "os.version", "os.features"}
+
+// ConfigFingerprint returns a sha256 digest of the runtime configuration and platform of the image in canonical
+// form. Unlike the image id it does not cover the diff ids, history or creation time, so two builds with the
+// same configuration share a fingerprint even if their layers differ.
+func (i *Image) ConfigFingerprint() (string, error) {
+
+	imageConfig, err := i.imageConfig()
+	if err != nil {
+		return "", err
+	}
+
+	selected := make(map[string]json.RawMessage)
+
+	for _, field := range fingerprintFields {
+		if raw, ok := imageConfig[field]; ok {
+			selected[field] = raw
+		}
+	}
+
+	if raw := runtimeConfig(imageConfig); raw != nil {
+		selected["config"] = raw
+	}
+
+	data, err := json.Marshal(selected)
+	if err != nil {
+		return "", fmt.Errorf("Error fingerprinting image: Json failed %s", i.PathToSource)
+	}
+
+	canonical, err := canonicalJSON(data)
+	if err != nil {
+		return "", fmt.Errorf("Error fingerprinting image: Json failed %s", i.PathToSource)
+	}
+
+	sum := sha256.Sum256(canonical)
+
+	return digestPrefix + hex.EncodeToString(sum[:]), nil
+
+}
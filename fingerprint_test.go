@@ -0,0 +1,49 @@
+package dockerscope
+
+import "testing"
+
+func TestConfigFingerprint(t *testing.T) {
+
+	runtime := map[string]interface{}{"Env": []string{"PATH=/usr/bin"}, "Cmd": []string{"/app"}, "User": "app"}
+
+	fingerprint := func(path string) string {
+
+		t.Helper()
+
+		f, err := openImage(t, path).ConfigFingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return f
+
+	}
+
+	first := fingerprint(ociArchive{layers: [][]testFile{{{name: "app", body: "v1"}}}, config: map[string]interface{}{
+		"config":  runtime,
+		"created": day(1),
+		"history": []map[string]interface{}{{"created_by": "COPY app /app"}},
+	}}.write(t))
+
+	rebuilt := fingerprint(ociArchive{layers: [][]testFile{{{name: "app", body: "v2"}}, {{name: "data"}}}, config: map[string]interface{}{
+		"config":  runtime,
+		"created": day(9),
+	}}.write(t))
+
+	// docker save records the platform in the json of the latest layer as well
+	saved := fingerprint(saveArchive{layers: []testLayer{{id: "a", config: runtime, files: []testFile{{name: "app", body: "v3"}},
+		extra: map[string]interface{}{"architecture": "amd64", "os": "linux"}}}, manifest: true}.write(t))
+
+	if first != rebuilt || first != saved {
+		t.Fatalf("ConfigFingerprint() = %s, %s and %s for images of the same config, want them equal", first, rebuilt, saved)
+	}
+
+	changed := fingerprint(ociArchive{layers: [][]testFile{{{name: "app", body: "v1"}}}, config: map[string]interface{}{
+		"config": map[string]interface{}{"Env": []string{"PATH=/usr/bin"}, "Cmd": []string{"/app", "--debug"}, "User": "app"},
+	}}.write(t))
+
+	if changed == first {
+		t.Fatal("ConfigFingerprint() did not change with the Cmd")
+	}
+
+}
@@ -0,0 +1,468 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// testFile is a single entry of a layer tarball built by layerTar
+type testFile struct {
+	name     string
+	body     string
+	mode     int64
+	typeflag byte
+	linkname string
+	modTime  time.Time
+}
+
+// layerTar returns an uncompressed tarball of files in the given order. Entries default to regular files, with
+// mode 0644 for files and 0755 for directories.
+func layerTar(files []testFile) []byte {
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	for _, f := range files {
+
+		h := &tar.Header{Name: f.name, Mode: f.mode, Typeflag: f.typeflag, Linkname: f.linkname, ModTime: f.modTime}
+
+		if h.Typeflag == 0 {
+			h.Typeflag = tar.TypeReg
+		}
+
+		if h.Mode == 0 {
+			h.Mode = 0644
+			if h.Typeflag == tar.TypeDir {
+				h.Mode = 0755
+			}
+		}
+
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(f.body))
+		}
+
+		if err := tw.WriteHeader(h); err != nil {
+			panic(err)
+		}
+
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+
+}
+
+// gzipped returns data gzip compressed
+func gzipped(data []byte) []byte {
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+
+	return buf.Bytes()
+
+}
+
+// zstdCompressed returns data zstd compressed
+func zstdCompressed(data []byte) []byte {
+
+	w, _ := zstd.NewWriter(nil)
+	defer w.Close()
+
+	return w.EncodeAll(data, nil)
+
+}
+
+// digestOf returns the sha256 digest of data in the sha256:<hex> form
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// mustJSON marshals v, panicking on failure
+func mustJSON(v interface{}) []byte {
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+
+}
+
+// day returns midnight of day n of January 2020, a stable timestamp for fixtures
+func day(n int) time.Time {
+	return time.Date(2020, 1, n, 0, 0, 0, 0, time.UTC)
+}
+
+// archiveEntry is a file of an image archive, a directory if data is nil
+type archiveEntry struct {
+	name string
+	data []byte
+}
+
+// writeArchive writes entries as a tarball into a temporary directory of t and returns its path
+func writeArchive(t *testing.T, entries []archiveEntry) string {
+
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "image.tar")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+
+	for _, e := range entries {
+
+		h := &tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e.data))}
+		if e.data == nil {
+			h.Typeflag = tar.TypeDir
+			h.Mode = 0755
+		}
+
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+
+}
+
+// writeTar writes the tarball of files into a temporary directory of t and returns its path
+func writeTar(t *testing.T, files []testFile) string {
+
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "layer.tar")
+
+	if err := ioutil.WriteFile(path, layerTar(files), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+
+}
+
+// testLayer is a layer of a docker save archive. Every layer is the child of the one before it.
+type testLayer struct {
+	id      string
+	created time.Time // day n+1 of January 2020 for the nth layer if not set
+	config  map[string]interface{}
+	extra   map[string]interface{} // additional top-level keys of the layer json, such as container_config
+	files   []testFile
+}
+
+// saveArchive is an image archive in the format docker save writes: a directory per layer, a repositories file
+// and, since Docker 1.10, a manifest.json with the image config
+type saveArchive struct {
+	layers       []testLayer
+	repositories interface{}            // contents of the repositories file, none if nil
+	manifest     bool                   // add manifest.json and the image config
+	config       map[string]interface{} // top-level keys replacing those of the generated image config
+	configStyle  string                 // "blob" or "digest" to refer to the config as blobs/sha256/<hex> or sha256:<hex>
+	reverse      bool                   // write the layer directories in reverse order, parents last
+}
+
+// write writes the archive into a temporary directory of t and returns its path
+func (a saveArchive) write(t *testing.T) string {
+
+	t.Helper()
+
+	var entries []archiveEntry
+	var diffIds, layerPaths []string
+
+	for n, l := range a.layers {
+
+		layer := layerTar(l.files)
+		diffIds = append(diffIds, digestOf(layer))
+
+		created := l.created
+		if created.IsZero() {
+			created = day(n + 1)
+		}
+
+		js := map[string]interface{}{"id": l.id, "created": created}
+		if n > 0 {
+			js["parent"] = a.layers[n-1].id
+		}
+		if l.config != nil {
+			js["config"] = l.config
+		}
+		for k, v := range l.extra {
+			js[k] = v
+		}
+
+		dir := []archiveEntry{
+			{name: l.id + "/"},
+			{name: l.id + "/VERSION", data: []byte("1.0")},
+			{name: l.id + "/json", data: mustJSON(js)},
+			{name: l.id + "/layer.tar", data: layer},
+		}
+
+		if a.reverse {
+			entries = append(dir, entries...)
+		} else {
+			entries = append(entries, dir...)
+		}
+		layerPaths = append(layerPaths, l.id+"/layer.tar")
+	}
+
+	if a.repositories != nil {
+		entries = append(entries, archiveEntry{name: "repositories", data: mustJSON(a.repositories)})
+	}
+
+	if a.manifest {
+
+		top := a.layers[len(a.layers)-1]
+
+		config := map[string]interface{}{
+			"architecture": "amd64",
+			"os":           "linux",
+			"created":      day(len(a.layers)),
+			"config":       top.config,
+			"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIds},
+		}
+		if !top.created.IsZero() {
+			config["created"] = top.created
+		}
+		for k, v := range a.config {
+			config[k] = v
+		}
+
+		data := mustJSON(config)
+		hex := digestOf(data)[len("sha256:"):]
+
+		ref := hex + ".json"
+		switch a.configStyle {
+		case "blob":
+			ref = "blobs/sha256/" + hex
+		case "digest":
+			ref = "sha256:" + hex
+		}
+
+		if a.configStyle == "" {
+			entries = append(entries, archiveEntry{name: ref, data: data})
+		} else {
+			entries = append(entries, archiveEntry{name: "blobs/"}, archiveEntry{name: "blobs/sha256/"},
+				archiveEntry{name: "blobs/sha256/" + hex, data: data})
+		}
+
+		tags := []string{}
+		if repos, ok := a.repositories.(map[string]map[string]string); ok {
+			for name, ts := range repos {
+				for tag := range ts {
+					tags = append(tags, name+":"+tag)
+				}
+			}
+			sort.Strings(tags)
+		}
+
+		manifest := []map[string]interface{}{{"Config": ref, "RepoTags": tags, "Layers": layerPaths}}
+		entries = append(entries, archiveEntry{name: "manifest.json", data: mustJSON(manifest)})
+	}
+
+	return writeArchive(t, entries)
+
+}
+
+// descriptor returns the OCI descriptor of data
+func descriptor(mediaType string, data []byte) map[string]interface{} {
+	return map[string]interface{}{"mediaType": mediaType, "digest": digestOf(data), "size": len(data)}
+}
+
+// ociArchive is an image in the OCI image layout, as written by docker save since Docker 25, buildx and skopeo
+// copy oci-archive:, or in the layout of skopeo copy dir:
+type ociArchive struct {
+	layers      [][]testFile
+	gzip        bool                     // compress the layers
+	config      map[string]interface{}   // top-level keys replacing those of the generated image config
+	annotations map[string]string        // annotations of the index entry of the image
+	nested      bool                     // have index.json point to an image index listing the image, as buildx does
+	manifests   []map[string]interface{} // index entries listed before the image, their blobs in blobs
+	blobs       [][]byte                 // additional blobs, such as those of manifests
+	docker      bool                     // add the manifest.json docker save writes next to the OCI layout
+	dir         bool                     // write the skopeo dir: layout instead of the OCI image layout
+}
+
+// write writes the archive into a temporary directory of t and returns its path
+func (a ociArchive) write(t *testing.T) string {
+
+	t.Helper()
+
+	blobs := append([][]byte{}, a.blobs...)
+	var layers []map[string]interface{}
+	var diffIds []string
+
+	for _, files := range a.layers {
+
+		layer := layerTar(files)
+		diffIds = append(diffIds, digestOf(layer))
+
+		mediaType := "application/vnd.oci.image.layer.v1.tar"
+		if a.gzip {
+			layer = gzipped(layer)
+			mediaType += "+gzip"
+		}
+
+		blobs = append(blobs, layer)
+		layers = append(layers, descriptor(mediaType, layer))
+	}
+
+	config := map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"created":      day(1),
+		"config":       map[string]interface{}{},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIds},
+	}
+	for k, v := range a.config {
+		config[k] = v
+	}
+
+	configData := mustJSON(config)
+	blobs = append(blobs, configData)
+
+	manifest := mustJSON(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        descriptor("application/vnd.oci.image.config.v1+json", configData),
+		"layers":        layers,
+	})
+
+	var entries []archiveEntry
+
+	if a.dir {
+
+		for _, b := range blobs {
+			entries = append(entries, archiveEntry{name: digestOf(b)[len("sha256:"):], data: b})
+		}
+
+		entries = append(entries,
+			archiveEntry{name: "manifest.json", data: manifest},
+			archiveEntry{name: "version", data: []byte("Directory Transport Version: 1.1\n")},
+		)
+
+		return writeArchive(t, entries)
+	}
+
+	image := descriptor("application/vnd.oci.image.manifest.v1+json", manifest)
+	image["platform"] = map[string]string{"architecture": "amd64", "os": "linux"}
+	if a.annotations != nil {
+		image["annotations"] = a.annotations
+	}
+	blobs = append(blobs, manifest)
+
+	index := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests":     append(append([]map[string]interface{}{}, a.manifests...), image),
+	}
+
+	if a.nested {
+		nested := mustJSON(index)
+		blobs = append(blobs, nested)
+		index = map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.oci.image.index.v1+json",
+			"manifests":     []map[string]interface{}{descriptor("application/vnd.oci.image.index.v1+json", nested)},
+		}
+	}
+
+	entries = append(entries,
+		archiveEntry{name: "oci-layout", data: []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+		archiveEntry{name: "index.json", data: mustJSON(index)},
+		archiveEntry{name: "blobs/"},
+		archiveEntry{name: "blobs/sha256/"},
+	)
+
+	if a.docker {
+
+		var tags, layerPaths []string
+		if ref := a.annotations["io.containerd.image.name"]; ref != "" {
+			tags = append(tags, ref)
+		}
+		for _, l := range layers {
+			layerPaths = append(layerPaths, "blobs/sha256/"+l["digest"].(string)[len("sha256:"):])
+		}
+
+		entries = append(entries, archiveEntry{name: "manifest.json", data: mustJSON([]map[string]interface{}{{
+			"Config":   "blobs/sha256/" + digestOf(configData)[len("sha256:"):],
+			"RepoTags": tags,
+			"Layers":   layerPaths,
+		}})})
+	}
+
+	seen := map[string]bool{}
+	for _, b := range blobs {
+		if d := digestOf(b); !seen[d] {
+			seen[d] = true
+			entries = append(entries, archiveEntry{name: "blobs/sha256/" + d[len("sha256:"):], data: b})
+		}
+	}
+
+	return writeArchive(t, entries)
+
+}
+
+// openImage opens the image archive at path, closing it when the test ends
+func openImage(t *testing.T, path string) *Image {
+
+	t.Helper()
+
+	img, err := NewImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(img.Close)
+
+	return img
+
+}
+
+// openImageWithOptions is openImage using opts
+func openImageWithOptions(t *testing.T, path string, opts Options) *Image {
+
+	t.Helper()
+
+	img, err := NewImageWithOptions(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(img.Close)
+
+	return img
+
+}
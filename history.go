@@ -0,0 +1,284 @@
+package dockerscope
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// nopPrefix precedes the instructions of the Dockerfile that docker records in the history without running them
+const nopPrefix = "#(nop)"
+
+// v1ContainerConfig is the part of a v1 layer json that records the build step that created the layer
+type v1ContainerConfig struct {
+	Cmd []string `json:"Cmd"`
+}
+
+// history returns the build history of the image, one entry per build step. Images with a manifest.json or an
+// OCI config take it from the config, v1 images have one entry per layer built from the command recorded in
+// its json.
+func (i *Image) history() ([]ociHistory, error) {
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	var imageConfig map[string]json.RawMessage
+
+	switch {
+	case i.isOCI():
+		imageConfig, err = i.imageConfig()
+	case i.hasManifest():
+		var entries []*manifestEntry
+		if entries, err = i.readManifest(); err == nil && len(entries) > 0 {
+			imageConfig, err = i.readManifestConfig(entries[0])
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]ociHistory, 0)
+
+	if imageConfig != nil {
+
+		if raw, found := imageConfig["history"]; found && string(raw) != "null" {
+			if err := json.Unmarshal(raw, &history); err != nil {
+				return nil, fmt.Errorf("Unexpected schema for `history` field in image config of %s", i.PathToSource)
+			}
+		}
+
+		return history, nil
+
+	}
+
+	for _, l := range layers {
+
+		layerConfig, err := i.readLayerConfig(l.Id)
+		if err != nil {
+			return nil, err
+		}
+
+		c := &v1ContainerConfig{}
+
+		if raw, found := layerConfig["container_config"]; found {
+			json.Unmarshal(raw, c)
+		}
+
+		history = append(history, ociHistory{Created: l.Created, CreatedBy: strings.Join(c.Cmd, " ")})
+
+	}
+
+	return history, nil
+
+}
+
+// instruction returns the Dockerfile instruction a build step was created by, such as USER app, and its
+// arguments. Steps docker ran as a shell command are reported as RUN.
+func (h *ociHistory) instruction() (keyword string, args string) {
+
+	step := strings.TrimSpace(h.CreatedBy)
+
+	if k := strings.Index(step, nopPrefix); k >= 0 {
+		step = strings.TrimSpace(step[k+len(nopPrefix):])
+	} else if strings.HasPrefix(step, "/bin/sh -c ") {
+		return "RUN", strings.TrimPrefix(step, "/bin/sh -c ")
+	}
+
+	fields := strings.SplitN(step, " ", 2)
+	keyword = strings.ToUpper(fields[0])
+
+	if len(fields) > 1 {
+		args = strings.TrimSpace(fields[1])
+	}
+
+	return keyword, args
+
+}
+
+// isRootUser reports whether user, given as user or user:group, is root
+func isRootUser(user string) bool {
+
+	name := strings.SplitN(user, ":", 2)[0]
+
+	return name == "" || name == "root" || name == "0"
+
+}
+
+// MissingNonRootUser reports whether no build step of the image ever switched to a user other than root. Unlike
+// the final user of the config, an image that dropped privileges and later switched back to root is not
+// reported.
+func (i *Image) MissingNonRootUser() (bool, error) {
+
+	c, err := i.Config()
+	if err != nil {
+		return false, err
+	}
+
+	if !isRootUser(c.User) {
+		return false, nil
+	}
+
+	history, err := i.history()
+	if err != nil {
+		return false, err
+	}
+
+	for _, h := range history {
+
+		keyword, args := h.instruction()
+
+		// older docker versions record the user as USER [app]
+		if keyword == "USER" && !isRootUser(strings.Trim(args, "[]")) {
+			return false, nil
+		}
+
+	}
+
+	return true, nil
+
+}
+
+// BuildArgs returns the build args visible in the build history of the image, keyed by name. Docker records
+// the build args a RUN step saw as a |N KEY=value prefix of its command, ARG steps record their defaults. ARG
+// steps without a default have an empty value unless a later step shows one. Values holding whitespace cannot
+// be told apart from the command and are cut at the first space.
+func (i *Image) BuildArgs() (map[string]string, error) {
+
+	history, err := i.history()
+	if err != nil {
+		return nil, err
+	}
+
+	args := make(map[string]string)
+
+	for _, h := range history {
+
+		// BuildKit records RUN steps with the instruction in front of the prefix
+		step := strings.TrimPrefix(strings.TrimSpace(h.CreatedBy), "RUN ")
+
+		if strings.HasPrefix(step, "|") {
+
+			fields := strings.Fields(step)
+
+			n, err := strconv.Atoi(strings.TrimPrefix(fields[0], "|"))
+			if err != nil {
+				continue
+			}
+
+			for k := 1; k <= n && k < len(fields); k++ {
+				if kv := strings.SplitN(fields[k], "=", 2); len(kv) == 2 {
+					args[kv[0]] = kv[1]
+				}
+			}
+
+			continue
+
+		}
+
+		keyword, rest := h.instruction()
+		if keyword != "ARG" {
+			continue
+		}
+
+		for _, field := range strings.Fields(rest) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) == 2 {
+				args[kv[0]] = kv[1]
+			} else if _, found := args[kv[0]]; !found {
+				args[kv[0]] = ""
+			}
+		}
+
+	}
+
+	return args, nil
+
+}
+
+// CreatedBy returns the command of the last build step of the image that recorded one, the instruction the
+// image was finished with, such as CMD ["app"] or a RUN command
+func (i *Image) CreatedBy() (string, error) {
+
+	history, err := i.history()
+	if err != nil {
+		return "", err
+	}
+
+	for k := len(history) - 1; k >= 0; k-- {
+		if step := strings.TrimSpace(history[k].CreatedBy); step != "" {
+			return step, nil
+		}
+	}
+
+	return "", fmt.Errorf("No build history recorded in image %s", i.PathToSource)
+
+}
+
+// metadataInstructions are the Dockerfile instructions that change the config rather than the filesystem
+var metadataInstructions = map[string]bool{
+	"ARG": true, "CMD": true, "ENTRYPOINT": true, "ENV": true, "EXPOSE": true, "HEALTHCHECK": true, "LABEL": true,
+	"MAINTAINER": true, "ONBUILD": true, "SHELL": true, "STOPSIGNAL": true, "USER": true, "VOLUME": true,
+	"WORKDIR": true,
+}
+
+// kind classifies the build step as copy, add, run or metadata, or unknown if it is none of them
+func (h *ociHistory) kind() string {
+
+	keyword, _ := h.instruction()
+
+	switch {
+	case keyword == "COPY":
+		return "copy"
+	case keyword == "ADD":
+		return "add"
+	case keyword == "RUN" || strings.HasPrefix(keyword, "|"):
+		return "run"
+	case metadataInstructions[keyword]:
+		return "metadata"
+	}
+
+	return "unknown"
+
+}
+
+// LayerKinds returns for every layer of the image the kind of build step that created it, keyed by layer id:
+// copy, add, run, metadata for the steps such as WORKDIR that older docker versions committed as a layer, or
+// unknown. The kind is guessed from the command recorded in the history, every layer is unknown if the history
+// was stripped or does not match the layers.
+func (i *Image) LayerKinds() (map[string]string, error) {
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := i.history()
+	if err != nil {
+		return nil, err
+	}
+
+	steps := make([]ociHistory, 0)
+
+	for _, h := range history {
+		if !h.EmptyLayer {
+			steps = append(steps, h)
+		}
+	}
+
+	kinds := make(map[string]string)
+
+	for k, l := range layers {
+		if len(steps) == len(layers) {
+			kinds[l.Id] = steps[k].kind()
+		} else {
+			kinds[l.Id] = "unknown"
+		}
+	}
+
+	return kinds, nil
+
+}
@@ -0,0 +1,154 @@
+package dockerscope
+
+import (
+	"reflect"
+	"testing"
+)
+
+// historyImage returns an OCI image built by steps, running as root in the end
+func historyImage(t *testing.T, steps ...string) *Image {
+
+	t.Helper()
+
+	var history []map[string]interface{}
+	for _, s := range steps {
+		history = append(history, map[string]interface{}{"created_by": s, "empty_layer": true})
+	}
+	history[0]["empty_layer"] = false
+
+	return openImage(t, ociArchive{
+		layers: [][]testFile{{{name: "app"}}},
+		config: map[string]interface{}{"history": history, "config": map[string]interface{}{"User": "root"}},
+	}.write(t))
+
+}
+
+func TestMissingNonRootUser(t *testing.T) {
+
+	for _, tc := range []struct {
+		steps   []string
+		missing bool
+	}{
+		{[]string{"/bin/sh -c #(nop) ADD file:4b9a in / ", "/bin/sh -c #(nop)  USER app", "/bin/sh -c #(nop)  USER root"}, false},
+		{[]string{"ADD rootfs.tar / # buildkit", "USER 1000:1000", "RUN apk add curl # buildkit", "USER 0"}, false},
+		{[]string{"ADD rootfs.tar / # buildkit", "/bin/sh -c echo USER app", "USER 0:0"}, true},
+		{[]string{"ADD rootfs.tar / # buildkit"}, true},
+	} {
+
+		missing, err := historyImage(t, tc.steps...).MissingNonRootUser()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if missing != tc.missing {
+			t.Fatalf("MissingNonRootUser() after %q = %v, want %v", tc.steps, missing, tc.missing)
+		}
+	}
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base"},
+		{id: "user", extra: map[string]interface{}{"container_config": map[string]interface{}{"Cmd": []string{"/bin/sh", "-c", "#(nop) ", "USER [app]"}}}},
+		{id: "root", config: map[string]interface{}{"User": "root"}, extra: map[string]interface{}{"container_config": map[string]interface{}{"Cmd": []string{"/bin/sh", "-c", "#(nop) ", "USER [root]"}}}},
+	}}.write(t))
+
+	if missing, err := img.MissingNonRootUser(); err != nil || missing {
+		t.Fatalf("MissingNonRootUser() of a v1 image switching to app = %v (%v), want false", missing, err)
+	}
+
+}
+
+func TestBuildArgs(t *testing.T) {
+
+	img := historyImage(t,
+		"/bin/sh -c #(nop) ADD file:4b9a in / ",
+		"/bin/sh -c #(nop)  ARG VERSION=1.0 DEBUG",
+		"ARG NPM_TOKEN",
+		"|2 NPM_TOKEN=s3cret VERSION=2.0 /bin/sh -c npm ci",
+		"RUN |1 TARGETARCH=amd64 /bin/sh -c make # buildkit",
+	)
+
+	args, err := img.BuildArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"VERSION": "2.0", "DEBUG": "", "NPM_TOKEN": "s3cret", "TARGETARCH": "amd64"}
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("BuildArgs() = %v, want %v", args, want)
+	}
+
+	if args, err := historyImage(t, "ADD rootfs.tar / # buildkit").BuildArgs(); err != nil || len(args) != 0 {
+		t.Fatalf("BuildArgs() of an image without build args = %v (%v), want none", args, err)
+	}
+
+}
+
+func TestCreatedBy(t *testing.T) {
+
+	img := openImage(t, ociArchive{
+		layers: [][]testFile{{{name: "app"}}},
+		config: map[string]interface{}{"history": []map[string]interface{}{
+			{"created_by": "ADD rootfs.tar / # buildkit"},
+			{"created_by": `CMD ["app"]`, "empty_layer": true},
+			{"comment": "buildkit.exporter.image.v0", "empty_layer": true},
+		}},
+	}.write(t))
+
+	if step, err := img.CreatedBy(); err != nil || step != `CMD ["app"]` {
+		t.Fatalf("CreatedBy() = %q (%v), want the CMD step the image was finished with", step, err)
+	}
+
+	img = openImage(t, saveArchive{layers: []testLayer{
+		{id: "base"},
+		{id: "app", extra: map[string]interface{}{"container_config": map[string]interface{}{"Cmd": []string{"/bin/sh", "-c", "make"}}}},
+	}}.write(t))
+
+	if step, err := img.CreatedBy(); err != nil || step != "/bin/sh -c make" {
+		t.Fatalf("CreatedBy() of a v1 image = %q (%v), want the command of its latest layer", step, err)
+	}
+
+	img = openImage(t, ociArchive{layers: [][]testFile{{{name: "app"}}}}.write(t))
+
+	if step, err := img.CreatedBy(); err == nil {
+		t.Fatalf("CreatedBy() of an image without history = %q, want an error", step)
+	}
+
+}
+
+func TestLayerKinds(t *testing.T) {
+
+	img := openImage(t, ociArchive{
+		layers: [][]testFile{{{name: "bin/sh"}}, {{name: "app/main"}}, {{name: "app/build"}}, {{name: "app/.keep"}}, {{name: "data"}}},
+		config: map[string]interface{}{"history": []map[string]interface{}{
+			{"created_by": "/bin/sh -c #(nop) ADD file:4b9a in / "},
+			{"created_by": "/bin/sh -c #(nop)  ENV MODE=production", "empty_layer": true},
+			{"created_by": "COPY app /app # buildkit"},
+			{"created_by": "RUN |1 VERSION=1.2 /bin/sh -c make # buildkit"},
+			{"created_by": "/bin/sh -c #(nop) WORKDIR /app"},
+			{"created_by": "imported from data.tar"},
+		}},
+	}.write(t))
+
+	kinds, err := img.LayerKinds()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err := img.orderedLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, want := range []string{"add", "copy", "run", "metadata", "unknown"} {
+		if kinds[layers[k].Id] != want {
+			t.Fatalf("LayerKinds() of layer %d = %q, want %q", k, kinds[layers[k].Id], want)
+		}
+	}
+
+	img = openImage(t, ociArchive{layers: [][]testFile{{{name: "bin/sh"}}, {{name: "app/main"}}}}.write(t))
+
+	if kinds, err := img.LayerKinds(); err != nil || len(kinds) != 2 || kinds[layers[0].Id] != "unknown" {
+		t.Fatalf("LayerKinds() of an image without history = %v (%v), want every layer unknown", kinds, err)
+	}
+
+}
@@ -0,0 +1,105 @@
+package dockerscope
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Hostname returns the hostname a container started from the image gets, as set in its config or, if unset
+// there, in the container_config of the build container. It is empty if the image sets none.
+func (i *Image) Hostname() (string, error) {
+	return i.hostConfig(func(c *ContainerConfig) string { return c.Hostname })
+}
+
+// Domainname returns the domain name a container started from the image gets, read like Hostname
+func (i *Image) Domainname() (string, error) {
+	return i.hostConfig(func(c *ContainerConfig) string { return c.Domainname })
+}
+
+// hostConfig returns the field get reads from the runtime configuration of the image or, if empty there, from
+// its container_config
+func (i *Image) hostConfig(get func(c *ContainerConfig) string) (string, error) {
+
+	c, err := i.Config()
+	if err != nil {
+		return "", err
+	}
+
+	if value := get(c); value != "" {
+		return value, nil
+	}
+
+	imageConfig, err := i.imageConfig()
+	if err != nil {
+		return "", err
+	}
+
+	raw, found := imageConfig["container_config"]
+	if !found || string(raw) == "null" {
+		return "", nil
+	}
+
+	container := &ContainerConfig{}
+
+	if err := json.Unmarshal(raw, container); err != nil {
+		return "", fmt.Errorf("Unexpected schema for `container_config` field in image %s", i.PathToSource)
+	}
+
+	return get(container), nil
+
+}
+
+// SetHostname sets the hostname a container started from the image gets. The hostname must be a valid RFC 1123
+// name such as appliance or appliance.example.com, an empty hostname removes it.
+func (i *Image) SetHostname(hostname string) error {
+
+	if !validHostname(hostname) {
+		return fmt.Errorf("Invalid hostname %s", hostname)
+	}
+
+	return i.setConfigField("Hostname", hostname)
+
+}
+
+// SetDomainname sets the domain name a container started from the image gets. It must be valid like a hostname,
+// an empty domain name removes it.
+func (i *Image) SetDomainname(domainname string) error {
+
+	if !validHostname(domainname) {
+		return fmt.Errorf("Invalid domain name %s", domainname)
+	}
+
+	return i.setConfigField("Domainname", domainname)
+
+}
+
+// validHostname reports whether name is empty or a valid RFC 1123 host name: dot separated labels of at most
+// 63 letters, digits and hyphens that neither start nor end with a hyphen, 253 characters at most in total
+func validHostname(name string) bool {
+
+	if name == "" {
+		return true
+	}
+
+	if len(name) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(name, ".") {
+
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+
+	}
+
+	return true
+
+}
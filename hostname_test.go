@@ -0,0 +1,59 @@
+package dockerscope
+
+import "testing"
+
+func TestHostnameAndDomainname(t *testing.T) {
+
+	for name, tc := range map[string]struct {
+		path     string
+		hostname string
+	}{
+		"oci": {ociArchive{layers: [][]testFile{{{name: "a"}}}}.write(t), ""},
+		"docker save": {saveArchive{layers: []testLayer{{
+			id:     "a",
+			config: map[string]interface{}{"Cmd": []string{"/sbin/init"}},
+			extra:  map[string]interface{}{"container_config": map[string]interface{}{"Hostname": "buildbox", "Domainname": "ci.internal"}},
+		}}}.write(t), "buildbox"},
+	} {
+
+		img := openImage(t, tc.path)
+
+		if hostname, err := img.Hostname(); err != nil || hostname != tc.hostname {
+			t.Fatalf("Hostname() of %s = %q (%v), want %q", name, hostname, err, tc.hostname)
+		}
+
+		if err := img.SetHostname("appliance"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		if err := openImage(t, tc.path).SetDomainname("example.com"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		img = openImage(t, tc.path)
+
+		hostname, err := img.Hostname()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		domainname, err := img.Domainname()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hostname != "appliance" || domainname != "example.com" {
+			t.Fatalf("Hostname() and Domainname() of %s = %q and %q, want appliance and example.com", name, hostname, domainname)
+		}
+
+		for _, invalid := range []string{"-appliance", "app_liance", "appliance.", "a..b"} {
+			if err := img.SetHostname(invalid); err == nil {
+				t.Fatalf("SetHostname(%q) succeeded", invalid)
+			}
+			if err := img.SetDomainname(invalid); err == nil {
+				t.Fatalf("SetDomainname(%q) succeeded", invalid)
+			}
+		}
+	}
+
+}
@@ -0,0 +1,141 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Index records where the content of every entry starts within the layer tarballs of an image, so that reads
+// can seek to an entry instead of scanning the tarball up to it. Compressed layers cannot be seeked into and
+// are not indexed.
+type Index struct {
+	layers map[string][]*indexEntry
+}
+
+// indexEntry is the header of a layer tarball entry and the offset of its content
+type indexEntry struct {
+	header *tar.Header
+	offset int64
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Entries returns the number of entries recorded for the layer layerId
+func (x *Index) Entries(layerId string) int {
+	return len(x.layers[layerId])
+}
+
+// BuildIndex scans every uncompressed layer of the image once and records the offsets of its entries. Later
+// reads of the image use the index until the layers are rewritten.
+func (i *Image) BuildIndex() (*Index, error) {
+
+	if err := i.loadLayers(); err != nil {
+		return nil, err
+	}
+
+	x := &Index{layers: make(map[string][]*indexEntry)}
+
+	for _, l := range i.Layers {
+
+		if format, err := l.compression(); err != nil || format != "" {
+			continue
+		}
+
+		entries, err := indexLayer(l.path)
+		if err != nil {
+			return nil, fmt.Errorf("Error indexing layer %s: %s", l.Id, err)
+		}
+
+		x.layers[l.Id] = entries
+
+	}
+
+	i.index = x
+
+	return x, nil
+
+}
+
+// indexLayer records the header and content offset of every entry of the tarball at path
+func indexLayer(path string) ([]*indexEntry, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// the tar reader must not see a Seeker, otherwise it skips content without the counter noticing
+	counter := &countingReader{r: file}
+	tarReader := tar.NewReader(counter)
+	entries := make([]*indexEntry, 0)
+	global := map[string]string{}
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			for key, value := range header.PAXRecords {
+				global[key] = value
+			}
+			continue
+		}
+		applyGlobalHeader(header, global)
+
+		if header.Typeflag == tar.TypeGNUSparse {
+			return nil, fmt.Errorf("Sparse entry %s cannot be indexed", header.Name)
+		}
+
+		entries = append(entries, &indexEntry{header: header, offset: counter.n})
+	}
+
+}
+
+// indexedLayer returns the index entries of layerId, ok is false when the layer is not indexed
+func (i *Image) indexedLayer(layerId string) (entries []*indexEntry, ok bool) {
+
+	if i.index == nil {
+		return nil, false
+	}
+
+	entries, ok = i.index.layers[layerId]
+
+	return entries, ok
+
+}
+
+// walkIndexedLayer calls fn for every entry of an indexed layer, reading each content directly at its offset
+func (i *Image) walkIndexedLayer(l *Layer, entries []*indexEntry, fn func(header *tar.Header, r io.Reader) error) error {
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("No layer %s found in image %s", l.Id, i.PathToSource)
+	}
+	defer file.Close()
+
+	for _, e := range entries {
+		if err := fn(e.header, io.NewSectionReader(file, e.offset, e.header.Size)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
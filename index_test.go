@@ -0,0 +1,80 @@
+package dockerscope
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadFilesThroughIndex(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "etc/os-release", body: "ID=alpine"},
+			{name: "etc/motd", body: "base motd"},
+			{name: "usr/share/doc/README", body: "docs"},
+		}},
+		{id: "app", files: []testFile{
+			{name: "etc/motd", body: "app motd"},
+			{name: "app/config.yaml", body: "port: 80"},
+		}},
+	}}.write(t))
+
+	x, err := img.BuildIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if x.Entries("base") != 3 || x.Entries("app") != 2 {
+		t.Fatalf("index records %d and %d entries, want 3 and 2", x.Entries("base"), x.Entries("app"))
+	}
+
+	// destroy every tar header, so any read that scans a layer again instead of using the index fails
+	for _, l := range img.Layers {
+
+		data, err := ioutil.ReadFile(l.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range x.layers[l.Id] {
+			copy(data[e.offset-512:e.offset], bytes.Repeat([]byte{0xff}, 512))
+		}
+
+		if err := ioutil.WriteFile(l.path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for p, want := range map[string]string{
+		"/etc/os-release":  "ID=alpine",
+		"/etc/motd":        "app motd",
+		"/app/config.yaml": "port: 80",
+	} {
+
+		data, err := img.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != want {
+			t.Fatalf("ReadFile(%s) = %q, want %q", p, data, want)
+		}
+	}
+
+	r, err := img.OpenLayerFile("base", "/etc/motd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if data, err := ioutil.ReadAll(r); err != nil || string(data) != "base motd" {
+		t.Fatalf("OpenLayerFile() read %q (%v), want %q", data, err, "base motd")
+	}
+
+	if _, err := img.ReadFile("/usr/share/doc/missing"); !os.IsNotExist(err) {
+		t.Fatalf("ReadFile of a missing file returned %v, want a not exist error", err)
+	}
+
+}
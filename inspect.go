@@ -0,0 +1,79 @@
+package dockerscope
+
+// the phases Inspect reports to Options.ProgressFunc
+const (
+	InspectLayers  = "layers"
+	InspectConfig  = "config"
+	InspectSizes   = "sizes"
+	InspectDigests = "digests"
+)
+
+// Inspection is an overview of an image
+type Inspection struct {
+	// Layers are the layers of the image, base layer first
+	Layers []*Layer
+	// Config is the runtime configuration of the image
+	Config *ContainerConfig
+	// Size is the size of the image as docker images reports it
+	Size int64
+	// LayerSizes are the stored sizes of the layer blobs, keyed by layer id
+	LayerSizes map[string]int64
+	// Id is the id of the image, the digest of its config or the id of the latest layer for v1 images
+	Id string
+	// DiffIds are the digests of the uncompressed layers, base layer first
+	DiffIds []string
+}
+
+// Inspect reads the layers of the image, parses its config, computes its sizes and the digests of its content
+// and returns all of it. Reading a large image takes a while, so every completed phase is reported to
+// Options.ProgressFunc if set.
+func (i *Image) Inspect() (*Inspection, error) {
+
+	progress := func(phase string) {
+		if i.options.ProgressFunc != nil {
+			i.options.ProgressFunc(phase)
+		}
+	}
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	progress(InspectLayers)
+
+	config, err := i.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	progress(InspectConfig)
+
+	size, err := i.DockerReportedSize()
+	if err != nil {
+		return nil, err
+	}
+
+	layerSizes := make(map[string]int64)
+
+	for _, l := range layers {
+		layerSizes[l.Id] = l.size()
+	}
+
+	progress(InspectSizes)
+
+	id, err := i.imageId()
+	if err != nil {
+		return nil, err
+	}
+
+	diffIds, err := i.layerDiffIds()
+	if err != nil {
+		return nil, err
+	}
+
+	progress(InspectDigests)
+
+	return &Inspection{Layers: layers, Config: config, Size: size, LayerSizes: layerSizes, Id: id, DiffIds: diffIds}, nil
+
+}
@@ -0,0 +1,35 @@
+package dockerscope
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+
+	var phases []string
+
+	img := openImageWithOptions(t, ociArchive{
+		layers: [][]testFile{{{name: "bin/sh", body: "sh"}}, {{name: "app/main", body: "main"}}},
+		config: map[string]interface{}{"config": map[string]interface{}{"Cmd": []string{"/app/main"}}},
+	}.write(t), Options{ProgressFunc: func(phase string) { phases = append(phases, phase) }})
+
+	in, err := img.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{InspectLayers, InspectConfig, InspectSizes, InspectDigests}; !reflect.DeepEqual(phases, want) {
+		t.Fatalf("Inspect() reported phases %q, want %q", phases, want)
+	}
+
+	if len(in.Layers) != 2 || len(in.DiffIds) != 2 || len(in.LayerSizes) != 2 || !strings.HasPrefix(in.Id, "sha256:") {
+		t.Fatalf("Inspect() = %+v, want 2 layers with their diff ids and sizes and a sha256 id", in)
+	}
+
+	if len(in.Config.Cmd) != 1 || in.Config.Cmd[0] != "/app/main" {
+		t.Fatalf("Inspect().Config.Cmd = %q, want [/app/main]", in.Config.Cmd)
+	}
+
+}
@@ -0,0 +1,478 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// layer returns the layer of the image with the given id
+func (i *Image) layer(layerId string) (*Layer, error) {
+
+	if err := i.loadLayers(); err != nil {
+		return nil, err
+	}
+
+	for _, l := range i.Layers {
+		if l.Id == layerId {
+			return l, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No layer %s found in image %s", layerId, i.PathToSource)
+
+}
+
+// magic numbers of the compression formats layer tarballs may be stored in
+var compressionMagic = map[string][]byte{
+	"gzip":  {0x1f, 0x8b},
+	"bzip2": {0x42, 0x5a, 0x68},
+	"xz":    {0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00},
+	"zstd":  {0x28, 0xb5, 0x2f, 0xfd},
+}
+
+// compression returns the compression format the layer tarball is stored in, or an empty string if it is
+// stored uncompressed. The format is detected from the content, media types are not always present.
+func (l *Layer) compression() (string, error) {
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return sniffCompression(bufio.NewReader(file))
+
+}
+
+// sniffCompression returns the compression format of the content of r without consuming it
+func sniffCompression(r *bufio.Reader) (string, error) {
+
+	head, err := r.Peek(6)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	for format, magic := range compressionMagic {
+		if bytes.HasPrefix(head, magic) {
+			return format, nil
+		}
+	}
+
+	return "", nil
+
+}
+
+// openLayer returns the uncompressed tarball of the layer layerId. The caller must close it.
+func (i *Image) openLayer(layerId string) (io.ReadCloser, error) {
+
+	l, err := i.layer(layerId)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.openLayerContent(l)
+
+}
+
+// openLayerContent returns the uncompressed tarball of l, whatever compression it is stored in. Every read of
+// layer content goes through here. The caller must close it.
+func (i *Image) openLayerContent(l *Layer) (io.ReadCloser, error) {
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, fmt.Errorf("No layer %s found in image %s", l.Id, i.PathToSource)
+	}
+
+	buffered := bufio.NewReader(file)
+
+	format, err := sniffCompression(buffered)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Error reading layer %s: %s", l.Id, err)
+	}
+
+	var r io.Reader
+
+	switch format {
+	case "":
+		r = buffered
+	case "gzip":
+		if r, err = gzip.NewReader(buffered); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Error reading compressed layer %s: %s", l.Id, err)
+		}
+	case "bzip2":
+		r = bzip2.NewReader(buffered)
+	case "zstd":
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Error reading compressed layer %s: %s", l.Id, err)
+		}
+		return &layerFile{Reader: decoder, file: file, decoder: decoder}, nil
+	default:
+		file.Close()
+		return nil, fmt.Errorf("Layer %s is %s compressed, which is not supported", l.Id, format)
+	}
+
+	return &layerFile{Reader: r, file: file}, nil
+
+}
+
+// loadLayers extracts the image and reads its layers unless this already happened
+func (i *Image) loadLayers() error {
+
+	if err := i.extract(); err != nil {
+		return err
+	}
+
+	if len(i.Layers) == 0 {
+		return i.readLayers()
+	}
+
+	return nil
+
+}
+
+// walkLayer calls fn for every entry of the layer tarball of layerId
+func (i *Image) walkLayer(layerId string, fn func(header *tar.Header, r io.Reader) error) error {
+
+	if entries, ok := i.indexedLayer(layerId); ok {
+
+		l, err := i.layer(layerId)
+		if err != nil {
+			return err
+		}
+
+		return i.walkIndexedLayer(l, entries, fn)
+
+	}
+
+	r, err := i.openLayer(layerId)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := walkTarReader(r, fn); err != nil {
+		return fmt.Errorf("Error reading layer %s: %s", layerId, err)
+	}
+
+	return nil
+
+}
+
+// WalkLayerEntries calls fn for every entry of the layer tarball of layerId, in the order the tarball stores
+// them, without extracting the layer. r reads the content of the entry and is only valid until fn returns. The
+// first error fn returns stops the walk and is returned unchanged.
+func (i *Image) WalkLayerEntries(layerId string, fn func(header *tar.Header, r io.Reader) error) error {
+
+	var fnErr error
+
+	err := i.walkLayer(layerId, func(header *tar.Header, r io.Reader) error {
+		fnErr = fn(header, r)
+		return fnErr
+	})
+
+	if fnErr != nil {
+		return fnErr
+	}
+
+	return err
+
+}
+
+// FileCountByLayer returns the number of files each layer adds to the image, keyed by layer id. Whiteouts are not
+// counted.
+func (i *Image) FileCountByLayer() (map[string]int, error) {
+
+	if err := i.loadLayers(); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+
+	for _, l := range i.Layers {
+
+		n := 0
+
+		err := i.walkLayer(l.Id, func(header *tar.Header, r io.Reader) error {
+			// whiteouts, opaque markers included, remove files rather than add them
+			if header.Typeflag != tar.TypeDir && !strings.HasPrefix(path.Base(cleanPath(header.Name)), whiteoutPrefix) {
+				n++
+			}
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		counts[l.Id] = n
+
+	}
+
+	return counts, nil
+
+}
+
+// LayersWithExecutables returns the paths of the regular files with any execute bit set each layer adds, keyed
+// by layer id and sorted. Layers adding no executable are left out. Files a layer adds are reported even when
+// a layer above removes them again.
+func (i *Image) LayersWithExecutables() (map[string][]string, error) {
+
+	if err := i.loadLayers(); err != nil {
+		return nil, err
+	}
+
+	executables := make(map[string][]string)
+
+	for _, l := range i.Layers {
+
+		paths := make([]string, 0)
+
+		err := i.walkLayer(l.Id, func(header *tar.Header, r io.Reader) error {
+			if (header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA) && header.Mode&0111 != 0 {
+				paths = append(paths, cleanPath(header.Name))
+			}
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(paths) > 0 {
+			sort.Strings(paths)
+			executables[l.Id] = paths
+		}
+
+	}
+
+	return executables, nil
+
+}
+
+// layerFile reads content from within a layer tarball
+type layerFile struct {
+	io.Reader
+	file    io.Closer
+	decoder *zstd.Decoder // zstd decoders run goroutines until closed
+}
+
+// Close closes the underlying layer tarball
+func (f *layerFile) Close() error {
+
+	if f.decoder != nil {
+		f.decoder.Close()
+	}
+
+	return f.file.Close()
+
+}
+
+// cleanPath normalizes the name of a tar entry to an absolute path such as /etc/passwd
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// OpenLayerFile returns a reader for the file at filePath inside the layer layerId without extracting the layer.
+// The caller must close the reader.
+func (i *Image) OpenLayerFile(layerId, filePath string) (io.ReadCloser, error) {
+
+	target := cleanPath(filePath)
+
+	if entries, ok := i.indexedLayer(layerId); ok {
+
+		l, err := i.layer(layerId)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+
+			if cleanPath(e.header.Name) != target || e.header.Typeflag != tar.TypeReg {
+				continue
+			}
+
+			file, err := os.Open(l.path)
+			if err != nil {
+				return nil, fmt.Errorf("No layer %s found in image %s", layerId, i.PathToSource)
+			}
+
+			return &layerFile{Reader: io.NewSectionReader(file, e.offset, e.header.Size), file: file}, nil
+
+		}
+
+		return nil, fmt.Errorf("No file %s found in layer %s", filePath, layerId)
+
+	}
+
+	file, err := i.openLayer(layerId)
+	if err != nil {
+		return nil, err
+	}
+
+	tarReader := tar.NewReader(file)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Error reading layer %s: %s", layerId, err)
+		}
+
+		if cleanPath(header.Name) == target && header.Typeflag == tar.TypeReg {
+			return &layerFile{Reader: tarReader, file: file}, nil
+		}
+	}
+
+	file.Close()
+
+	return nil, fmt.Errorf("No file %s found in layer %s", filePath, layerId)
+
+}
+
+// layerContent returns the diff id of the layer layerId, the digest of its uncompressed tarball, and the total
+// size of the files it contains
+func (i *Image) layerContent(layerId string) (diffId string, size int64, err error) {
+
+	r, err := i.openLayer(layerId)
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Close()
+
+	digest := sha256.New()
+	tee := io.TeeReader(r, digest)
+
+	err = walkTarReader(tee, func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			size += header.Size
+		}
+		return nil
+	})
+
+	if err != nil {
+		return "", 0, fmt.Errorf("Error reading layer %s: %s", layerId, err)
+	}
+
+	// the tar reader stops at the end-of-archive marker, the padding after it is part of the digest too
+	if _, err := io.Copy(digest, r); err != nil {
+		return "", 0, fmt.Errorf("Error reading layer %s: %s", layerId, err)
+	}
+
+	return "sha256:" + hex.EncodeToString(digest.Sum(nil)), size, nil
+
+}
+
+// DockerReportedSize returns the size of the image the way docker images reports it: the summed content size of
+// all layers, counting layers with identical content only once
+func (i *Image) DockerReportedSize() (int64, error) {
+
+	if err := i.loadLayers(); err != nil {
+		return 0, err
+	}
+
+	seen := make(map[string]bool)
+	var total int64
+
+	for _, l := range i.Layers {
+
+		diffId, size, err := i.layerContent(l.Id)
+		if err != nil {
+			return 0, err
+		}
+
+		if !seen[diffId] {
+			seen[diffId] = true
+			total += size
+		}
+
+	}
+
+	return total, nil
+
+}
+
+// CompressionRatios returns for every layer the size of its stored blob divided by the size of its uncompressed
+// tarball, keyed by layer id. Uncompressed layers have a ratio of 1, a ratio close to 1 for a compressed layer
+// means its content hardly compresses, as is the case for media files or archives.
+func (i *Image) CompressionRatios() (map[string]float64, error) {
+
+	if err := i.loadLayers(); err != nil {
+		return nil, err
+	}
+
+	ratios := make(map[string]float64)
+
+	for _, l := range i.Layers {
+
+		r, err := i.openLayerContent(l)
+		if err != nil {
+			return nil, err
+		}
+
+		uncompressed, err := io.Copy(ioutil.Discard, r)
+		r.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("Error reading layer %s: %s", l.Id, err)
+		}
+
+		if uncompressed == 0 {
+			ratios[l.Id] = 1
+			continue
+		}
+
+		ratios[l.Id] = float64(l.size()) / float64(uncompressed)
+
+	}
+
+	return ratios, nil
+
+}
+
+const (
+	// maxLayers is the number of layers docker historically refuses to load images beyond
+	maxLayers = 127
+	// defaultLayerWarningThreshold is the layer count LayerLimitWarning warns from if Options.LayerWarningThreshold
+	// is not set
+	defaultLayerWarningThreshold = 100
+)
+
+// LayerLimitWarning reports whether the image has come close to or beyond the 127 layers docker can load, and
+// the number of layers it has. It warns from Options.LayerWarningThreshold layers on, 100 if not set. Images
+// that warn can be brought back below the limit with CoalesceLayers.
+func (i *Image) LayerLimitWarning() (bool, int, error) {
+
+	if err := i.loadLayers(); err != nil {
+		return false, 0, err
+	}
+
+	threshold := i.options.LayerWarningThreshold
+	if threshold <= 0 {
+		threshold = defaultLayerWarningThreshold
+	}
+
+	n := len(i.Layers)
+
+	return n >= threshold || n > maxLayers, n, nil
+
+}
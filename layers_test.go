@@ -0,0 +1,300 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileCountByLayer(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/hostname", body: "box"},
+			{name: "etc/hosts", body: "127.0.0.1 localhost"},
+			{name: "bin/sh", body: "#!"},
+		}},
+		{id: "app", files: []testFile{
+			{name: "app/main", body: "main"},
+		}},
+		{id: "cleanup", files: []testFile{
+			{name: "etc/.wh.hosts"},
+			{name: "app/.wh..wh..opq"},
+		}},
+		{id: "empty"},
+	}}.write(t))
+
+	counts, err := img.FileCountByLayer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"base": 3, "app": 1, "cleanup": 0, "empty": 0}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("FileCountByLayer() = %v, want %v", counts, want)
+	}
+
+}
+
+func TestOpenLayerFile(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "etc/motd", body: "welcome"},
+			{name: "srv/data.bin", body: "0123456789"},
+		}},
+	}}.write(t))
+
+	r, err := img.OpenLayerFile("base", "/srv/data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "0123456789" {
+		t.Fatalf("OpenLayerFile() read %q, want %q", data, "0123456789")
+	}
+
+	if _, err := img.OpenLayerFile("base", "/etc/missing"); err == nil {
+		t.Fatal("OpenLayerFile() of a missing file succeeded")
+	}
+
+}
+
+func TestDockerReportedSize(t *testing.T) {
+
+	shared := []testFile{{name: "usr/lib/libshared.so", body: strings.Repeat("s", 1000)}}
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: shared},
+		{id: "app", files: []testFile{{name: "app/main", body: strings.Repeat("m", 200)}}},
+		{id: "again", files: shared},
+	}, manifest: true}.write(t))
+
+	size, err := img.DockerReportedSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != 1200 {
+		t.Fatalf("DockerReportedSize() = %d, want 1200 with the shared layer counted once", size)
+	}
+
+}
+
+func TestOpenLayerContent(t *testing.T) {
+
+	files := []testFile{{name: "etc/", typeflag: tar.TypeDir}, {name: "etc/hostname", body: "builder"}}
+
+	for _, tc := range []struct {
+		name  string
+		store func([]byte) []byte
+	}{
+		{"uncompressed", func(b []byte) []byte { return b }},
+		{"gzip", gzipped},
+		{"zstd", zstdCompressed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+
+			img := openImage(t, saveArchive{layers: []testLayer{{id: "a", files: files}}}.write(t))
+
+			l, err := img.layer("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// docker save of a v1 image gives no media type, the compression has to be detected from the content
+			if err := ioutil.WriteFile(l.path, tc.store(layerTar(files)), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := img.openLayerContent(l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			content, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(content, layerTar(files)) {
+				t.Fatal("openLayerContent() did not return the uncompressed tarball")
+			}
+
+			if data, err := img.ReadFile("/etc/hostname"); err != nil || string(data) != "builder" {
+				t.Fatalf("ReadFile(/etc/hostname) = %q (%v), want builder", data, err)
+			}
+
+		})
+	}
+
+	img := openImage(t, ociArchive{layers: [][]testFile{files}, gzip: true}.write(t))
+
+	if data, err := img.ReadFile("/etc/hostname"); err != nil || string(data) != "builder" {
+		t.Fatalf("ReadFile(/etc/hostname) of a gzip OCI layer = %q (%v), want builder", data, err)
+	}
+
+}
+
+func TestCompressionRatios(t *testing.T) {
+
+	random := make([]byte, 64<<10)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	img := openImage(t, ociArchive{layers: [][]testFile{
+		{{name: "usr/share/doc/README", body: strings.Repeat("compressible ", 8<<10)}},
+		{{name: "media/video.mp4", body: string(random)}},
+	}, gzip: true}.write(t))
+
+	ratios, err := img.CompressionRatios()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layers, err := img.orderedLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if text := ratios[layers[0].Id]; text <= 0 || text > 0.1 {
+		t.Fatalf("CompressionRatios() of the text layer = %v, want below 0.1", text)
+	}
+
+	if media := ratios[layers[1].Id]; media < 0.9 {
+		t.Fatalf("CompressionRatios() of the random layer = %v, want about 1", media)
+	}
+
+	img = openImage(t, saveArchive{layers: []testLayer{{id: "a", files: []testFile{{name: "a", body: "a"}}}}}.write(t))
+
+	if ratios, err := img.CompressionRatios(); err != nil || ratios["a"] != 1 {
+		t.Fatalf("CompressionRatios() of an uncompressed layer = %v (%v), want 1", ratios, err)
+	}
+
+}
+
+func TestWalkLayerEntries(t *testing.T) {
+
+	img := openImage(t, ociArchive{layers: [][]testFile{{
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/hosts", body: "127.0.0.1"},
+		{name: "etc/motd", body: "hello"},
+		{name: "etc/issue", typeflag: tar.TypeSymlink, linkname: "motd"},
+	}}, gzip: true}.write(t))
+
+	layers, err := img.orderedLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries int
+	var headerSizes, read int64
+
+	err = img.WalkLayerEntries(layers[0].Id, func(h *tar.Header, r io.Reader) error {
+
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		entries++
+		headerSizes += h.Size
+		read += int64(len(data))
+
+		return nil
+
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entries != 4 || headerSizes != 14 || read != 14 {
+		t.Fatalf("WalkLayerEntries() visited %d entries of %d bytes, reading %d, want 4 entries of 14 bytes", entries, headerSizes, read)
+	}
+
+	stop := errors.New("stop")
+	entries = 0
+
+	err = img.WalkLayerEntries(layers[0].Id, func(h *tar.Header, r io.Reader) error {
+		entries++
+		return stop
+	})
+	if err != stop || entries != 1 {
+		t.Fatalf("WalkLayerEntries() = %v after %d entries, want the callback error after the first", err, entries)
+	}
+
+	if err := img.WalkLayerEntries("missing", func(*tar.Header, io.Reader) error { return nil }); err == nil {
+		t.Fatal("WalkLayerEntries() succeeded on a missing layer")
+	}
+
+}
+
+func TestLayerLimitWarning(t *testing.T) {
+
+	var layers []testLayer
+	for k := 0; k < 5; k++ {
+		layers = append(layers, testLayer{id: fmt.Sprintf("l%d", k), created: day(1).Add(time.Duration(k) * time.Hour)})
+	}
+	path := saveArchive{layers: layers}.write(t)
+
+	for _, tc := range []struct {
+		threshold int
+		warn      bool
+	}{
+		{4, true},
+		{5, true},
+		{6, false},
+		{0, false},
+	} {
+
+		warn, n, err := openImageWithOptions(t, path, Options{LayerWarningThreshold: tc.threshold}).LayerLimitWarning()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if warn != tc.warn || n != 5 {
+			t.Fatalf("LayerLimitWarning() with threshold %d = %v, %d, want %v, 5", tc.threshold, warn, n, tc.warn)
+		}
+	}
+
+}
+
+func TestLayersWithExecutables(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{{name: "etc/app.conf", body: "conf", mode: 0644}}},
+		{id: "app", files: []testFile{
+			{name: "usr/bin/tool", body: "tool", mode: 0755},
+			{name: "usr/bin/data", body: "data", mode: 0600},
+			{name: "opt/run", body: "run", mode: 0700},
+		}},
+		{id: "cleanup", files: []testFile{{name: "opt/.wh.run"}}},
+	}}.write(t))
+
+	executables, err := img.LayersWithExecutables()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string][]string{"app": {"/opt/run", "/usr/bin/tool"}}; !reflect.DeepEqual(executables, want) {
+		t.Fatalf("LayersWithExecutables() = %v, want %v", executables, want)
+	}
+
+}
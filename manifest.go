@@ -0,0 +1,153 @@
+package dockerscope
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// manifestEntry is an image listed in the manifest.json that docker save writes next to the v1 layers
+type manifestEntry struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// manifestPath returns the location of manifest.json in the working copy
+func (i *Image) manifestPath() string {
+	return i.pathToWorkingCopy + string(filepath.Separator) + dockerManifestFile
+}
+
+// hasManifest reports whether the image carries a docker save manifest.json
+func (i *Image) hasManifest() bool {
+
+	if i.isDirLayout() {
+		return false
+	}
+
+	_, err := os.Stat(i.manifestPath())
+
+	return err == nil
+
+}
+
+// readManifest returns the images listed in manifest.json
+func (i *Image) readManifest() ([]*manifestEntry, error) {
+
+	data, err := ioutil.ReadFile(i.manifestPath())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read manifest of image %s", i.pathToWorkingCopy)
+	}
+
+	var entries []*manifestEntry
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("Unexpected data schema for manifest.json in image %s", i.pathToWorkingCopy)
+	}
+
+	return entries, nil
+
+}
+
+// writeManifest replaces manifest.json with entries
+func (i *Image) writeManifest(entries []*manifestEntry) error {
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("Error writing manifest: Json failed %s", i.pathToWorkingCopy)
+	}
+
+	if err := ioutil.WriteFile(i.manifestPath(), data, 0644); err != nil {
+		return fmt.Errorf("Error writing manifest: Manifest write failed) %s", i.pathToWorkingCopy)
+	}
+
+	return nil
+
+}
+
+// readManifestConfig returns the top level fields of the config file entry refers to
+func (i *Image) readManifestConfig(entry *manifestEntry) (map[string]json.RawMessage, error) {
+
+	path := i.manifestConfigPath(entry)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read image config %s", path)
+	}
+
+	var config map[string]json.RawMessage
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Unexpected data schema for image config %s", path)
+	}
+
+	return config, nil
+
+}
+
+// manifestConfigPath returns the location of the config file entry references in the working copy. docker save
+// references it by file name, <hex>.json at the root of the archive, archives in OCI layout by blob path,
+// blobs/sha256/<hex>. References by bare digest are looked up as a blob first, then at the root.
+func (i *Image) manifestConfigPath(entry *manifestEntry) string {
+
+	if !strings.HasPrefix(entry.Config, digestPrefix) {
+		return filepath.Join(i.pathToWorkingCopy, filepath.FromSlash(entry.Config))
+	}
+
+	hex := strings.TrimPrefix(entry.Config, digestPrefix)
+	blob := filepath.Join(i.pathToWorkingCopy, ociBlobDirectory, "sha256", hex)
+
+	if _, err := os.Stat(blob); err == nil {
+		return blob
+	}
+
+	return filepath.Join(i.pathToWorkingCopy, hex+".json")
+
+}
+
+// writeManifestConfig stores config under its new digest and points entry to it, keeping the style entry
+// references the config in. The config file is content addressed, so the previous file is removed.
+func (i *Image) writeManifestConfig(entry *manifestEntry, config map[string]json.RawMessage) error {
+
+	data, err := marshalConfig(config)
+	if err != nil {
+		return fmt.Errorf("Error writing image config: Json failed %s", i.pathToWorkingCopy)
+	}
+
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	previous := i.manifestConfigPath(entry)
+	name := digest
+
+	if strings.HasSuffix(previous, ".json") {
+		name += ".json"
+	}
+
+	target := filepath.Join(filepath.Dir(previous), name)
+
+	if err := ioutil.WriteFile(target, data, 0644); err != nil {
+		return fmt.Errorf("Error writing image config: Config write failed) %s", i.pathToWorkingCopy)
+	}
+
+	reference := path.Join(path.Dir(entry.Config), name)
+	if strings.HasPrefix(entry.Config, digestPrefix) {
+		reference = digestPrefix + digest
+	}
+
+	if entry.Config != reference {
+		if previous != target {
+			os.Remove(previous)
+		}
+		entry.Config = reference
+	}
+
+	return nil
+
+}
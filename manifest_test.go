@@ -0,0 +1,99 @@
+package dockerscope
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestManifestConfigReferences(t *testing.T) {
+
+	for _, tc := range []struct {
+		style string
+		match func(ref string) bool
+	}{
+		{"", func(ref string) bool { return strings.HasSuffix(ref, ".json") && !strings.Contains(ref, "/") }},
+		{"blob", func(ref string) bool { return strings.HasPrefix(ref, "blobs/sha256/") && !strings.Contains(ref, ".") }},
+		{"digest", func(ref string) bool { return strings.HasPrefix(ref, "sha256:") }},
+	} {
+
+		path := saveArchive{
+			layers:       []testLayer{{id: "a", config: map[string]interface{}{"User": "app"}, files: []testFile{{name: "app"}}}},
+			repositories: map[string]map[string]string{"app": {"latest": "a"}},
+			manifest:     true,
+			configStyle:  tc.style,
+		}.write(t)
+
+		img := openImage(t, path)
+
+		if c, err := img.Config(); err != nil || c.User != "app" {
+			t.Fatalf("Config() with config reference style %q = %+v (%v), want User app", tc.style, c, err)
+		}
+
+		if err := img.SetLabel("version", "2"); err != nil {
+			t.Fatal(tc.style, err)
+		}
+
+		img = openImage(t, path)
+		if err := img.extract(); err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := img.readManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ref := entries[0].Config; !tc.match(ref) {
+			t.Fatalf("SetLabel() changed the config reference style %q to %s", tc.style, ref)
+		}
+
+		config := img.manifestConfigPath(entries[0])
+		if _, err := os.Stat(config); err != nil {
+			t.Fatalf("manifestConfigPath() = %s: %v", config, err)
+		}
+
+		id, err := img.imageId()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d, err := fileDigest(config); err != nil || d != id {
+			t.Fatalf("imageId() = %s, want the digest %s of the config", id, d)
+		}
+
+		if err := img.SelfTest(); err != nil {
+			t.Fatalf("SelfTest() with config reference style %q = %v", tc.style, err)
+		}
+
+		if v := img.LabelOr("version", ""); v != "2" {
+			t.Fatalf("label version = %q after SetLabel(), want 2", v)
+		}
+	}
+
+	// docker save since Docker 25 writes an OCI layout with a manifest.json referring to blob paths
+	img := openImage(t, ociArchive{
+		layers:      [][]testFile{{{name: "app"}}},
+		config:      map[string]interface{}{"config": map[string]interface{}{"User": "app"}},
+		annotations: map[string]string{"io.containerd.image.name": "docker.io/library/app:latest"},
+		docker:      true,
+	}.write(t))
+	if err := img.extract(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := img.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := img.readManifestConfig(entries[0])
+	if err != nil {
+		t.Fatalf("readManifestConfig() of %s = %v", entries[0].Config, err)
+	}
+
+	if !strings.Contains(string(config["config"]), `"User":"app"`) {
+		t.Fatalf("readManifestConfig() = %s, want the image config", config["config"])
+	}
+
+}
@@ -0,0 +1,754 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+	maxLinkDepth   = 40
+)
+
+// mergedEntry is a path of the merged filesystem together with the layer that provides it
+type mergedEntry struct {
+	header *tar.Header
+	layer  string
+}
+
+// TarEntry describes a path of the merged filesystem as recorded in the tar header of the layer providing it
+type TarEntry struct {
+	Path     string
+	Mode     os.FileMode
+	Size     int64
+	ModTime  time.Time
+	Uid      int
+	Gid      int
+	Uname    string
+	Gname    string
+	Typeflag byte
+	Linkname string
+	Layer    string
+}
+
+// FileInfo is a short description of a path of the merged filesystem and the layer providing it
+type FileInfo struct {
+	Path  string
+	Mode  os.FileMode
+	Size  int64
+	Layer string
+}
+
+// fileInfo returns the short description of the merged path p
+func (e *mergedEntry) fileInfo(p string) FileInfo {
+	return FileInfo{Path: p, Mode: e.header.FileInfo().Mode(), Size: e.header.Size, Layer: e.layer}
+}
+
+// tarEntry returns the description of the merged path p
+func (e *mergedEntry) tarEntry(p string) *TarEntry {
+
+	return &TarEntry{
+		Path:     p,
+		Mode:     e.header.FileInfo().Mode(),
+		Size:     e.header.Size,
+		ModTime:  e.header.ModTime,
+		Uid:      e.header.Uid,
+		Gid:      e.header.Gid,
+		Uname:    e.header.Uname,
+		Gname:    e.header.Gname,
+		Typeflag: e.header.Typeflag,
+		Linkname: e.header.Linkname,
+		Layer:    e.layer,
+	}
+
+}
+
+// mergedFS is the filesystem a container started from the image sees, keyed by absolute path
+type mergedFS map[string]*mergedEntry
+
+type byPosition []*Layer
+
+func (a byPosition) Len() int           { return len(a) }
+func (a byPosition) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byPosition) Less(i, j int) bool { return a[i].position < a[j].position }
+
+// orderedLayers returns the layers of the image in the order they are stacked, base layer first
+func (i *Image) orderedLayers() ([]*Layer, error) {
+
+	if err := i.loadLayers(); err != nil {
+		return nil, err
+	}
+
+	l := make([]*Layer, len(i.Layers))
+	copy(l, i.Layers)
+
+	// layers know their position in the stack from the manifest or their parent chain, otherwise they are
+	// stacked by creation time
+	if len(l) > 0 && l[0].position > 0 {
+		sort.Sort(byPosition(l))
+	} else {
+		sort.Sort(sort.Reverse(ByCreated(l)))
+	}
+
+	return l, nil
+
+}
+
+// stackLayers sets the position of v1 layers in the stack. The order of manifest.json is used if the image has
+// one, otherwise the chain of parent layers. Layers keep no position if neither describes a single stack.
+func (i *Image) stackLayers(layers []*Layer) error {
+
+	byId := make(map[string]*Layer)
+
+	for _, l := range layers {
+		byId[l.Id] = l
+	}
+
+	stack := make([]*Layer, 0, len(layers))
+
+	if i.hasManifest() {
+
+		entries, err := i.readManifest()
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 1 {
+			for _, p := range entries[0].Layers {
+				if l, ok := byId[path.Base(path.Dir(p))]; ok {
+					stack = append(stack, l)
+				}
+			}
+		}
+
+	} else {
+
+		// the top layer is the one no other layer names as its parent
+		isParent := make(map[string]bool)
+
+		for _, l := range layers {
+			isParent[l.parent] = true
+		}
+
+		var top *Layer
+
+		for _, l := range layers {
+			if !isParent[l.Id] {
+				if top != nil {
+					return nil
+				}
+				top = l
+			}
+		}
+
+		for l := top; l != nil && len(stack) < len(layers); l = byId[l.parent] {
+			stack = append([]*Layer{l}, stack...)
+		}
+
+	}
+
+	if len(stack) != len(layers) {
+		return nil
+	}
+
+	for k, l := range stack {
+		l.position = k + 1
+	}
+
+	return nil
+
+}
+
+// mergedFS applies all layers of the image on top of each other, honoring whiteouts
+func (i *Image) mergedFS() (mergedFS, error) {
+	return i.mergeLayers(nil)
+}
+
+// mergeLayers applies all layers of the image on top of each other like mergedFS does and calls removed, if set,
+// for every path a whiteout removes
+func (i *Image) mergeLayers(removed func(p string, e *mergedEntry)) (mergedFS, error) {
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	fs := make(mergedFS)
+	dirs := make(map[string]bool)
+
+	for _, l := range layers {
+
+		layerId := l.Id
+
+		err := i.WalkLayerEntries(layerId, func(header *tar.Header, r io.Reader) error {
+
+			name := cleanPath(header.Name)
+			if name == "/" {
+				return nil
+			}
+
+			dir, base := path.Split(name)
+
+			switch {
+			case base == opaqueWhiteout:
+				fs.whiteout(fs.pathsBelow(path.Clean(dir), layerId), removed)
+			case strings.HasPrefix(base, whiteoutPrefix):
+				hidden := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+				paths := fs.pathsBelow(hidden, layerId)
+				if e, found := fs[hidden]; found && e.layer != layerId {
+					paths = append(paths, hidden)
+				}
+				fs.whiteout(paths, removed)
+			default:
+				if add, err := fs.resolveConflict(name, header, layerId, i.options.ConflictPolicy, dirs); !add {
+					return err
+				}
+				fs[name] = &mergedEntry{header: header, layer: layerId}
+				for d := path.Dir(name); d != "/"; d = path.Dir(d) {
+					dirs[d] = true
+				}
+			}
+
+			return nil
+
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+	}
+
+	return fs, nil
+
+}
+
+// resolveConflict applies policy if the entry header of layerId at name collides with what the layers below
+// provide: a directory replacing a file or the other way round, or an entry below a path that is not a
+// directory. dirs holds every directory paths were added below. It reports whether the entry is to be added.
+func (fs mergedFS) resolveConflict(name string, header *tar.Header, layerId string, policy ConflictPolicy, dirs map[string]bool) (bool, error) {
+
+	isDir := header.Typeflag == tar.TypeDir
+	replaced := make([]string, 0)
+
+	if e, found := fs[name]; found && e.layer != layerId && (e.header.Typeflag == tar.TypeDir) != isDir {
+		replaced = append(replaced, name)
+	}
+
+	if !isDir && dirs[name] {
+		prefix := name + "/"
+		for p, e := range fs {
+			if strings.HasPrefix(p, prefix) && e.layer != layerId {
+				replaced = append(replaced, name)
+				break
+			}
+		}
+	}
+
+	// a symlink above the entry redirects it rather than colliding with it
+	for d := path.Dir(name); d != "/"; d = path.Dir(d) {
+		if e, found := fs[d]; found && e.layer != layerId && e.header.Typeflag != tar.TypeDir && e.header.Typeflag != tar.TypeSymlink {
+			replaced = append(replaced, d)
+		}
+	}
+
+	if len(replaced) == 0 {
+		return true, nil
+	}
+
+	switch policy {
+	case ConflictSkip:
+		return false, nil
+	case ConflictError:
+		return false, fmt.Errorf("%w: %s of layer %s collides with %s of a lower layer", ErrConflict, name, layerId, replaced[0])
+	}
+
+	for _, p := range replaced {
+		delete(fs, p)
+		fs.removeBelow(p, layerId)
+	}
+
+	return true, nil
+
+}
+
+// pathsBelow returns every path below dir that was provided by a layer other than layerId
+func (fs mergedFS) pathsBelow(dir string, layerId string) []string {
+
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	paths := make([]string, 0)
+
+	for p, e := range fs {
+		if strings.HasPrefix(p, prefix) && e.layer != layerId {
+			paths = append(paths, p)
+		}
+	}
+
+	return paths
+
+}
+
+// removeBelow removes every path below dir that was provided by a layer other than layerId
+func (fs mergedFS) removeBelow(dir string, layerId string) {
+
+	for _, p := range fs.pathsBelow(dir, layerId) {
+		delete(fs, p)
+	}
+
+}
+
+// whiteout removes paths, calling removed for each of them if it is set
+func (fs mergedFS) whiteout(paths []string, removed func(p string, e *mergedEntry)) {
+
+	for _, p := range paths {
+		if removed != nil {
+			removed(p, fs[p])
+		}
+		delete(fs, p)
+	}
+
+}
+
+// dirs returns every directory of the merged filesystem, including those only implied by the paths below them
+func (fs mergedFS) dirs() map[string]bool {
+
+	dirs := map[string]bool{"/": true}
+
+	for p, e := range fs {
+		if e.header.Typeflag == tar.TypeDir {
+			dirs[p] = true
+		}
+		for d := path.Dir(p); d != "/"; d = path.Dir(d) {
+			dirs[d] = true
+		}
+	}
+
+	return dirs
+
+}
+
+// resolve follows every symlink along p and returns the path it finally refers to. ok is false if some
+// component of p does not exist.
+func (fs mergedFS) resolve(p string, dirs map[string]bool, depth int) (resolved string, ok bool) {
+
+	if depth > maxLinkDepth {
+		return p, false
+	}
+
+	cur := "/"
+
+	for _, part := range strings.Split(strings.Trim(path.Clean(p), "/"), "/") {
+
+		if part == "" {
+			continue
+		}
+
+		cur = path.Join(cur, part)
+
+		e, found := fs[cur]
+		if !found {
+			if dirs[cur] {
+				continue
+			}
+			return cur, false
+		}
+
+		if e.header.Typeflag == tar.TypeSymlink {
+			target := e.header.Linkname
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(cur), target)
+			}
+			if cur, ok = fs.resolve(target, dirs, depth+1); !ok {
+				return cur, false
+			}
+		}
+
+	}
+
+	return cur, true
+
+}
+
+// BrokenSymlinks returns every symlink of the merged filesystem whose target does not exist within the image,
+// formatted as "link -> target"
+func (i *Image) BrokenSymlinks() ([]string, error) {
+
+	fs, err := i.mergedFS()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := fs.dirs()
+	broken := make([]string, 0)
+
+	for p, e := range fs {
+		if e.header.Typeflag != tar.TypeSymlink {
+			continue
+		}
+		if _, ok := fs.resolve(p, dirs, 0); !ok {
+			broken = append(broken, fmt.Sprintf("%s -> %s", p, e.header.Linkname))
+		}
+	}
+
+	sort.Strings(broken)
+
+	return broken, nil
+
+}
+
+// Stat returns the metadata of filePath in the merged filesystem without reading its content. Paths removed by
+// a whiteout do not exist. Directories that are only implied by the paths below them are reported with
+// default permissions.
+func (i *Image) Stat(filePath string) (*TarEntry, error) {
+
+	fs, err := i.mergedFS()
+	if err != nil {
+		return nil, err
+	}
+
+	p := cleanPath(filePath)
+
+	if e, ok := fs[p]; ok {
+		return e.tarEntry(p), nil
+	}
+
+	if fs.dirs()[p] {
+		return &TarEntry{Path: p, Mode: os.ModeDir | 0755, Typeflag: tar.TypeDir}, nil
+	}
+
+	return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+
+}
+
+// Exists reports whether filePath exists in the merged filesystem, without reading any content. Symlinks along
+// the directories above filePath are followed, a symlink at filePath itself exists even if its target does
+// not. Paths removed by a whiteout do not exist.
+func (i *Image) Exists(filePath string) (bool, error) {
+
+	fs, err := i.mergedFS()
+	if err != nil {
+		return false, err
+	}
+
+	p := cleanPath(filePath)
+	if p == "/" {
+		return true, nil
+	}
+
+	dirs := fs.dirs()
+
+	dir, ok := fs.resolve(path.Dir(p), dirs, 0)
+	if !ok {
+		return false, nil
+	}
+
+	p = path.Join(dir, path.Base(p))
+	_, found := fs[p]
+
+	return found || dirs[p], nil
+
+}
+
+// IsDeleted reports whether filePath is removed from the merged filesystem by a whiteout, and the id of the layer
+// whose whiteout removed it. The whiteout may name the path itself or a directory above it, or mark a directory
+// above it opaque. Only paths a lower layer provided, as an entry or as the directory above one, are deleted. A
+// path added again by a later layer is not deleted.
+func (i *Image) IsDeleted(filePath string) (bool, string, error) {
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return false, "", err
+	}
+
+	p := cleanPath(filePath)
+	present, deleted, deletedBy := false, false, ""
+
+	for _, l := range layers {
+
+		// whiteouts only hide what the layers below provide, so the layer is looked at as a whole
+		added, whiteout, opaque := false, false, false
+
+		err := i.walkLayer(l.Id, func(header *tar.Header, r io.Reader) error {
+
+			name := cleanPath(header.Name)
+			dir, base := path.Split(name)
+			dir = path.Clean(dir)
+
+			switch {
+			case base == opaqueWhiteout:
+				opaque = opaque || (p != dir && below(p, dir))
+			case strings.HasPrefix(base, whiteoutPrefix):
+				whiteout = whiteout || below(p, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			case below(name, p):
+				// an entry below p provides p as the directory above it
+				added = true
+			}
+
+			return nil
+
+		})
+
+		if err != nil {
+			return false, "", err
+		}
+
+		if (whiteout || opaque) && present {
+			present, deleted, deletedBy = false, true, l.Id
+		}
+
+		if added {
+			present, deleted, deletedBy = true, false, ""
+		}
+
+	}
+
+	return deleted, deletedBy, nil
+
+}
+
+// RedundantLayers returns the layers, base layer first, that contribute nothing to the merged filesystem: every
+// path they add is replaced or removed by a layer above. Layers with whiteouts are never redundant, removing
+// them would bring back what they delete. The config and history of the image may still refer to them.
+func (i *Image) RedundantLayers() ([]*Layer, error) {
+
+	fs, err := i.mergedFS()
+	if err != nil {
+		return nil, err
+	}
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	contributing := make(map[string]bool)
+
+	for _, e := range fs {
+		contributing[e.layer] = true
+	}
+
+	redundant := make([]*Layer, 0)
+
+	for _, l := range layers {
+
+		if contributing[l.Id] {
+			continue
+		}
+
+		hasWhiteout := false
+
+		err := i.walkLayer(l.Id, func(header *tar.Header, r io.Reader) error {
+			hasWhiteout = hasWhiteout || strings.HasPrefix(path.Base(cleanPath(header.Name)), whiteoutPrefix)
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !hasWhiteout {
+			redundant = append(redundant, l)
+		}
+
+	}
+
+	return redundant, nil
+
+}
+
+// DeletedButPresent returns the regular files a whiteout removes from the merged filesystem that are still
+// stored in the lower layer providing them, largest first. Their size is wasted in every copy of the image,
+// squashing the layers involved reclaims it.
+func (i *Image) DeletedButPresent() ([]FileInfo, error) {
+
+	found := make([]FileInfo, 0)
+
+	_, err := i.mergeLayers(func(p string, e *mergedEntry) {
+		if e.header.Typeflag == tar.TypeReg || e.header.Typeflag == tar.TypeRegA {
+			found = append(found, e.fileInfo(p))
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(found, func(a, b int) bool {
+		if found[a].Size != found[b].Size {
+			return found[a].Size > found[b].Size
+		}
+		return found[a].Path < found[b].Path
+	})
+
+	return found, nil
+
+}
+
+// ReadFile returns the content of filePath in the merged filesystem, following symlinks
+func (i *Image) ReadFile(filePath string) ([]byte, error) {
+
+	fs, err := i.mergedFS()
+	if err != nil {
+		return nil, err
+	}
+
+	p, ok := fs.resolve(cleanPath(filePath), fs.dirs(), 0)
+	e := fs[p]
+
+	if ok && e != nil && e.header.Typeflag == tar.TypeLink {
+		p = cleanPath(e.header.Linkname)
+		e = fs[p]
+	}
+
+	if !ok || e == nil {
+		return nil, &os.PathError{Op: "open", Path: cleanPath(filePath), Err: os.ErrNotExist}
+	}
+
+	if e.header.Typeflag != tar.TypeReg && e.header.Typeflag != tar.TypeRegA {
+		return nil, fmt.Errorf("%s is not a regular file", filePath)
+	}
+
+	r, err := i.OpenLayerFile(e.layer, p)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+
+}
+
+// WalkFS calls fn for every path of the merged filesystem in lexical order, stopping at the first error
+func (i *Image) WalkFS(fn func(info FileInfo) error) error {
+
+	fs, err := i.mergedFS()
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(fs))
+
+	for p := range fs {
+		paths = append(paths, p)
+	}
+
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		if err := fn(fs[p].fileInfo(p)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Find returns every path of the merged filesystem matching pattern. A pattern containing a slash is matched
+// against the full path, any other pattern against the last element of the path, as path.Match does.
+func (i *Image) Find(pattern string) ([]FileInfo, error) {
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("Invalid pattern %q: %s", pattern, err)
+	}
+
+	found := make([]FileInfo, 0)
+
+	err := i.WalkFS(func(info FileInfo) error {
+
+		name := path.Base(info.Path)
+		if strings.Contains(pattern, "/") {
+			name = info.Path
+		}
+
+		if ok, _ := path.Match(pattern, name); ok {
+			found = append(found, info)
+		}
+
+		return nil
+
+	})
+
+	return found, err
+
+}
+
+// FileExtensions returns how many regular files of the merged filesystem have each file extension, such as .py
+// or .jar, compared case insensitively and keyed in lower case. Files without an extension, including dot files
+// such as .bashrc, are counted under the empty string.
+func (i *Image) FileExtensions() (map[string]int, error) {
+
+	fs, err := i.mergedFS()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+
+	for p, e := range fs {
+
+		if e.header.Typeflag != tar.TypeReg && e.header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		base := path.Base(p)
+		ext := path.Ext(base)
+
+		if ext == base {
+			ext = ""
+		}
+
+		counts[strings.ToLower(ext)]++
+
+	}
+
+	return counts, nil
+
+}
+
+// DirectoryCount returns the number of directories of the merged filesystem, not counting the root. Directories
+// only implied by the paths below them count, directories removed by a whiteout do not.
+func (i *Image) DirectoryCount() (int, error) {
+
+	fs, err := i.mergedFS()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(fs.dirs()) - 1, nil
+
+}
+
+// EffectiveLayerSizes returns for every layer the summed size of the regular files it provides to the merged
+// filesystem, keyed by layer id. Files a layer adds that a layer above overwrites or removes do not count, so
+// this is the share of each layer in the filesystem a container sees rather than the size of its blob.
+func (i *Image) EffectiveLayerSizes() (map[string]int64, error) {
+
+	fs, err := i.mergedFS()
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int64)
+
+	for _, l := range i.Layers {
+		sizes[l.Id] = 0
+	}
+
+	for _, e := range fs {
+		if e.header.Typeflag == tar.TypeReg || e.header.Typeflag == tar.TypeRegA {
+			sizes[e.layer] += e.header.Size
+		}
+	}
+
+	return sizes, nil
+
+}
@@ -0,0 +1,408 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBrokenSymlinks(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "usr/bin/python3", body: "elf"},
+			{name: "usr/lib/libssl.so.3", body: "elf"},
+			{name: "etc/app.conf", body: "conf"},
+		}},
+		{id: "app", files: []testFile{
+			{name: "usr/bin/python", typeflag: tar.TypeSymlink, linkname: "python3"},
+			{name: "bin", typeflag: tar.TypeSymlink, linkname: "usr/bin"},
+			{name: "usr/local/bin/py", typeflag: tar.TypeSymlink, linkname: "/bin/python"},
+			{name: "usr/lib/libssl.so", typeflag: tar.TypeSymlink, linkname: "libssl.so.1.1"},
+			{name: "etc/.wh.app.conf"},
+			{name: "etc/app.yaml", typeflag: tar.TypeSymlink, linkname: "app.conf"},
+		}},
+	}}.write(t))
+
+	broken, err := img.BrokenSymlinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"/etc/app.yaml -> app.conf", "/usr/lib/libssl.so -> libssl.so.1.1"}
+	if !reflect.DeepEqual(broken, want) {
+		t.Fatalf("BrokenSymlinks() = %q, want %q", broken, want)
+	}
+
+}
+
+func TestStat(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "etc/shadow", body: "root:*:19000", mode: 0640},
+			{name: "etc/motd", body: "hi"},
+		}},
+		{id: "app", files: []testFile{
+			{name: "etc/shadow", body: "root:!:19000::::::", mode: 0600, modTime: day(9)},
+			{name: "etc/.wh.motd"},
+			{name: "usr/local/bin/app", body: "elf", mode: 0755},
+		}},
+	}}.write(t))
+
+	e, err := img.Stat("/etc/shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Mode != 0600 || e.Size != 18 || !e.ModTime.Equal(day(9)) || e.Layer != "app" {
+		t.Fatalf("Stat(/etc/shadow) = %+v, want mode 0600 and size 18 from layer app", e)
+	}
+
+	if _, err := img.Stat("etc/motd"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of a whited out file returned %v, want a not exist error", err)
+	}
+
+	e, err = img.Stat("/usr/local")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !e.Mode.IsDir() {
+		t.Fatalf("Stat(/usr/local) has mode %v, want a directory", e.Mode)
+	}
+
+}
+
+func TestMergeFollowsStackingOrder(t *testing.T) {
+
+	// the layer directories are written top layer first, and neither their creation times nor their ids sort
+	// in stacking order
+	layers := []testLayer{
+		{id: "c-base", created: day(20), files: []testFile{{name: "etc/version", body: "base"}, {name: "etc/base", body: "base"}}},
+		{id: "b-middle", created: day(10), files: []testFile{{name: "etc/version", body: "middle"}, {name: "etc/.wh.base"}}},
+		{id: "a-top", created: day(5), files: []testFile{{name: "etc/version", body: "top"}}},
+	}
+
+	for _, manifest := range []bool{false, true} {
+
+		img := openImage(t, saveArchive{layers: layers, manifest: manifest, reverse: true}.write(t))
+
+		data, err := img.ReadFile("/etc/version")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != "top" {
+			t.Fatalf("manifest %v: ReadFile(/etc/version) = %q, want the top layer's %q", manifest, data, "top")
+		}
+
+		if _, err := img.ReadFile("/etc/base"); err == nil {
+			t.Fatalf("manifest %v: /etc/base is present although the middle layer removes it", manifest)
+		}
+
+		ordered, err := img.orderedLayers()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for k, l := range ordered {
+			if l.Id != layers[k].id {
+				t.Fatalf("manifest %v: layer %d is %s, want %s", manifest, k, l.Id, layers[k].id)
+			}
+		}
+	}
+
+}
+
+func TestWhiteoutHidesLowerLayersOnly(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{{name: "etc/motd", body: "base"}}},
+		{id: "app", files: []testFile{
+			{name: "etc/app.conf", body: "app"},
+			{name: "etc/.wh.app.conf"},
+			{name: "etc/.wh.motd"},
+		}},
+	}}.write(t))
+
+	if data, err := img.ReadFile("/etc/app.conf"); err != nil || string(data) != "app" {
+		t.Fatalf("ReadFile(/etc/app.conf) = %q (%v), want the file its own layer whites out kept", data, err)
+	}
+
+	if _, err := img.ReadFile("/etc/motd"); err == nil {
+		t.Fatal("/etc/motd is present although the layer above removes it")
+	}
+
+}
+
+func TestIsDeleted(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/secret", body: "s"},
+			{name: "cache/", typeflag: tar.TypeDir},
+			{name: "cache/pip/wheel", body: "w"},
+			{name: "conf/", typeflag: tar.TypeDir},
+			{name: "conf/app.ini", body: "a"},
+			{name: "restored", body: "1"},
+		}},
+		{id: "cleanup", files: []testFile{
+			{name: "etc/.wh.secret"},
+			{name: ".wh.cache"},
+			{name: "conf/.wh..wh..opq"},
+			{name: ".wh.restored"},
+		}},
+		{id: "app", files: []testFile{{name: "restored", body: "2"}}},
+	}}.write(t))
+
+	for p, by := range map[string]string{
+		"/etc/secret":      "cleanup",
+		"/cache/pip/wheel": "cleanup",
+		"/cache":           "cleanup",
+		"/conf/app.ini":    "cleanup",
+		"/restored":        "",
+		"/etc":             "",
+		"/never/existed":   "",
+		"/cache/pip":       "cleanup",
+		"/cache/never":     "",
+	} {
+
+		deleted, layer, err := img.IsDeleted(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if deleted != (by != "") || layer != by {
+			t.Fatalf("IsDeleted(%s) = %v, %q, want %v, %q", p, deleted, layer, by != "", by)
+		}
+	}
+
+}
+
+func TestConflictPolicy(t *testing.T) {
+
+	path := saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "opt/", typeflag: tar.TypeDir},
+			{name: "opt/tool/", typeflag: tar.TypeDir},
+			{name: "opt/tool/bin", body: "bin"},
+			{name: "data", body: "file"},
+		}},
+		{id: "app", files: []testFile{
+			{name: "opt/tool", body: "a file now"},
+			{name: "data/", typeflag: tar.TypeDir},
+			{name: "data/db", body: "db"},
+		}},
+	}}.write(t)
+
+	for _, tc := range []struct {
+		policy ConflictPolicy
+		want   map[string]string
+	}{
+		{ConflictOverwrite, map[string]string{"opt/tool": "a file now", "data/db": "db"}},
+		{ConflictSkip, map[string]string{"opt/tool/bin": "bin", "data": "file"}},
+	} {
+
+		target := t.TempDir()
+		if err := openImageWithOptions(t, path, Options{ConflictPolicy: tc.policy}).ExtractRootFS(target); err != nil {
+			t.Fatal(err)
+		}
+
+		for p, body := range tc.want {
+			if data, err := ioutil.ReadFile(filepath.Join(target, filepath.FromSlash(p))); err != nil || string(data) != body {
+				t.Fatalf("%s extracted with policy %v = %q (%v), want %q", p, tc.policy, data, err, body)
+			}
+		}
+	}
+
+	if _, err := openImageWithOptions(t, path, Options{ConflictPolicy: ConflictError}).Stat("/opt/tool"); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Stat() with ConflictError = %v, want ErrConflict", err)
+	}
+
+}
+
+func TestRedundantLayers(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{{name: "etc/", typeflag: tar.TypeDir}, {name: "etc/os-release", body: "debian"}}},
+		{id: "draft", files: []testFile{{name: "etc/app.conf", body: "draft"}, {name: "tmp/", typeflag: tar.TypeDir}, {name: "tmp/build.log", body: "log"}}},
+		{id: "partly", files: []testFile{{name: "srv/keep", body: "keep"}, {name: "srv/replace", body: "old"}}},
+		{id: "final", files: []testFile{
+			{name: "etc/app.conf", body: "final"},
+			{name: ".wh.tmp"},
+			{name: "srv/replace", body: "new"},
+		}},
+	}}.write(t))
+
+	redundant, err := img.RedundantLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(redundant) != 1 || redundant[0].Id != "draft" {
+		ids := make([]string, 0)
+		for _, l := range redundant {
+			ids = append(ids, l.Id)
+		}
+		t.Fatalf("RedundantLayers() = %q, want [draft]", ids)
+	}
+
+}
+
+func TestDeletedButPresent(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "download", files: []testFile{
+			{name: "tmp/", typeflag: tar.TypeDir},
+			{name: "tmp/sdk.tar.gz", body: strings.Repeat("x", 50000)},
+			{name: "tmp/sdk/", typeflag: tar.TypeDir},
+			{name: "tmp/sdk/README", body: "readme"},
+			{name: "usr/bin/sdk", body: "sdk"},
+		}},
+		{id: "cleanup", files: []testFile{{name: "tmp/.wh.sdk.tar.gz"}, {name: "tmp/.wh.sdk"}}},
+	}}.write(t))
+
+	deleted, err := img.DeletedButPresent()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(deleted) != 2 {
+		t.Fatalf("DeletedButPresent() = %+v, want the archive and the README", deleted)
+	}
+
+	if f := deleted[0]; f.Path != "/tmp/sdk.tar.gz" || f.Size != 50000 || f.Layer != "download" {
+		t.Fatalf("DeletedButPresent()[0] = %+v, want /tmp/sdk.tar.gz of 50000 bytes in layer download", f)
+	}
+
+	if f := deleted[1]; f.Path != "/tmp/sdk/README" || f.Size != 6 {
+		t.Fatalf("DeletedButPresent()[1] = %+v, want /tmp/sdk/README of 6 bytes", f)
+	}
+
+}
+
+func TestFileExtensions(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "app/", typeflag: tar.TypeDir},
+			{name: "app/main.py", body: "main"},
+			{name: "app/Util.PY", body: "util"},
+			{name: "app/lib.tar.gz", body: "gz"},
+			{name: "app/old.py", body: "old"},
+			{name: "lib/app.jar", body: "jar"},
+			{name: "bin/sh", body: "sh"},
+			{name: "root/.bashrc", body: "rc"},
+			{name: "bin/python", typeflag: tar.TypeSymlink, linkname: "python3"},
+		}},
+		{id: "app", files: []testFile{{name: "app/.wh.old.py"}}},
+	}}.write(t))
+
+	counts, err := img.FileExtensions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dot files such as .bashrc have no extension, their name is all there is
+	want := map[string]int{".py": 2, ".gz": 1, ".jar": 1, "": 2}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("FileExtensions() = %v, want %v", counts, want)
+	}
+
+}
+
+func TestDirectoryCount(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "usr/lib/x86_64/libc.so", body: "libc"},
+			{name: "var/", typeflag: tar.TypeDir},
+			{name: "var/cache/", typeflag: tar.TypeDir},
+			{name: "var/cache/apt/", typeflag: tar.TypeDir},
+			{name: "var/cache/apt/pkgcache.bin", body: "cache"},
+		}},
+		{id: "app", files: []testFile{
+			{name: "var/.wh.cache"},
+			{name: "srv/", typeflag: tar.TypeDir},
+		}},
+	}}.write(t))
+
+	n, err := img.DirectoryCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// etc, usr, usr/lib, usr/lib/x86_64, var and srv
+	if n != 6 {
+		t.Fatalf("DirectoryCount() = %d, want 6", n)
+	}
+
+}
+
+func TestExists(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "usr/bin/sh", body: "sh"},
+			{name: "bin", typeflag: tar.TypeSymlink, linkname: "usr/bin"},
+			{name: "gone", body: "gone"},
+			{name: "dangling", typeflag: tar.TypeSymlink, linkname: "/nowhere"},
+		}},
+		{id: "app", files: []testFile{{name: ".wh.gone"}}},
+	}}.write(t))
+
+	for p, want := range map[string]bool{
+		"/":           true,
+		"/usr/bin/sh": true,
+		"/bin/sh":     true,
+		"usr":         true,
+		"/gone":       false,
+		"/absent":     false,
+		"/dangling":   true,
+		"/dangling/x": false,
+	} {
+		exists, err := img.Exists(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exists != want {
+			t.Fatalf("Exists(%s) = %v, want %v", p, exists, want)
+		}
+	}
+
+}
+
+func TestEffectiveLayerSizes(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "keep", body: strings.Repeat("k", 100)},
+			{name: "overwritten", body: strings.Repeat("o", 500)},
+			{name: "removed", body: strings.Repeat("r", 700)},
+		}},
+		{id: "update", files: []testFile{
+			{name: "overwritten", body: strings.Repeat("O", 50)},
+			{name: ".wh.removed"},
+		}},
+		{id: "cleanup", files: []testFile{{name: ".wh.overwritten"}}},
+	}}.write(t))
+
+	sizes, err := img.EffectiveLayerSizes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]int64{"base": 100, "update": 0, "cleanup": 0}; !reflect.DeepEqual(sizes, want) {
+		t.Fatalf("EffectiveLayerSizes() = %v, want %v", sizes, want)
+	}
+
+}
@@ -0,0 +1,564 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrMultipleImages is returned when an archive holding more than one image is opened as a single image
+var ErrMultipleImages = errors.New("Multiple images")
+
+// ArchivedImage is one of the images an archive holds
+type ArchivedImage struct {
+	// Id is the digest of the manifest of OCI images, the digest of the config of images listed in manifest.json
+	// and the id of the top layer of v1 images
+	Id string
+	// RepoTags are the references the image is tagged with, sorted
+	RepoTags []string
+	// digests are the manifests of OCI images that make up the image
+	digests []string
+}
+
+// matches reports whether ref is the id of the image, with or without the sha256: prefix, or one of its tags.
+// Tags without a tag of their own match the latest tag.
+func (a *ArchivedImage) matches(ref string) bool {
+
+	if ref == a.Id || digestPrefix+ref == a.Id {
+		return true
+	}
+
+	if _, tag := splitTag(ref); tag == "" {
+		ref += ":" + defaultTag
+	}
+
+	for _, t := range a.RepoTags {
+		if t == ref {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// readArchiveFiles returns the content of the files of the tarball at pathToImage named names, without
+// extracting the tarball. Files the archive lacks are missing from the result.
+func readArchiveFiles(pathToImage string, names ...string) (map[string][]byte, error) {
+
+	file, err := os.Open(pathToImage)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	// the file is a Seeker, the tar reader skips the content of every other entry without reading it
+	tarReader := tar.NewReader(file)
+	files := make(map[string][]byte)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return files, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(cleanPath(header.Name), "/")
+
+		if wanted[name] && header.Typeflag != tar.TypeDir {
+			if files[name], err = ioutil.ReadAll(tarReader); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+}
+
+// ListImages returns the images the archive at pathToImage holds, without extracting it. OCI archives list one
+// image per manifest of index.json, docker save archives one per entry of manifest.json and v1 archives one per
+// layer the repositories file tags.
+func ListImages(pathToImage string) ([]ArchivedImage, error) {
+
+	files, err := readArchiveFiles(pathToImage, ociIndexFile, dockerManifestFile, imageConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read image %s", pathToImage)
+	}
+
+	switch {
+	case files[ociIndexFile] != nil:
+		return listOCIImages(files[ociIndexFile])
+	case files[dockerManifestFile] != nil:
+		return listManifestImages(files[dockerManifestFile])
+	case files[imageConfigFile] != nil:
+		return listV1Images(files[imageConfigFile])
+	}
+
+	return []ArchivedImage{}, nil
+
+}
+
+// listOCIImages returns the images of an OCI index. Entries pointing to the same manifest are one image tagged
+// several times. Manifests no entry names, such as the platforms of a multi-platform image, are one image
+// together. Attestations are not images.
+func listOCIImages(data []byte) ([]ArchivedImage, error) {
+
+	index := &ociManifest{}
+
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("Unexpected data schema for OCI index")
+	}
+
+	byDigest := make([]ArchivedImage, 0)
+	positions := make(map[string]int)
+
+	for _, d := range index.Manifests {
+
+		if d.isReference() {
+			continue
+		}
+
+		k, found := positions[d.Digest]
+		if !found {
+			k = len(byDigest)
+			positions[d.Digest] = k
+			byDigest = append(byDigest, ArchivedImage{Id: d.Digest, RepoTags: []string{}, digests: []string{d.Digest}})
+		}
+
+		name := d.Annotations[containerdNameAnnotation]
+		if name == "" {
+			name = d.Annotations[ociRefNameAnnotation]
+		}
+
+		if name != "" && !containsString(byDigest[k].RepoTags, name) {
+			byDigest[k].RepoTags = append(byDigest[k].RepoTags, name)
+			sort.Strings(byDigest[k].RepoTags)
+		}
+
+	}
+
+	images := make([]ArchivedImage, 0)
+	merged := -1
+
+	for _, a := range byDigest {
+
+		if len(a.RepoTags) > 0 {
+			images = append(images, a)
+			continue
+		}
+
+		if merged < 0 {
+			merged = len(images)
+			images = append(images, a)
+			continue
+		}
+
+		images[merged].digests = append(images[merged].digests, a.Id)
+
+	}
+
+	return images, nil
+
+}
+
+// manifestImageId returns the id of the image entry describes, the digest of its config
+func manifestImageId(entry *manifestEntry) string {
+
+	if strings.HasPrefix(entry.Config, digestPrefix) {
+		return entry.Config
+	}
+
+	return digestPrefix + strings.TrimSuffix(path.Base(entry.Config), ".json")
+
+}
+
+// listManifestImages returns the images of a manifest.json
+func listManifestImages(data []byte) ([]ArchivedImage, error) {
+
+	var entries []*manifestEntry
+
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("Unexpected data schema for manifest.json")
+	}
+
+	images := make([]ArchivedImage, 0)
+
+	for _, entry := range entries {
+
+		tags := append([]string{}, entry.RepoTags...)
+		sort.Strings(tags)
+
+		images = append(images, ArchivedImage{Id: manifestImageId(entry), RepoTags: tags})
+
+	}
+
+	return images, nil
+
+}
+
+// listV1Images returns the images of a repositories file, one per tagged layer
+func listV1Images(data []byte) ([]ArchivedImage, error) {
+
+	repos, err := parseRepositories(data)
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]ArchivedImage, 0)
+	byLayer := make(map[string]int)
+
+	for name, tags := range repos {
+		for tag, layerId := range tags {
+
+			k, found := byLayer[layerId]
+			if !found {
+				k = len(images)
+				byLayer[layerId] = k
+				images = append(images, ArchivedImage{Id: layerId, RepoTags: []string{}})
+			}
+
+			images[k].RepoTags = append(images[k].RepoTags, name+":"+tag)
+
+		}
+	}
+
+	for k := range images {
+		sort.Strings(images[k].RepoTags)
+	}
+
+	sort.Slice(images, func(a, b int) bool { return images[a].Id < images[b].Id })
+
+	return images, nil
+
+}
+
+// containsString reports whether list contains s
+func containsString(list []string, s string) bool {
+
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// Select writes the image ref of the archive at pathToImage, given by id or tag as ListImages reports them, to
+// target as an archive of its own and opens it. The archive at pathToImage is left unchanged.
+func Select(pathToImage, ref, target string) (*Image, error) {
+
+	images, err := ListImages(pathToImage)
+	if err != nil {
+		return nil, err
+	}
+
+	var chosen *ArchivedImage
+
+	for k := range images {
+		if images[k].matches(ref) {
+			chosen = &images[k]
+			break
+		}
+	}
+
+	if chosen == nil {
+		return nil, fmt.Errorf("No image %s found in %s", ref, pathToImage)
+	}
+
+	source := newImage(pathToImage, Options{})
+	defer source.Close()
+
+	if err := source.extract(); err != nil {
+		return nil, err
+	}
+
+	dir := workingDirectory + string(filepath.Separator) + randomFilename()
+	if err := os.Mkdir(dir, defaultDirMode); err != nil {
+		return nil, fmt.Errorf("Error selecting image: Mkdir failed) %s", dir)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := source.copyImage(chosen, dir); err != nil {
+		return nil, err
+	}
+
+	if err := tarit(dir, target); err != nil {
+		return nil, fmt.Errorf("Error selecting image: Tar failed) %s", target)
+	}
+
+	return NewImage(target)
+
+}
+
+// copyImage copies the files making up the image a from the working copy into dir, together with an index,
+// manifest.json and repositories file listing only a
+func (i *Image) copyImage(a *ArchivedImage, dir string) error {
+
+	copyEntry := func(rel string) error {
+		return copyInto(filepath.Join(i.pathToWorkingCopy, rel), filepath.Join(dir, rel))
+	}
+
+	tags := a.RepoTags
+
+	switch {
+	case i.isOCI():
+
+		if err := i.copyOCIImage(a, dir); err != nil {
+			return err
+		}
+
+		if i.hasManifest() {
+
+			// docker save writes both layouts, keep the manifest.json entries of the configs just copied
+			entries, err := i.readManifest()
+			if err != nil {
+				return err
+			}
+
+			kept := make([]*manifestEntry, 0)
+
+			for _, entry := range entries {
+				if _, err := os.Stat(filepath.Join(dir, ociBlobDirectory, "sha256", strings.TrimPrefix(manifestImageId(entry), digestPrefix))); err == nil {
+					kept = append(kept, entry)
+					tags = append(tags, entry.RepoTags...)
+				}
+			}
+
+			if err := writeJSON(filepath.Join(dir, dockerManifestFile), kept); err != nil {
+				return err
+			}
+
+		}
+
+	case i.hasManifest():
+
+		entries, err := i.readManifest()
+		if err != nil {
+			return err
+		}
+
+		var entry *manifestEntry
+
+		for _, e := range entries {
+			if manifestImageId(e) == a.Id {
+				entry = e
+				break
+			}
+		}
+
+		if entry == nil {
+			return fmt.Errorf("No image %s found in manifest of %s", a.Id, i.PathToSource)
+		}
+
+		config, err := filepath.Rel(i.pathToWorkingCopy, i.manifestConfigPath(entry))
+		if err != nil {
+			return err
+		}
+
+		if err := copyEntry(config); err != nil {
+			return err
+		}
+
+		for _, l := range entry.Layers {
+
+			// v1 layers bring their json and VERSION file along
+			rel := filepath.FromSlash(l)
+			if path.Base(l) == layerTarFile {
+				rel = filepath.Dir(rel)
+			}
+
+			if err := copyEntry(rel); err != nil {
+				return err
+			}
+
+		}
+
+		if err := writeJSON(filepath.Join(dir, dockerManifestFile), []*manifestEntry{entry}); err != nil {
+			return err
+		}
+
+	default:
+
+		// v1 images are the chain of parents of their top layer
+		for layerId := a.Id; layerId != ""; {
+
+			if err := copyEntry(layerId); err != nil {
+				return err
+			}
+
+			layerConfig, err := i.readLayerConfig(layerId)
+			if err != nil {
+				return err
+			}
+
+			layerId = ""
+			json.Unmarshal(layerConfig["parent"], &layerId)
+
+		}
+
+	}
+
+	if _, err := os.Stat(i.repositoriesPath()); err != nil {
+		return nil
+	}
+
+	repos, err := i.Repositories()
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[string]map[string]string)
+
+	for name, named := range repos {
+		for tag, layerId := range named {
+			if containsString(tags, name+":"+tag) || layerId == a.Id {
+				if kept[name] == nil {
+					kept[name] = make(map[string]string)
+				}
+				kept[name][tag] = layerId
+			}
+		}
+	}
+
+	return writeJSON(filepath.Join(dir, imageConfigFile), kept)
+
+}
+
+// copyOCIImage copies the OCI layout of the image a into dir: its entries of index.json and every blob they
+// reference
+func (i *Image) copyOCIImage(a *ArchivedImage, dir string) error {
+
+	path := i.pathToWorkingCopy + string(filepath.Separator) + ociIndexFile
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read OCI index %s", path)
+	}
+
+	var index map[string]json.RawMessage
+	var descriptors []map[string]json.RawMessage
+
+	if json.Unmarshal(raw, &index) != nil || json.Unmarshal(index["manifests"], &descriptors) != nil {
+		return fmt.Errorf("Unexpected data schema for OCI index %s", path)
+	}
+
+	kept := make([]map[string]json.RawMessage, 0)
+	blobs := make(map[string]*BlobInfo)
+
+	for _, d := range descriptors {
+
+		var digest string
+		json.Unmarshal(d["digest"], &digest)
+
+		if !containsString(a.digests, digest) {
+			continue
+		}
+
+		kept = append(kept, d)
+
+		if err := addBlob(blobs, i.blobPath(digest), "", 1); err != nil {
+			return err
+		}
+
+		m, err := i.readManifestBlob(digest)
+		if err != nil {
+			return err
+		}
+
+		if err := i.collectReferencedBlobs(m, blobs, 0); err != nil {
+			return err
+		}
+
+	}
+
+	for digest := range blobs {
+
+		rel, err := filepath.Rel(i.pathToWorkingCopy, i.blobPath(digest))
+		if err != nil {
+			return err
+		}
+
+		if err := copyInto(i.blobPath(digest), filepath.Join(dir, rel)); err != nil {
+			return err
+		}
+
+	}
+
+	if _, err := os.Stat(filepath.Join(i.pathToWorkingCopy, ociLayoutFile)); err == nil {
+		if err := copyInto(filepath.Join(i.pathToWorkingCopy, ociLayoutFile), filepath.Join(dir, ociLayoutFile)); err != nil {
+			return err
+		}
+	}
+
+	index["manifests"], _ = json.Marshal(kept)
+
+	return writeJSON(filepath.Join(dir, ociIndexFile), index)
+
+}
+
+// copyInto copies the file or the files of the directory source to target, creating the directories target
+// needs
+func copyInto(source, target string) error {
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("Error selecting image: %s is missing", source)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("Error selecting image: Mkdir failed) %s", target)
+	}
+
+	if !info.IsDir() {
+		return copyFile(source, target)
+	}
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return fmt.Errorf("Error selecting image: Mkdir failed) %s", target)
+	}
+
+	files, err := ioutil.ReadDir(source)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if err := copyInto(filepath.Join(source, f.Name()), filepath.Join(target, f.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// writeJSON writes v to path as json
+func writeJSON(path string, v interface{}) error {
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Error writing %s: Json failed", path)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("Error writing %s: Write failed", path)
+	}
+
+	return nil
+
+}
@@ -0,0 +1,210 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mergeArchives writes the archive docker save or buildx would write for all the images of the archives at paths:
+// their files, the first copy of every file they share, with the entries of manifest.json, repositories and
+// index.json combined
+func mergeArchives(t *testing.T, paths ...string) string {
+
+	t.Helper()
+
+	var entries []archiveEntry
+	var manifest, descriptors []json.RawMessage
+	var index map[string]json.RawMessage
+	repos := make(map[string]json.RawMessage)
+	seen := make(map[string]bool)
+
+	for _, p := range paths {
+
+		file, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tarReader := tar.NewReader(file)
+
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadAll(tarReader)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			switch name := header.Name; name {
+			case "manifest.json":
+				var m []json.RawMessage
+				if err := json.Unmarshal(data, &m); err != nil {
+					t.Fatal(err)
+				}
+				manifest = append(manifest, m...)
+			case "repositories":
+				var r map[string]json.RawMessage
+				if err := json.Unmarshal(data, &r); err != nil {
+					t.Fatal(err)
+				}
+				for k, v := range r {
+					repos[k] = v
+				}
+			case "index.json":
+				var d []json.RawMessage
+				if err := json.Unmarshal(data, &index); err != nil {
+					t.Fatal(err)
+				}
+				if err := json.Unmarshal(index["manifests"], &d); err != nil {
+					t.Fatal(err)
+				}
+				descriptors = append(descriptors, d...)
+			default:
+				if header.Typeflag == tar.TypeDir {
+					data = nil
+				}
+				if !seen[name] {
+					seen[name] = true
+					entries = append(entries, archiveEntry{name: name, data: data})
+				}
+			}
+		}
+
+		file.Close()
+	}
+
+	if manifest != nil {
+		entries = append(entries, archiveEntry{name: "manifest.json", data: mustJSON(manifest)})
+	}
+	if len(repos) > 0 {
+		entries = append(entries, archiveEntry{name: "repositories", data: mustJSON(repos)})
+	}
+	if index != nil {
+		index["manifests"] = mustJSON(descriptors)
+		entries = append(entries, archiveEntry{name: "index.json", data: mustJSON(index)})
+	}
+
+	return writeArchive(t, entries)
+
+}
+
+func TestMultipleImages(t *testing.T) {
+
+	for _, manifest := range []bool{true, false} {
+
+		a := saveArchive{
+			layers:       []testLayer{{id: "a1", config: map[string]interface{}{"User": "a"}, files: []testFile{{name: "a"}}}},
+			repositories: map[string]map[string]string{"repo/a": {"latest": "a1"}},
+			manifest:     manifest,
+		}.write(t)
+
+		b := saveArchive{
+			layers: []testLayer{
+				{id: "b1", config: map[string]interface{}{"User": "b"}, files: []testFile{{name: "b"}}},
+				{id: "b2", config: map[string]interface{}{"User": "b"}},
+			},
+			repositories: map[string]map[string]string{"repo/b": {"v1": "b2"}},
+			manifest:     manifest,
+		}.write(t)
+
+		multi := mergeArchives(t, a, b)
+
+		if _, err := NewImage(multi); !errors.Is(err, ErrMultipleImages) {
+			t.Fatalf("NewImage() of an archive of two images = %v, want ErrMultipleImages", err)
+		}
+
+		images, err := ListImages(multi)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(images) != 2 {
+			t.Fatalf("ListImages() = %+v, want 2 images", images)
+		}
+
+		img, err := Select(multi, "repo/b:v1", filepath.Join(t.TempDir(), "b.tar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(img.Close)
+
+		c, err := img.Config()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		layers, err := img.orderedLayers()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.User != "b" || len(layers) != 2 {
+			t.Fatalf("Select(repo/b:v1) picked an image of user %s with %d layers, want user b with 2 layers", c.User, len(layers))
+		}
+
+		if err := img.SetName("renamed"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := img.SelfTest(); err != nil {
+			t.Fatalf("SelfTest() of the selected image = %v", err)
+		}
+
+		if _, err := Select(multi, "repo/c", filepath.Join(t.TempDir(), "c.tar")); err == nil {
+			t.Fatal("Select() of an image the archive lacks succeeded")
+		}
+
+		openImage(t, a)
+	}
+
+}
+
+func TestMultipleOCIImages(t *testing.T) {
+
+	a := ociArchive{
+		layers:      [][]testFile{{{name: "a"}}},
+		annotations: map[string]string{"io.containerd.image.name": "repo/a:latest"},
+	}.write(t)
+
+	b := ociArchive{
+		layers:      [][]testFile{{{name: "b"}}, {{name: "c"}}},
+		annotations: map[string]string{"io.containerd.image.name": "repo/b:latest"},
+	}.write(t)
+
+	multi := mergeArchives(t, a, b)
+
+	if _, err := NewImage(multi); !errors.Is(err, ErrMultipleImages) {
+		t.Fatalf("NewImage() of an OCI archive of two images = %v, want ErrMultipleImages", err)
+	}
+
+	img, err := Select(multi, "repo/b", filepath.Join(t.TempDir(), "b.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(img.Close)
+
+	layers, err := img.orderedLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(layers) != 2 {
+		t.Fatalf("Select(repo/b) picked an image with %d layers, want 2", len(layers))
+	}
+
+	if err := img.Verify(); err != nil {
+		t.Fatalf("Verify() of the selected image = %v", err)
+	}
+
+}
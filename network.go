@@ -0,0 +1,135 @@
+package dockerscope
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// exposedPortsHint is the key NetworkHints reports the exposed ports under
+const exposedPortsHint = "ExposedPorts"
+
+// networkLabelWords mark labels that describe how the image expects to be reached, such as
+// com.example.network.mode or traefik.http.services.app.loadbalancer.server.port
+var networkLabelWords = []string{"network", "port", "protocol", "hostname", "dns", "expose"}
+
+// NetworkHints collects what the image declares about its networking: the exposed ports, comma separated and
+// sorted under the key ExposedPorts, and every label whose key mentions networking, such as a port or a
+// network mode, under its own key
+func (i *Image) NetworkHints() (map[string]string, error) {
+
+	c, err := i.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	hints := make(map[string]string)
+
+	if len(c.ExposedPorts) > 0 {
+
+		ports := make([]string, 0, len(c.ExposedPorts))
+
+		for p := range c.ExposedPorts {
+			ports = append(ports, p)
+		}
+
+		sort.Strings(ports)
+		hints[exposedPortsHint] = strings.Join(ports, ",")
+
+	}
+
+	for key, value := range c.Labels {
+
+		lower := strings.ToLower(key)
+
+		for _, word := range networkLabelWords {
+			if strings.Contains(lower, word) {
+				hints[key] = value
+				break
+			}
+		}
+
+	}
+
+	return hints, nil
+
+}
+
+// ExposedTCP returns the TCP ports the image exposes, sorted. Ports exposed without a protocol are TCP ports,
+// ranges such as 8000-8002/tcp are reported port by port.
+func (i *Image) ExposedTCP() ([]int, error) {
+	return i.exposedPorts("tcp")
+}
+
+// ExposedUDP returns the UDP ports the image exposes, sorted, reported like ExposedTCP
+func (i *Image) ExposedUDP() ([]int, error) {
+	return i.exposedPorts("udp")
+}
+
+// exposedPorts returns the ports of protocol the image exposes, sorted
+func (i *Image) exposedPorts(protocol string) ([]int, error) {
+
+	c, err := i.Config()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[int]bool)
+	ports := make([]int, 0)
+
+	for spec := range c.ExposedPorts {
+
+		port, proto := spec, "tcp"
+		if k := strings.Index(spec, "/"); k >= 0 {
+			port, proto = spec[:k], strings.ToLower(spec[k+1:])
+		}
+
+		if proto != protocol {
+			continue
+		}
+
+		first, last, err := portRange(port)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected exposed port %s in image %s", spec, i.PathToSource)
+		}
+
+		for p := first; p <= last; p++ {
+			if !seen[p] {
+				seen[p] = true
+				ports = append(ports, p)
+			}
+		}
+
+	}
+
+	sort.Ints(ports)
+
+	return ports, nil
+
+}
+
+// portRange parses a port such as 80 or a port range such as 8000-8002
+func portRange(spec string) (first, last int, err error) {
+
+	bounds := strings.SplitN(spec, "-", 2)
+
+	if first, err = strconv.Atoi(bounds[0]); err != nil {
+		return 0, 0, err
+	}
+
+	last = first
+
+	if len(bounds) == 2 {
+		if last, err = strconv.Atoi(bounds[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("Invalid port range %s", spec)
+	}
+
+	return first, last, nil
+
+}
@@ -0,0 +1,71 @@
+package dockerscope
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNetworkHints(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{{id: "a", config: map[string]interface{}{
+		"ExposedPorts": map[string]struct{}{"8080/tcp": {}, "53/udp": {}},
+		"Labels": map[string]string{
+			"io.openshift.expose-services": "8080:http",
+			"com.example.network.mode":     "host",
+			"maintainer":                   "ops@example.com",
+		},
+	}}}}.write(t))
+
+	hints, err := img.NetworkHints()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"ExposedPorts":                 "53/udp,8080/tcp",
+		"io.openshift.expose-services": "8080:http",
+		"com.example.network.mode":     "host",
+	}
+	if !reflect.DeepEqual(hints, want) {
+		t.Fatalf("NetworkHints() = %v, want %v", hints, want)
+	}
+
+}
+
+func TestExposedTCPAndUDP(t *testing.T) {
+
+	img := openImage(t, ociArchive{
+		layers: [][]testFile{{{name: "app"}}},
+		config: map[string]interface{}{"config": map[string]interface{}{"ExposedPorts": map[string]struct{}{
+			"80/tcp": {}, "443": {}, "53/udp": {}, "53/tcp": {}, "6000-6002/udp": {}, "9/sctp": {},
+		}}},
+	}.write(t))
+
+	tcp, err := img.ExposedTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udp, err := img.ExposedUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int{53, 80, 443}; !reflect.DeepEqual(tcp, want) {
+		t.Fatalf("ExposedTCP() = %v, want %v", tcp, want)
+	}
+
+	if want := []int{53, 6000, 6001, 6002}; !reflect.DeepEqual(udp, want) {
+		t.Fatalf("ExposedUDP() = %v, want %v", udp, want)
+	}
+
+	img = openImage(t, ociArchive{
+		layers: [][]testFile{{{name: "app"}}},
+		config: map[string]interface{}{"config": map[string]interface{}{"ExposedPorts": map[string]struct{}{"http/tcp": {}}}},
+	}.write(t))
+
+	if ports, err := img.ExposedTCP(); err == nil {
+		t.Fatalf("ExposedTCP() of a named port = %v, want an error", ports)
+	}
+
+}
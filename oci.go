@@ -0,0 +1,348 @@
+package dockerscope
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ociLayoutFile      = "oci-layout"
+	ociIndexFile       = "index.json"
+	ociBlobDirectory   = "blobs"
+	dockerManifestFile = "manifest.json"
+	dirVersionFile     = "version"
+
+	// referenceTypeAnnotation marks manifests buildx stores next to the images they describe, such as
+	// attestations. They are not images of their own.
+	referenceTypeAnnotation = "vnd.docker.reference.type"
+	// referenceDigestAnnotation names the digest of the manifest a reference manifest describes
+	referenceDigestAnnotation = "vnd.docker.reference.digest"
+)
+
+// ociDescriptor references a blob of an OCI image by digest
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType,omitempty"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+// ociPlatform is the platform an OCI manifest is built for
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ociManifest is an OCI image manifest or image index. Docker v2 manifests and manifest lists share the schema.
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Manifests     []ociDescriptor   `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociHistory is a single step of the build history recorded in an image config
+type ociHistory struct {
+	Created    time.Time `json:"created"`
+	CreatedBy  string    `json:"created_by"`
+	EmptyLayer bool      `json:"empty_layer"`
+}
+
+// ociConfig is the part of an image config blob needed to read the layers
+type ociConfig struct {
+	Created time.Time    `json:"created"`
+	History []ociHistory `json:"history"`
+}
+
+// isReference reports whether d points to a manifest describing another image rather than to an image
+func (d *ociDescriptor) isReference() bool {
+	return d.Annotations[referenceTypeAnnotation] != ""
+}
+
+// isIndex reports whether m lists other manifests rather than layers
+func (m *ociManifest) isIndex() bool {
+	return len(m.Manifests) > 0 || strings.Contains(m.MediaType, "index") || strings.Contains(m.MediaType, "list")
+}
+
+// isOCI reports whether the image is stored as an OCI layout or as a skopeo dir: layout
+func (i *Image) isOCI() bool {
+
+	for _, f := range []string{ociLayoutFile, ociIndexFile} {
+		if _, err := os.Stat(i.pathToWorkingCopy + string(filepath.Separator) + f); err == nil {
+			return true
+		}
+	}
+
+	return i.isDirLayout()
+
+}
+
+// isDirLayout reports whether the image is stored the way skopeo's dir: transport writes it, with loose blobs
+// next to a single image manifest
+func (i *Image) isDirLayout() bool {
+
+	if _, err := os.Stat(i.pathToWorkingCopy + string(filepath.Separator) + dirVersionFile); err != nil {
+		return false
+	}
+
+	data, err := ioutil.ReadFile(i.pathToWorkingCopy + string(filepath.Separator) + dockerManifestFile)
+	if err != nil {
+		return false
+	}
+
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+
+}
+
+// blobPath returns the location of the blob with the given digest in the working copy
+func (i *Image) blobPath(digest string) string {
+
+	algorithm, hex := "sha256", digest
+	if k := strings.Index(digest, ":"); k >= 0 {
+		algorithm, hex = digest[:k], digest[k+1:]
+	}
+
+	if i.isDirLayout() {
+		return i.pathToWorkingCopy + string(filepath.Separator) + hex
+	}
+
+	return filepath.Join(i.pathToWorkingCopy, ociBlobDirectory, algorithm, hex)
+
+}
+
+// readBlob returns the content of the blob with the given digest
+func (i *Image) readBlob(digest string) ([]byte, error) {
+
+	data, err := ioutil.ReadFile(i.blobPath(digest))
+	if err != nil {
+		return nil, fmt.Errorf("No blob %s found in image %s", digest, i.PathToSource)
+	}
+
+	return data, nil
+
+}
+
+// readManifestBlob parses the manifest or index stored in the blob with the given digest
+func (i *Image) readManifestBlob(digest string) (*ociManifest, error) {
+
+	data, err := i.readBlob(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &ociManifest{}
+
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Unexpected data schema for manifest %s in image %s", digest, i.PathToSource)
+	}
+
+	return m, nil
+
+}
+
+// ociIndex returns the top level index of an OCI layout. For a dir: layout it returns the image manifest itself.
+func (i *Image) ociIndex() (*ociManifest, error) {
+
+	file := ociIndexFile
+	if i.isDirLayout() {
+		file = dockerManifestFile
+	}
+
+	path := i.pathToWorkingCopy + string(filepath.Separator) + file
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read OCI index %s", path)
+	}
+
+	m := &ociManifest{}
+
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("Unexpected data schema for OCI index %s", path)
+	}
+
+	return m, nil
+
+}
+
+// ociManifest returns the image manifest of an OCI layout, descending through nested indexes.
+// The first image manifest found is used.
+func (i *Image) ociManifest() (*ociManifest, error) {
+
+	m, _, err := i.ociManifestChain()
+
+	return m, err
+
+}
+
+// ociManifestChain returns the image manifest of an OCI layout together with the digests leading to it, from
+// the entry of the top level index down to the manifest itself. The chain is empty for a dir: layout.
+func (i *Image) ociManifestChain() (*ociManifest, []string, error) {
+
+	index, err := i.ociIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return i.findManifest(index, 0)
+
+}
+
+// findManifest returns the first image manifest reachable from m and the digests leading to it. Attestation
+// manifests are skipped.
+func (i *Image) findManifest(m *ociManifest, depth int) (*ociManifest, []string, error) {
+
+	if !m.isIndex() {
+		return m, []string{}, nil
+	}
+
+	if depth > maxLinkDepth {
+		return nil, nil, fmt.Errorf("OCI index nesting too deep in image %s", i.PathToSource)
+	}
+
+	for _, d := range m.Manifests {
+
+		if d.isReference() {
+			continue
+		}
+
+		child, err := i.readManifestBlob(d.Digest)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if found, chain, err := i.findManifest(child, depth+1); err == nil {
+			return found, append([]string{d.Digest}, chain...), nil
+		}
+
+	}
+
+	return nil, nil, fmt.Errorf("No image manifest found in image %s", i.PathToSource)
+
+}
+
+// readOCILayers reads the layers of an OCI image in the order the manifest lists them
+func (i *Image) readOCILayers() error {
+
+	m, err := i.ociManifest()
+	if err != nil {
+		return err
+	}
+
+	data, err := i.readBlob(m.Config.Digest)
+	if err != nil {
+		return err
+	}
+
+	config := &ociConfig{}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return fmt.Errorf("Unexpected data schema for image config %s", m.Config.Digest)
+	}
+
+	// the history lists an entry for every build step, only those not marked empty produced a layer
+	created := make([]time.Time, 0)
+
+	for _, h := range config.History {
+		if !h.EmptyLayer {
+			created = append(created, h.Created)
+		}
+	}
+
+	l := make([]*Layer, 0)
+
+	for k, d := range m.Layers {
+
+		layerCreationTime := config.Created
+		if len(created) == len(m.Layers) {
+			layerCreationTime = created[k]
+		}
+
+		l = append(l, &Layer{
+			Id:        strings.TrimPrefix(d.Digest, "sha256:"),
+			Created:   layerCreationTime,
+			path:      i.blobPath(d.Digest),
+			mediaType: d.MediaType,
+			position:  k + 1,
+		})
+
+	}
+
+	i.Layers = l
+
+	return nil
+
+}
+
+// LayerMediaTypes returns the media type of every layer as the manifest records it, base layer first.
+// Only OCI and Docker v2 manifests record media types, v1 images have none.
+func (i *Image) LayerMediaTypes() ([]string, error) {
+
+	if err := i.extract(); err != nil {
+		return nil, err
+	}
+
+	if !i.isOCI() {
+		return nil, fmt.Errorf("Image %s is a v1 image, its layers carry no media types", i.PathToSource)
+	}
+
+	m, err := i.ociManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	types := make([]string, len(m.Layers))
+
+	for k, d := range m.Layers {
+		if d.MediaType == "" {
+			return nil, fmt.Errorf("Layer %s of image %s carries no media type", d.Digest, i.PathToSource)
+		}
+		types[k] = d.MediaType
+	}
+
+	return types, nil
+
+}
+
+// ManifestDigest returns the digest of the manifest of the image, the digest a registry stores it under and
+// docker pull name@digest refers to. It differs from the image id, the digest of the config. For archives of a
+// multi-platform image it is the digest of the manifest list or index. Only OCI images carry a manifest, docker
+// save archives have none until the layers get compressed by a push.
+func (i *Image) ManifestDigest() (string, error) {
+
+	if err := i.extract(); err != nil {
+		return "", err
+	}
+
+	if !i.isOCI() {
+		return "", fmt.Errorf("Image %s carries no registry manifest", i.PathToSource)
+	}
+
+	_, chain, err := i.ociManifestChain()
+	if err != nil {
+		return "", err
+	}
+
+	path := i.pathToWorkingCopy + string(filepath.Separator) + dockerManifestFile
+	if len(chain) > 0 {
+		path = i.blobPath(chain[0])
+	}
+
+	digest, err := fileDigest(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read manifest of image %s", i.PathToSource)
+	}
+
+	return digest, nil
+
+}
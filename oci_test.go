@@ -0,0 +1,186 @@
+package dockerscope
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadOCILayouts(t *testing.T) {
+
+	layers := [][]testFile{
+		{{name: "etc/os-release", body: "ID=alpine"}, {name: "tmp/build.log", body: "log"}},
+		{{name: "app/main", body: "main"}, {name: "tmp/.wh.build.log"}},
+	}
+	config := map[string]interface{}{"config": map[string]interface{}{"User": "app", "Cmd": []string{"/app/main"}}}
+
+	for name, archive := range map[string]ociArchive{
+		"oci layout":                 {},
+		"docker save since 25":       {docker: true, annotations: map[string]string{"io.containerd.image.name": "docker.io/library/app:1"}},
+		"skopeo copy oci-archive:":   {gzip: true, annotations: map[string]string{"org.opencontainers.image.ref.name": "latest"}},
+		"buildx with a nested index": {gzip: true, nested: true},
+		"skopeo copy dir:":           {gzip: true, dir: true},
+	} {
+
+		archive.layers = layers
+		archive.config = config
+		img := openImage(t, archive.write(t))
+
+		c, err := img.Config()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		if c.User != "app" || len(c.Cmd) != 1 || c.Cmd[0] != "/app/main" {
+			t.Fatalf("%s: Config() = %+v, want user app running /app/main", name, c)
+		}
+
+		counts, err := img.FileCountByLayer()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		// the whiteout of the upper layer adds no file
+		if len(img.Layers) != 2 || counts[img.Layers[0].Id] != 2 || counts[img.Layers[1].Id] != 1 {
+			t.Fatalf("%s: FileCountByLayer() = %v, want a layer of two files and one of a single file", name, counts)
+		}
+
+		r, err := img.OpenLayerFile(img.Layers[1].Id, "/app/main")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		if string(data) != "main" {
+			t.Fatalf("%s: OpenLayerFile() read %q, want %q", name, data, "main")
+		}
+	}
+
+}
+
+func TestLayerMediaTypes(t *testing.T) {
+
+	img := openImage(t, ociArchive{layers: [][]testFile{{{name: "a"}}, {{name: "b"}}}, gzip: true}.write(t))
+
+	types, err := img.LayerMediaTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"application/vnd.oci.image.layer.v1.tar+gzip", "application/vnd.oci.image.layer.v1.tar+gzip"}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("LayerMediaTypes() = %q, want %q", types, want)
+	}
+
+	// skopeo copy dir: of a Windows image keeps the Docker v2 manifest with its foreign base layer
+	base, app := gzipped(layerTar([]testFile{{name: "Files/base"}})), gzipped(layerTar([]testFile{{name: "Files/app"}}))
+	config := mustJSON(map[string]interface{}{"os": "windows", "architecture": "amd64", "rootfs": map[string]interface{}{
+		"type":     "layers",
+		"diff_ids": []string{digestOf(layerTar([]testFile{{name: "Files/base"}})), digestOf(layerTar([]testFile{{name: "Files/app"}}))},
+	}})
+	manifest := mustJSON(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.docker.distribution.manifest.v2+json",
+		"config":        descriptor("application/vnd.docker.container.image.v1+json", config),
+		"layers": []map[string]interface{}{
+			descriptor("application/vnd.docker.image.rootfs.foreign.diff.tar.gzip", base),
+			descriptor("application/vnd.docker.image.rootfs.diff.tar.gzip", app),
+		},
+	})
+
+	var entries []archiveEntry
+	for _, b := range [][]byte{base, app, config} {
+		entries = append(entries, archiveEntry{name: digestOf(b)[len("sha256:"):], data: b})
+	}
+	entries = append(entries,
+		archiveEntry{name: "manifest.json", data: manifest},
+		archiveEntry{name: "version", data: []byte("Directory Transport Version: 1.1\n")},
+	)
+
+	img = openImage(t, writeArchive(t, entries))
+
+	if types, err = img.LayerMediaTypes(); err != nil {
+		t.Fatal(err)
+	}
+
+	want = []string{"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip", "application/vnd.docker.image.rootfs.diff.tar.gzip"}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("LayerMediaTypes() = %q, want %q", types, want)
+	}
+
+	img = openImage(t, saveArchive{layers: []testLayer{{id: "base"}}, manifest: true}.write(t))
+
+	if _, err := img.LayerMediaTypes(); err == nil || !strings.Contains(err.Error(), "v1 image") {
+		t.Fatalf("LayerMediaTypes() of a docker save image returned %v, want an error naming it a v1 image", err)
+	}
+
+}
+
+func TestManifestDigest(t *testing.T) {
+
+	img := openImage(t, ociArchive{layers: [][]testFile{{{name: "app"}}}}.write(t))
+
+	digest, err := img.ManifestDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := img.ociIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := img.imageId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if digest != index.Manifests[0].Digest || digest == id {
+		t.Fatalf("ManifestDigest() = %s, want the manifest digest %s the index lists, not the image id %s", digest, index.Manifests[0].Digest, id)
+	}
+
+	// buildx archives of multi-platform images are pulled by the digest of their image index
+	img = openImage(t, ociArchive{layers: [][]testFile{{{name: "app"}}}, nested: true}.write(t))
+
+	if digest, err = img.ManifestDigest(); err != nil {
+		t.Fatal(err)
+	}
+
+	if index, err = img.ociIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := img.readBlob(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nested ociManifest
+	if err := json.Unmarshal(data, &nested); err != nil {
+		t.Fatal(err)
+	}
+
+	if digest != index.Manifests[0].Digest || len(nested.Manifests) != 1 {
+		t.Fatalf("ManifestDigest() of a nested index = %s, want the digest %s of the image index", digest, index.Manifests[0].Digest)
+	}
+
+	img = openImage(t, ociArchive{layers: [][]testFile{{{name: "app"}}}, dir: true}.write(t))
+
+	if digest, err := img.ManifestDigest(); err != nil || len(digest) != len("sha256:")+64 {
+		t.Fatalf("ManifestDigest() of a dir: layout = %s (%v), want the digest of its manifest.json", digest, err)
+	}
+
+	img = openImage(t, saveArchive{layers: []testLayer{{id: "app"}}, manifest: true}.write(t))
+
+	if digest, err := img.ManifestDigest(); err == nil {
+		t.Fatalf("ManifestDigest() of a docker save archive = %s, want an error", digest)
+	}
+
+}
@@ -0,0 +1,626 @@
+package dockerscope
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// writeBlob stores data as a blob of the OCI layout and returns its digest
+func (i *Image) writeBlob(data []byte) (string, error) {
+
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	path := i.blobPath(digest)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("Error writing blob: Mkdir failed) %s", path)
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return "", fmt.Errorf("Error writing blob: Blob write failed) %s", path)
+	}
+
+	return digest, nil
+
+}
+
+// retargetDescriptor points d to newDigest if it currently references oldDigest and reports whether it did
+func retargetDescriptor(d map[string]json.RawMessage, oldDigest, newDigest string, size int64) bool {
+
+	var digest string
+
+	if json.Unmarshal(d["digest"], &digest) != nil || digest != oldDigest {
+		return false
+	}
+
+	d["digest"], _ = json.Marshal(newDigest)
+	d["size"], _ = json.Marshal(size)
+
+	return true
+
+}
+
+// editOCIConfig applies fn to the config blob of every image manifest of the layout, the config of each
+// platform of a multi-platform image, and updates the content addressed references up to index.json: the
+// config descriptors, every manifest and index on the way and manifest.json if the archive carries one.
+func (i *Image) editOCIConfig(fn func(imageConfig map[string]json.RawMessage) error) error {
+
+	// platforms may share a config, it is edited once
+	edited := make(map[string]*ociDescriptor)
+
+	return i.editOCIManifests(func(manifest map[string]json.RawMessage) ([]string, error) {
+		return i.editManifestConfig(manifest, fn, edited)
+	})
+
+}
+
+// editManifestConfig applies fn to the config blob manifest refers to, stores the result as a new blob and
+// points manifest and manifest.json at it. edited maps the configs already edited to their new descriptor. It
+// returns the digest of the replaced config.
+func (i *Image) editManifestConfig(manifest map[string]json.RawMessage, fn func(imageConfig map[string]json.RawMessage) error, edited map[string]*ociDescriptor) ([]string, error) {
+
+	var config map[string]json.RawMessage
+	var digest string
+
+	if json.Unmarshal(manifest["config"], &config) != nil || json.Unmarshal(config["digest"], &digest) != nil {
+		return nil, fmt.Errorf("Unexpected data schema for manifest in image %s", i.PathToSource)
+	}
+
+	d, found := edited[digest]
+
+	if !found {
+
+		data, err := i.readBlob(digest)
+		if err != nil {
+			return nil, err
+		}
+
+		var imageConfig map[string]json.RawMessage
+
+		if err := json.Unmarshal(data, &imageConfig); err != nil {
+			return nil, fmt.Errorf("Unexpected data schema for image config %s", digest)
+		}
+
+		if err := fn(imageConfig); err != nil {
+			return nil, err
+		}
+
+		if data, err = marshalConfig(imageConfig); err != nil {
+			return nil, fmt.Errorf("Error editing image: Json failed %s", i.pathToWorkingCopy)
+		}
+
+		configDigest, err := i.writeBlob(data)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := i.retargetManifestConfigs(digest, configDigest); err != nil {
+			return nil, err
+		}
+
+		d = &ociDescriptor{Digest: configDigest, Size: int64(len(data))}
+		edited[digest] = d
+
+	}
+
+	retargetDescriptor(config, digest, d.Digest, d.Size)
+	manifest["config"], _ = json.Marshal(config)
+
+	return []string{digest}, nil
+
+}
+
+// requireSinglePlatform fails for multi-platform images. Their platforms have layers of their own, rewriting
+// the layers of one platform would leave the others as they were.
+func (i *Image) requireSinglePlatform() error {
+
+	platforms, err := i.Platforms()
+	if err != nil {
+		return err
+	}
+
+	if len(platforms) > 1 {
+		return fmt.Errorf("Rewriting layers of multi-platform images is not supported %s", i.PathToSource)
+	}
+
+	return nil
+
+}
+
+// replaceOCILayers points the image manifest at layers and applies fn to its config, which has to record the
+// diff ids of the new layers. manifest.json follows if the archive carries one. Layer blobs no longer used are
+// removed.
+func (i *Image) replaceOCILayers(layers []ociDescriptor, fn func(imageConfig map[string]json.RawMessage) error) error {
+
+	edited := make(map[string]*ociDescriptor)
+
+	return i.editOCIManifests(func(manifest map[string]json.RawMessage) ([]string, error) {
+
+		var old []ociDescriptor
+
+		if err := json.Unmarshal(manifest["layers"], &old); err != nil {
+			return nil, fmt.Errorf("Unexpected data schema for manifest in image %s", i.PathToSource)
+		}
+
+		replaced, err := i.editManifestConfig(manifest, fn, edited)
+		if err != nil {
+			return nil, err
+		}
+
+		manifest["layers"], _ = json.Marshal(layers)
+
+		if err := i.retargetManifestLayers(edited[replaced[0]].Digest, layers); err != nil {
+			return nil, err
+		}
+
+		for _, d := range old {
+			replaced = append(replaced, d.Digest)
+		}
+
+		return replaced, nil
+
+	})
+
+}
+
+// retargetManifestLayers sets the layer paths of the entries of a docker save manifest.json inside an OCI
+// archive that use the config blob configDigest
+func (i *Image) retargetManifestLayers(configDigest string, layers []ociDescriptor) error {
+
+	if !i.hasManifest() {
+		return nil
+	}
+
+	entries, err := i.readManifest()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+
+		if !strings.HasSuffix(entry.Config, strings.TrimPrefix(configDigest, "sha256:")) {
+			continue
+		}
+
+		entry.Layers = make([]string, len(layers))
+		for k, d := range layers {
+			entry.Layers[k] = ociBlobDirectory + "/sha256/" + strings.TrimPrefix(d.Digest, "sha256:")
+		}
+
+	}
+
+	return i.writeManifest(entries)
+
+}
+
+// editOCIManifests calls fn with every image manifest of the layout, or the manifest of a dir: layout, and
+// stores what fn changed. fn returns the digests of the blobs it replaced. The descriptors of every index
+// leading to a changed manifest are updated up to index.json, as are the attestations naming it. Manifests
+// several entries refer to, such as an image saved under two tags, are edited once. Blobs replaced that nothing
+// refers to any longer are removed.
+func (i *Image) editOCIManifests(fn func(manifest map[string]json.RawMessage) ([]string, error)) error {
+
+	path := i.pathToWorkingCopy + string(filepath.Separator) + ociIndexFile
+	if i.isDirLayout() {
+		path = i.pathToWorkingCopy + string(filepath.Separator) + dockerManifestFile
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read OCI index %s", path)
+	}
+
+	replaced := make(map[string]*ociDescriptor)
+	old := make([]string, 0)
+
+	edit := func(manifest map[string]json.RawMessage) error {
+		blobs, err := fn(manifest)
+		old = append(old, blobs...)
+		return err
+	}
+
+	if raw, err = i.editManifestData(raw, edit, replaced, 0); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		return fmt.Errorf("Error editing image: Index write failed) %s", path)
+	}
+
+	for digest := range replaced {
+		old = append(old, digest)
+	}
+
+	return i.removeUnreferencedBlobs(old)
+
+}
+
+// editManifestData applies fn to the image manifest raw or, if raw is an index, to every image manifest it
+// lists, and returns raw updated. replaced maps the digests of the manifests edited so far to their new
+// descriptors.
+func (i *Image) editManifestData(raw []byte, fn func(manifest map[string]json.RawMessage) error, replaced map[string]*ociDescriptor, depth int) ([]byte, error) {
+
+	m := &ociManifest{}
+	var manifest map[string]json.RawMessage
+
+	if json.Unmarshal(raw, m) != nil || json.Unmarshal(raw, &manifest) != nil {
+		return nil, fmt.Errorf("Unexpected data schema for manifest in image %s", i.PathToSource)
+	}
+
+	if !m.isIndex() {
+		if err := fn(manifest); err != nil {
+			return nil, err
+		}
+		return json.Marshal(manifest)
+	}
+
+	if depth > maxLinkDepth {
+		return nil, fmt.Errorf("OCI index nesting too deep in image %s", i.PathToSource)
+	}
+
+	var descriptors []map[string]json.RawMessage
+
+	if err := json.Unmarshal(manifest["manifests"], &descriptors); err != nil || len(descriptors) != len(m.Manifests) {
+		return nil, fmt.Errorf("Unexpected data schema for OCI index in image %s", i.PathToSource)
+	}
+
+	for k, d := range m.Manifests {
+
+		if d.isReference() {
+			continue
+		}
+
+		edited, found := replaced[d.Digest]
+
+		if !found {
+
+			child, err := i.readBlob(d.Digest)
+			if err != nil {
+				return nil, err
+			}
+
+			if child, err = i.editManifestData(child, fn, replaced, depth+1); err != nil {
+				return nil, err
+			}
+
+			digest, err := i.writeBlob(child)
+			if err != nil {
+				return nil, err
+			}
+
+			edited = &ociDescriptor{Digest: digest, Size: int64(len(child))}
+			replaced[d.Digest] = edited
+
+		}
+
+		retargetDescriptor(descriptors[k], d.Digest, edited.Digest, edited.Size)
+
+	}
+
+	// attestations name the digest of the manifest they describe
+	for k, d := range m.Manifests {
+
+		edited, found := replaced[d.Annotations[referenceDigestAnnotation]]
+
+		if d.isReference() && found {
+			d.Annotations[referenceDigestAnnotation] = edited.Digest
+			descriptors[k]["annotations"], _ = json.Marshal(d.Annotations)
+		}
+
+	}
+
+	manifest["manifests"], _ = json.Marshal(descriptors)
+
+	return json.Marshal(manifest)
+
+}
+
+// removeUnreferencedBlobs removes the blobs of digests that neither the OCI index nor manifest.json refer to
+func (i *Image) removeUnreferencedBlobs(digests []string) error {
+
+	index, err := i.ociIndex()
+	if err != nil {
+		return err
+	}
+
+	referenced := make(map[string]bool)
+
+	if err := i.collectReferencedDigests(index, referenced, 0); err != nil {
+		return err
+	}
+
+	if i.hasManifest() && !i.isDirLayout() {
+
+		entries, err := i.readManifest()
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			for _, p := range append([]string{entry.Config}, entry.Layers...) {
+				referenced[digestPrefix+path.Base(p)] = true
+			}
+		}
+
+	}
+
+	for _, digest := range digests {
+		if !referenced[digest] {
+			os.Remove(i.blobPath(digest))
+		}
+	}
+
+	return nil
+
+}
+
+// collectReferencedDigests adds the digest of every blob the manifest or index m refers to, descending into the
+// manifests it lists
+func (i *Image) collectReferencedDigests(m *ociManifest, referenced map[string]bool, depth int) error {
+
+	if depth > maxLinkDepth {
+		return fmt.Errorf("OCI index nesting too deep in image %s", i.PathToSource)
+	}
+
+	if !m.isIndex() {
+		referenced[m.Config.Digest] = true
+		for _, l := range m.Layers {
+			referenced[l.Digest] = true
+		}
+		return nil
+	}
+
+	for _, d := range m.Manifests {
+
+		if referenced[d.Digest] {
+			continue
+		}
+		referenced[d.Digest] = true
+
+		child, err := i.readManifestBlob(d.Digest)
+		if err != nil {
+			return err
+		}
+
+		if err := i.collectReferencedDigests(child, referenced, depth+1); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
+
+// retargetManifestConfigs points the entries of a docker save manifest.json inside an OCI archive from the
+// config blob oldDigest to newDigest
+func (i *Image) retargetManifestConfigs(oldDigest, newDigest string) error {
+
+	if !i.hasManifest() {
+		return nil
+	}
+
+	entries, err := i.readManifest()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Config, strings.TrimPrefix(oldDigest, "sha256:")) {
+			entry.Config = ociBlobDirectory + "/sha256/" + strings.TrimPrefix(newDigest, "sha256:")
+		}
+	}
+
+	return i.writeManifest(entries)
+
+}
+
+const (
+	ociRefNameAnnotation     = "org.opencontainers.image.ref.name"
+	containerdNameAnnotation = "io.containerd.image.name"
+	defaultTag               = "latest"
+)
+
+// splitTag splits an image reference such as registry:5000/app:1.0 into its name and tag. The tag is empty
+// when the reference has none.
+func splitTag(ref string) (name, tag string) {
+
+	k := strings.LastIndex(ref, ":")
+	if k < 0 || strings.Contains(ref[k:], "/") {
+		return ref, ""
+	}
+
+	return ref[:k], ref[k+1:]
+
+}
+
+// setOCIName renames every image listed in index.json and manifest.json to newName while keeping its tag
+func (i *Image) setOCIName(newName string) error {
+
+	if i.isDirLayout() {
+		return fmt.Errorf("Images in dir layout carry no name %s", i.PathToSource)
+	}
+
+	path := i.pathToWorkingCopy + string(filepath.Separator) + ociIndexFile
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read OCI index %s", path)
+	}
+
+	var index map[string]json.RawMessage
+	var descriptors []map[string]json.RawMessage
+
+	if json.Unmarshal(raw, &index) != nil || json.Unmarshal(index["manifests"], &descriptors) != nil {
+		return fmt.Errorf("Unexpected data schema for OCI index %s", path)
+	}
+
+	for _, d := range descriptors {
+
+		annotations := make(map[string]string)
+		json.Unmarshal(d["annotations"], &annotations)
+
+		// digest references pin the image instead of naming a tag, only their repository changes
+		if ref := annotations[containerdNameAnnotation]; strings.Contains(ref, "@") {
+			annotations[containerdNameAnnotation] = newName + ref[strings.Index(ref, "@"):]
+			d["annotations"], _ = json.Marshal(annotations)
+			continue
+		}
+
+		tag := defaultTag
+
+		// skopeo stores a plain tag as ref name, containerd the full reference
+		if ref := annotations[ociRefNameAnnotation]; ref != "" && !strings.ContainsAny(ref, "/:@") {
+			tag = ref
+		} else if _, t := splitTag(annotations[containerdNameAnnotation]); t != "" {
+			tag = t
+		}
+
+		annotations[containerdNameAnnotation] = newName + ":" + tag
+		annotations[ociRefNameAnnotation] = tag
+
+		d["annotations"], _ = json.Marshal(annotations)
+
+	}
+
+	index["manifests"], _ = json.Marshal(descriptors)
+
+	if raw, err = json.Marshal(index); err != nil {
+		return fmt.Errorf("Error renaming image: Json failed %s", path)
+	}
+
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		return fmt.Errorf("Error renaming image: Index write failed) %s", path)
+	}
+
+	if !i.hasManifest() {
+		return nil
+	}
+
+	entries, err := i.readManifest()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+
+		if len(entry.RepoTags) == 0 {
+			entry.RepoTags = []string{newName + ":" + defaultTag}
+			continue
+		}
+
+		for k, t := range entry.RepoTags {
+			if strings.Contains(t, "@") {
+				entry.RepoTags[k] = newName + t[strings.Index(t, "@"):]
+				continue
+			}
+			_, tag := splitTag(t)
+			if tag == "" {
+				tag = defaultTag
+			}
+			entry.RepoTags[k] = newName + ":" + tag
+		}
+
+	}
+
+	return i.writeManifest(entries)
+
+}
+
+// addOCIReference adds an entry for ref to index.json that points at the same manifest as the first entry
+func (i *Image) addOCIReference(ref string) error {
+
+	if i.isDirLayout() {
+		return fmt.Errorf("Images in dir layout carry no name %s", i.PathToSource)
+	}
+
+	path := i.pathToWorkingCopy + string(filepath.Separator) + ociIndexFile
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read OCI index %s", path)
+	}
+
+	var index map[string]json.RawMessage
+	var descriptors []map[string]json.RawMessage
+
+	if json.Unmarshal(raw, &index) != nil || json.Unmarshal(index["manifests"], &descriptors) != nil || len(descriptors) == 0 {
+		return fmt.Errorf("Unexpected data schema for OCI index %s", path)
+	}
+
+	d := make(map[string]json.RawMessage)
+
+	for k, v := range descriptors[0] {
+		d[k] = v
+	}
+
+	d["annotations"], _ = json.Marshal(map[string]string{containerdNameAnnotation: ref})
+	index["manifests"], _ = json.Marshal(append(descriptors, d))
+
+	if raw, err = json.Marshal(index); err != nil {
+		return fmt.Errorf("Error tagging image: Json failed %s", path)
+	}
+
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		return fmt.Errorf("Error tagging image: Index write failed) %s", path)
+	}
+
+	return nil
+
+}
+
+// dropOCIDigestReferences removes the entries of index.json named name@<digest> for a digest other than id
+func (i *Image) dropOCIDigestReferences(id string) error {
+
+	path := i.pathToWorkingCopy + string(filepath.Separator) + ociIndexFile
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read OCI index %s", path)
+	}
+
+	var index map[string]json.RawMessage
+	var descriptors []map[string]json.RawMessage
+
+	if json.Unmarshal(raw, &index) != nil || json.Unmarshal(index["manifests"], &descriptors) != nil {
+		return fmt.Errorf("Unexpected data schema for OCI index %s", path)
+	}
+
+	kept := make([]map[string]json.RawMessage, 0, len(descriptors))
+
+	for _, d := range descriptors {
+
+		annotations := make(map[string]string)
+		json.Unmarshal(d["annotations"], &annotations)
+
+		ref := annotations[containerdNameAnnotation]
+		if k := strings.Index(ref, "@"); k < 0 || ref[k+1:] == id {
+			kept = append(kept, d)
+		}
+
+	}
+
+	if len(kept) == len(descriptors) {
+		return nil
+	}
+
+	index["manifests"], _ = json.Marshal(kept)
+
+	if raw, err = json.Marshal(index); err != nil {
+		return fmt.Errorf("Error editing image: Json failed %s", path)
+	}
+
+	if err := ioutil.WriteFile(path, raw, 0644); err != nil {
+		return fmt.Errorf("Error editing image: Index write failed) %s", path)
+	}
+
+	return nil
+
+}
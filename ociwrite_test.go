@@ -0,0 +1,334 @@
+package dockerscope
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkOCIDigests fails t unless every blob of the OCI layout of img is stored under its digest and every
+// descriptor reachable from index.json and every path of manifest.json points to an existing blob of the
+// recorded digest and size
+func checkOCIDigests(t *testing.T, img *Image) {
+
+	t.Helper()
+
+	infos, err := ioutil.ReadDir(filepath.Join(img.pathToWorkingCopy, "blobs", "sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, info := range infos {
+
+		data, err := ioutil.ReadFile(filepath.Join(img.pathToWorkingCopy, "blobs", "sha256", info.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d := digestOf(data); d != "sha256:"+info.Name() {
+			t.Fatalf("blob %s has digest %s", info.Name(), d)
+		}
+	}
+
+	var check func(d ociDescriptor)
+	check = func(d ociDescriptor) {
+
+		data, err := img.readBlob(d.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if int64(len(data)) != d.Size {
+			t.Fatalf("descriptor of %s records size %d, blob has %d bytes", d.Digest, d.Size, len(data))
+		}
+
+		m := &ociManifest{}
+		if json.Unmarshal(data, m) != nil {
+			return
+		}
+
+		for _, c := range m.Manifests {
+			check(c)
+		}
+
+		for _, l := range m.Layers {
+			check(l)
+		}
+
+		if m.Config.Digest != "" {
+			check(m.Config)
+		}
+
+	}
+
+	index, err := img.ociIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range index.Manifests {
+		check(d)
+	}
+
+	if !img.hasManifest() {
+		return
+	}
+
+	entries, err := img.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range entries {
+		for _, p := range append([]string{e.Config}, e.Layers...) {
+			if _, err := os.Stat(filepath.Join(img.pathToWorkingCopy, p)); err != nil {
+				t.Fatalf("manifest.json references missing %s", p)
+			}
+		}
+	}
+
+}
+
+func TestOCIEditsKeepDigestsValid(t *testing.T) {
+
+	for name, archive := range map[string]ociArchive{
+		"oci layout":           {},
+		"nested index":         {gzip: true, nested: true},
+		"docker save since 25": {docker: true, annotations: map[string]string{"io.containerd.image.name": "app:1"}},
+	} {
+
+		archive.layers = [][]testFile{{{name: "etc/os-release", body: "ID=alpine"}}, {{name: "app/main", body: "main"}}}
+		archive.config = map[string]interface{}{"config": map[string]interface{}{"Labels": map[string]string{"version": "1"}}}
+		path := archive.write(t)
+
+		if err := openImage(t, path).SetLabel("team", "platform"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		img := openImage(t, path)
+
+		c, err := img.Config()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		if c.Labels["team"] != "platform" || c.Labels["version"] != "1" {
+			t.Fatalf("%s: labels after SetLabel = %v, want team and version", name, c.Labels)
+		}
+
+		checkOCIDigests(t, img)
+
+		if err := img.SetName("registry.example.com/team/app"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		img = openImage(t, path)
+
+		if c, err = img.Config(); err != nil || c.Labels["team"] != "platform" {
+			t.Fatalf("%s: labels after SetName = %v (%v), want team kept", name, c.Labels, err)
+		}
+
+		checkOCIDigests(t, img)
+
+		index, err := img.ociIndex()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		want := "registry.example.com/team/app:latest"
+		if archive.docker {
+			want = "registry.example.com/team/app:1"
+		}
+
+		if n := index.Manifests[0].Annotations[containerdNameAnnotation]; n != want {
+			t.Fatalf("%s: image name after SetName = %q, want %q", name, n, want)
+		}
+	}
+
+}
+
+func TestOCIEditDirLayout(t *testing.T) {
+
+	path := ociArchive{layers: [][]testFile{{{name: "app/main", body: "main"}}}, dir: true}.write(t)
+
+	if err := openImage(t, path).SetLabel("team", "platform"); err != nil {
+		t.Fatal(err)
+	}
+
+	img := openImage(t, path)
+
+	c, err := img.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Labels["team"] != "platform" {
+		t.Fatalf("labels after SetLabel = %v, want team", c.Labels)
+	}
+
+	m, err := img.ociManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := img.readBlob(m.Config.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if digestOf(data) != m.Config.Digest || int64(len(data)) != m.Config.Size {
+		t.Fatalf("config descriptor %s of size %d does not match the config blob", m.Config.Digest, m.Config.Size)
+	}
+
+}
+
+func TestOCIEditImageSavedUnderTwoTags(t *testing.T) {
+
+	// docker save app:1 app:2 lists the manifest once per tag
+	var archives []string
+	for _, ref := range []string{"app:1", "app:2"} {
+		archives = append(archives, ociArchive{
+			layers:      [][]testFile{{{name: "app/main", body: "main"}}},
+			docker:      true,
+			annotations: map[string]string{"io.containerd.image.name": ref},
+		}.write(t))
+	}
+	path := mergeArchives(t, archives...)
+
+	if err := openImage(t, path).SetLabel("team", "platform"); err != nil {
+		t.Fatal(err)
+	}
+
+	img := openImage(t, path)
+
+	if c, err := img.Config(); err != nil || c.Labels["team"] != "platform" {
+		t.Fatalf("labels after SetLabel = %v (%v), want team", c.Labels, err)
+	}
+
+	checkOCIDigests(t, img)
+
+	if index := mustOCIIndex(t, img); len(index.Manifests) != 2 || index.Manifests[0].Digest != index.Manifests[1].Digest {
+		t.Fatalf("index after SetLabel = %+v, want both tags on the edited manifest", index.Manifests)
+	}
+
+	if err := img.SelfTest(); err != nil {
+		t.Fatalf("SelfTest() after SetLabel = %v", err)
+	}
+
+}
+
+func TestOCIEditAllPlatforms(t *testing.T) {
+
+	layer := layerTar([]testFile{{name: "app/main", body: "arm64"}})
+	config := mustJSON(map[string]interface{}{
+		"architecture": "arm64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Labels": map[string]string{"version": "1"}},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{digestOf(layer)}},
+	})
+	manifest := mustJSON(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        descriptor("application/vnd.oci.image.config.v1+json", config),
+		"layers":        []interface{}{descriptor("application/vnd.oci.image.layer.v1.tar", layer)},
+	})
+	arm64 := descriptor("application/vnd.oci.image.manifest.v1+json", manifest)
+	arm64["platform"] = map[string]string{"architecture": "arm64", "os": "linux"}
+
+	statement := []byte(`{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://spdx.dev/Document"}`)
+	attestationConfig := []byte(`{"architecture":"unknown","os":"unknown","rootfs":{"type":"layers","diff_ids":[]}}`)
+	attestationManifest := mustJSON(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        descriptor("application/vnd.oci.image.config.v1+json", attestationConfig),
+		"layers":        []interface{}{descriptor("application/vnd.in-toto+json", statement)},
+	})
+	attestation := descriptor("application/vnd.oci.image.manifest.v1+json", attestationManifest)
+	attestation["annotations"] = map[string]string{
+		"vnd.docker.reference.type":   "attestation-manifest",
+		"vnd.docker.reference.digest": digestOf(manifest),
+	}
+
+	path := ociArchive{
+		layers:    [][]testFile{{{name: "app/main", body: "amd64"}}},
+		config:    map[string]interface{}{"config": map[string]interface{}{"Labels": map[string]string{"version": "1"}}},
+		nested:    true,
+		manifests: []map[string]interface{}{arm64, attestation},
+		blobs:     [][]byte{layer, config, manifest, statement, attestationConfig, attestationManifest},
+	}.write(t)
+
+	if err := openImage(t, path).SetLabel("team", "platform"); err != nil {
+		t.Fatal(err)
+	}
+
+	img := openImage(t, path)
+
+	platforms, err := img.Platforms()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkOCIDigests(t, img)
+
+	if len(platforms) != 2 {
+		t.Fatalf("Platforms() after SetLabel = %+v, want arm64 and amd64", platforms)
+	}
+
+	for _, p := range platforms {
+
+		m, err := img.readManifestBlob(p.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := img.readBlob(m.Config.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var c struct{ Config ContainerConfig }
+		if err := json.Unmarshal(data, &c); err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Config.Labels["team"] != "platform" || c.Config.Labels["version"] != "1" {
+			t.Fatalf("labels of %s after SetLabel = %v, want team and version", p.Architecture, c.Config.Labels)
+		}
+	}
+
+	for _, replaced := range [][]byte{manifest, config} {
+		if _, err := img.readBlob(digestOf(replaced)); err == nil {
+			t.Fatalf("blob %s replaced by SetLabel left behind", digestOf(replaced))
+		}
+	}
+
+	if _, err := img.readBlob(digestOf(layer)); err != nil {
+		t.Fatalf("layer blob removed by SetLabel: %v", err)
+	}
+
+	index, err := img.readManifestBlob(mustOCIIndex(t, img).Manifests[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ref := index.Manifests[1].Annotations["vnd.docker.reference.digest"]; ref != platforms[0].Digest {
+		t.Fatalf("attestation refers to %s after SetLabel, want the edited arm64 manifest %s", ref, platforms[0].Digest)
+	}
+
+}
+
+// mustOCIIndex returns the top level index of img
+func mustOCIIndex(t *testing.T, img *Image) *ociManifest {
+
+	t.Helper()
+
+	index, err := img.ociIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return index
+
+}
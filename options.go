@@ -0,0 +1,125 @@
+package dockerscope
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// Options tune how an image is inspected. The zero value is used by NewImage.
+type Options struct {
+	// WorldWritableAllowed lists paths such as /tmp that are expected to be world writable. They and the paths
+	// below them are not reported by WorldWritableFiles.
+	WorldWritableAllowed []string
+
+	// CacheMountPatterns are the path patterns CacheMountArtifacts looks for, DefaultCacheMountPatterns if empty
+	CacheMountPatterns []string
+
+	// SecretEnvPatterns are the environment variable names SuspiciousEnv reports, DefaultSecretEnvPatterns if empty
+	SecretEnvPatterns []string
+
+	// OnSkip, if set, is called for every entry the extraction of the image skips, such as entries escaping the
+	// working copy or of unsupported type, with the reason it was skipped
+	OnSkip func(entry string, reason string)
+
+	// IOMaxRetries is how often the extraction retries a file write that failed with a transient error such as
+	// EAGAIN or ESTALE, waiting longer before every retry. Zero fails on the first error.
+	IOMaxRetries int
+
+	// Now returns the current time, time.Now if nil. Operations that stamp the image with the current time use it.
+	Now func() time.Time
+
+	// Concurrency is how many layers ExtractLayers unpacks at the same time, one if not set
+	Concurrency int
+
+	// DirMode is the mode of the working copy the image is extracted into. It defaults to 0700, so that other
+	// local users cannot read the content of the image.
+	DirMode os.FileMode
+
+	// CopyBufferSize is the size in bytes of the buffer file contents are copied through during extraction, 32 KiB
+	// if not set
+	CopyBufferSize int
+
+	// ConflictPolicy decides what happens when an entry of a layer collides with what the layers below provide
+	// in a way whiteouts do not cover, such as a file where a lower layer has a directory
+	ConflictPolicy ConflictPolicy
+
+	// LayerWarningThreshold is the layer count from which LayerLimitWarning warns, 100 if not set
+	LayerWarningThreshold int
+
+	// OverlayWhiteouts makes ExtractForOverlay convert whiteouts into the form overlayfs expects: character
+	// devices 0:0 for removed paths and the trusted.overlay.opaque attribute for opaque directories. Both need
+	// root privileges and Linux.
+	OverlayWhiteouts bool
+
+	// ProgressFunc, if set, is called by Inspect every time it completes one of its phases, with the phase
+	// completed: InspectLayers, InspectConfig, InspectSizes and InspectDigests, in that order
+	ProgressFunc func(phase string)
+
+	// BudgetTransferSize makes CheckSizeBudget check the transfer size of the image, the stored size of its layer
+	// blobs as a push or pull moves them, instead of its total uncompressed size
+	BudgetTransferSize bool
+
+	// IncludePaths are glob patterns such as /app or /etc/*.conf selecting what ExtractRootFS writes, everything
+	// if empty. A pattern selects the paths it matches and everything below them.
+	IncludePaths []string
+
+	// ExcludePaths are glob patterns like IncludePaths for what ExtractRootFS leaves out. Excluding wins over
+	// including, so /app included and /app/tmp excluded writes /app without /app/tmp.
+	ExcludePaths []string
+}
+
+// ConflictPolicy decides how the merged filesystem resolves an entry that collides with the layers below it
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite lets the upper entry win, as docker does: a file replacing a directory hides everything
+	// below the directory, a directory replacing a file hides the file
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictSkip keeps what the lower layers provide and leaves the colliding entry out
+	ConflictSkip
+	// ConflictError fails with ErrConflict
+	ConflictError
+)
+
+// ErrConflict is returned under ConflictError when an entry collides with the layers below it
+var ErrConflict = errors.New("Conflicting layer entry")
+
+// copyBufferSize returns the size of the buffer extraction copies file contents through
+func (o Options) copyBufferSize() int {
+
+	if o.CopyBufferSize > 0 {
+		return o.CopyBufferSize
+	}
+
+	return 32 * 1024
+
+}
+
+// defaultDirMode is the mode of the working copy if Options.DirMode is not set
+const defaultDirMode os.FileMode = 0700
+
+// DefaultCacheMountPatterns are the paths build tools commonly use as cache mount targets
+var DefaultCacheMountPatterns = []string{
+	"/root/.cache",
+	"/root/.npm",
+	"/root/.m2/repository",
+	"/root/.gradle/caches",
+	"/root/.cargo/registry",
+	"/go/pkg/mod",
+	"/usr/local/share/.cache/yarn",
+	"/var/cache/apt",
+	"/var/lib/apt/lists",
+	"/var/cache/apk",
+}
+
+// DefaultSecretEnvPatterns are environment variable names that commonly hold credentials
+var DefaultSecretEnvPatterns = []string{
+	"*_TOKEN",
+	"*_SECRET",
+	"*_PASSWORD",
+	"*_PASSWD",
+	"*_KEY",
+	"*_ACCESS_KEY*",
+	"*_CREDENTIALS",
+}
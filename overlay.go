@@ -0,0 +1,89 @@
+package dockerscope
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractForOverlay unpacks every layer of the image into its own directory dir/<layer id> and returns the
+// directories topmost layer first, the order the lowerdir option of an overlayfs mount lists them in:
+//
+//	mount -t overlay overlay -o lowerdir=<dirs joined by :> /mnt
+//
+// Whiteouts are kept as the .wh. files the layers contain unless Options.OverlayWhiteouts is set, which converts
+// them into the whiteouts overlayfs understands.
+func (i *Image) ExtractForOverlay(dir string) ([]string, error) {
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, len(layers))
+
+	for k, l := range layers {
+
+		target := filepath.Join(dir, l.Id)
+
+		if err := i.extractLayer(l, target); err != nil {
+			return nil, err
+		}
+
+		if i.options.OverlayWhiteouts {
+			if err := convertWhiteouts(target); err != nil {
+				return nil, fmt.Errorf("Error converting whiteouts of layer %s: %s", l.Id, err)
+			}
+		}
+
+		dirs[len(layers)-1-k] = target
+
+	}
+
+	return dirs, nil
+
+}
+
+// convertWhiteouts replaces the .wh. files below dir by overlayfs whiteouts
+func convertWhiteouts(dir string) error {
+
+	whiteouts := make([]string, 0)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), whiteoutPrefix) {
+			whiteouts = append(whiteouts, path)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, path := range whiteouts {
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+
+		parent, base := filepath.Split(path)
+
+		if base == opaqueWhiteout {
+			err = markOpaque(parent)
+		} else {
+			err = makeWhiteout(filepath.Join(parent, strings.TrimPrefix(base, whiteoutPrefix)))
+		}
+
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+
+}
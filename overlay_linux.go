@@ -0,0 +1,15 @@
+//go:build linux
+
+package dockerscope
+
+import "syscall"
+
+// makeWhiteout creates the character device 0:0 overlayfs hides path of the lower layers with
+func makeWhiteout(path string) error {
+	return syscall.Mknod(path, syscall.S_IFCHR|0000, 0)
+}
+
+// markOpaque sets the attribute that makes overlayfs hide the content the lower layers have below dir
+func markOpaque(dir string) error {
+	return syscall.Setxattr(dir, "trusted.overlay.opaque", []byte("y"), 0)
+}
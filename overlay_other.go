@@ -0,0 +1,18 @@
+//go:build !linux
+
+package dockerscope
+
+import "errors"
+
+// errOverlayUnsupported is returned when converting whiteouts outside of Linux, which has no overlayfs
+var errOverlayUnsupported = errors.New("Overlay whiteouts are only supported on Linux")
+
+// makeWhiteout fails, overlayfs whiteouts need Linux
+func makeWhiteout(path string) error {
+	return errOverlayUnsupported
+}
+
+// markOpaque fails, overlayfs whiteouts need Linux
+func markOpaque(dir string) error {
+	return errOverlayUnsupported
+}
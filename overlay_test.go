@@ -0,0 +1,65 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestExtractForOverlay(t *testing.T) {
+
+	path := saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{{name: "etc/", typeflag: tar.TypeDir}, {name: "etc/motd", body: "hi"}, {name: "var/", typeflag: tar.TypeDir}, {name: "var/cache/", typeflag: tar.TypeDir}}},
+		{id: "runtime", files: []testFile{{name: "usr/", typeflag: tar.TypeDir}, {name: "usr/bin/", typeflag: tar.TypeDir}, {name: "usr/bin/python3", body: "python"}}},
+		{id: "app", files: []testFile{{name: "etc/", typeflag: tar.TypeDir}, {name: "etc/.wh.motd"}, {name: "var/", typeflag: tar.TypeDir}, {name: "var/cache/", typeflag: tar.TypeDir}, {name: "var/cache/.wh..wh..opq"}}},
+	}}.write(t)
+
+	dir := t.TempDir()
+
+	dirs, err := openImage(t, path).ExtractForOverlay(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{filepath.Join(dir, "app"), filepath.Join(dir, "runtime"), filepath.Join(dir, "base")}
+	if !reflect.DeepEqual(dirs, want) {
+		t.Fatalf("ExtractForOverlay() = %q, want the layer directories topmost first %q", dirs, want)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "runtime", "usr", "bin", "python3")); err != nil {
+		t.Fatalf("layer runtime not extracted into its directory: %v", err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dir, "app", "etc", ".wh.motd")); err != nil {
+		t.Fatalf("whiteout not kept without OverlayWhiteouts: %v", err)
+	}
+
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("converting whiteouts needs root on Linux")
+	}
+
+	dir = t.TempDir()
+
+	if _, err := openImageWithOptions(t, path, Options{OverlayWhiteouts: true}).ExtractForOverlay(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Lstat(filepath.Join(dir, "app", "etc", "motd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode()&os.ModeCharDevice == 0 {
+		t.Fatalf("whiteout of /etc/motd converted to mode %v, want a character device", info.Mode())
+	}
+
+	for _, p := range []string{filepath.Join("etc", ".wh.motd"), filepath.Join("var", "cache", ".wh..wh..opq")} {
+		if _, err := os.Lstat(filepath.Join(dir, "app", p)); err == nil {
+			t.Fatalf("%s kept with OverlayWhiteouts", p)
+		}
+	}
+
+}
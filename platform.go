@@ -0,0 +1,139 @@
+package dockerscope
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// PlatformEntry is an image of an archive built for a single platform
+type PlatformEntry struct {
+	OS           string
+	Architecture string
+	Variant      string
+	Digest       string
+}
+
+// Platforms returns every platform the archive holds an image for. For OCI images Digest is the digest of the
+// platform's manifest, other images hold a single platform whose Digest is the image id.
+func (i *Image) Platforms() ([]PlatformEntry, error) {
+
+	if err := i.loadLayers(); err != nil {
+		return nil, err
+	}
+
+	if !i.isOCI() || i.isDirLayout() {
+
+		c := &ociPlatform{}
+
+		imageConfig, err := i.platformConfig()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(imageConfig, c); err != nil {
+			return nil, fmt.Errorf("Unexpected data schema for image config of %s", i.PathToSource)
+		}
+
+		digest, err := i.imageId()
+		if err != nil {
+			return nil, err
+		}
+
+		return []PlatformEntry{{OS: c.OS, Architecture: c.Architecture, Variant: c.Variant, Digest: digest}}, nil
+
+	}
+
+	index, err := i.ociIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	platforms := make([]PlatformEntry, 0)
+
+	if err := i.collectPlatforms(index, &platforms, 0); err != nil {
+		return nil, err
+	}
+
+	return platforms, nil
+
+}
+
+// platformConfig returns the raw image config that records the platform of a single platform image
+func (i *Image) platformConfig() ([]byte, error) {
+
+	if i.hasManifest() {
+
+		entries, err := i.readManifest()
+		if err != nil || len(entries) == 0 {
+			return nil, fmt.Errorf("Failed to read manifest of image %s", i.pathToWorkingCopy)
+		}
+
+		config, err := i.readManifestConfig(entries[0])
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(config)
+
+	}
+
+	imageConfig, err := i.imageConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(imageConfig)
+
+}
+
+// collectPlatforms appends an entry for every image manifest listed by the index m, descending into nested
+// indexes. Attestation manifests are skipped, manifests without a platform in their descriptor take it from
+// their config.
+func (i *Image) collectPlatforms(m *ociManifest, platforms *[]PlatformEntry, depth int) error {
+
+	if depth > maxLinkDepth {
+		return fmt.Errorf("OCI index nesting too deep in image %s", i.PathToSource)
+	}
+
+	for _, d := range m.Manifests {
+
+		if d.isReference() {
+			continue
+		}
+
+		child, err := i.readManifestBlob(d.Digest)
+		if err != nil {
+			return err
+		}
+
+		if child.isIndex() {
+			if err := i.collectPlatforms(child, platforms, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		p := d.Platform
+
+		if p == nil {
+
+			data, err := i.readBlob(child.Config.Digest)
+			if err != nil {
+				return err
+			}
+
+			p = &ociPlatform{}
+
+			if err := json.Unmarshal(data, p); err != nil {
+				return fmt.Errorf("Unexpected data schema for image config %s", child.Config.Digest)
+			}
+
+		}
+
+		*platforms = append(*platforms, PlatformEntry{OS: p.OS, Architecture: p.Architecture, Variant: p.Variant, Digest: d.Digest})
+
+	}
+
+	return nil
+
+}
@@ -0,0 +1,105 @@
+package dockerscope
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlatforms(t *testing.T) {
+
+	config := mustJSON(map[string]interface{}{
+		"architecture": "arm64",
+		"variant":      "v8",
+		"os":           "linux",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{}},
+	})
+	manifest := mustJSON(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        descriptor("application/vnd.oci.image.config.v1+json", config),
+		"layers":        []interface{}{},
+	})
+
+	img := openImage(t, ociArchive{
+		layers:    [][]testFile{{{name: "a"}}},
+		nested:    true,
+		manifests: []map[string]interface{}{descriptor("application/vnd.oci.image.manifest.v1+json", manifest)},
+		blobs:     [][]byte{config, manifest},
+	}.write(t))
+
+	platforms, err := img.Platforms()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(platforms) != 2 {
+		t.Fatalf("Platforms() = %+v, want arm64 and amd64", platforms)
+	}
+
+	want := PlatformEntry{OS: "linux", Architecture: "arm64", Variant: "v8", Digest: digestOf(manifest)}
+	if platforms[0] != want {
+		t.Fatalf("Platforms()[0] = %+v, want %+v taken from the config", platforms[0], want)
+	}
+
+	if p := platforms[1]; p.OS != "linux" || p.Architecture != "amd64" || p.Variant != "" || p.Digest == "" {
+		t.Fatalf("Platforms()[1] = %+v, want linux/amd64", p)
+	}
+
+	img = openImage(t, saveArchive{layers: []testLayer{{id: "a"}}, manifest: true}.write(t))
+
+	platforms, err = img.Platforms()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := img.imageId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []PlatformEntry{{OS: "linux", Architecture: "amd64", Digest: id}}; !reflect.DeepEqual(platforms, want) {
+		t.Fatalf("Platforms() = %+v, want %+v", platforms, want)
+	}
+
+}
+
+func TestBuildxAttestationManifests(t *testing.T) {
+
+	statement := []byte(`{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://spdx.dev/Document"}`)
+	config := []byte(`{"architecture":"unknown","os":"unknown","rootfs":{"type":"layers","diff_ids":[]}}`)
+	manifest := mustJSON(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        descriptor("application/vnd.oci.image.config.v1+json", config),
+		"layers":        []interface{}{descriptor("application/vnd.in-toto+json", statement)},
+	})
+
+	// buildx lists the attestation manifest of an image next to it in the index, here ahead of it
+	attestation := descriptor("application/vnd.oci.image.manifest.v1+json", manifest)
+	attestation["platform"] = map[string]string{"architecture": "unknown", "os": "unknown"}
+	attestation["annotations"] = map[string]string{
+		"vnd.docker.reference.type":   "attestation-manifest",
+		"vnd.docker.reference.digest": digestOf([]byte("image manifest")),
+	}
+
+	img := openImage(t, ociArchive{
+		layers:    [][]testFile{{{name: "app", body: "app"}}},
+		nested:    true,
+		manifests: []map[string]interface{}{attestation},
+		blobs:     [][]byte{statement, config, manifest},
+	}.write(t))
+
+	platforms, err := img.Platforms()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(platforms) != 1 || platforms[0].OS != "linux" || platforms[0].Architecture != "amd64" {
+		t.Fatalf("Platforms() = %+v, want only linux/amd64", platforms)
+	}
+
+	if data, err := img.ReadFile("/app"); err != nil || string(data) != "app" {
+		t.Fatalf("ReadFile(/app) = %q (%v), want the file of the image rather than the attestation", data, err)
+	}
+
+}
@@ -0,0 +1,58 @@
+package dockerscope
+
+import (
+	"errors"
+	"io"
+	"syscall"
+	"time"
+)
+
+// retryBackoff is the wait before the first retry of a failed write, it doubles with every further retry
+const retryBackoff = 10 * time.Millisecond
+
+// transient reports whether err is a filesystem error that may go away when the operation is repeated, as
+// network mounted filesystems report them
+func transient(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.EINTR)
+}
+
+// retry calls fn until it succeeds, fails with an error that is not transient or has been retried maxRetries
+// times, waiting longer before every retry
+func retry(maxRetries int, fn func() error) error {
+
+	wait := retryBackoff
+
+	for attempt := 0; ; attempt++ {
+
+		err := fn()
+		if err == nil || attempt >= maxRetries || !transient(err) {
+			return err
+		}
+
+		time.Sleep(wait)
+		wait *= 2
+
+	}
+
+}
+
+// retryWriter writes to w, retrying writes that fail with a transient error
+type retryWriter struct {
+	w          io.Writer
+	maxRetries int
+}
+
+// Write writes p to the underlying writer, continuing after the bytes already written when a write is retried
+func (r *retryWriter) Write(p []byte) (int, error) {
+
+	written := 0
+
+	err := retry(r.maxRetries, func() error {
+		n, err := r.w.Write(p[written:])
+		written += n
+		return err
+	})
+
+	return written, err
+
+}
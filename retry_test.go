@@ -0,0 +1,60 @@
+package dockerscope
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+	"testing"
+)
+
+// flakyWriter fails its first fails writes with err after writing a single byte
+type flakyWriter struct {
+	fails int
+	err   error
+	buf   bytes.Buffer
+}
+
+func (f *flakyWriter) Write(p []byte) (int, error) {
+
+	if f.fails > 0 {
+		f.fails--
+		f.buf.Write(p[:1])
+		return 1, f.err
+	}
+
+	return f.buf.Write(p)
+
+}
+
+func TestRetryWriter(t *testing.T) {
+
+	for _, err := range []error{syscall.EAGAIN, syscall.ESTALE} {
+
+		f := &flakyWriter{fails: 2, err: err}
+
+		n, werr := (&retryWriter{w: f, maxRetries: 2}).Write([]byte("layer"))
+		if werr != nil || n != 5 || f.buf.String() != "layer" {
+			t.Fatalf("Write() after 2 %v failures = %d, %v writing %q, want all of layer", err, n, werr, f.buf.String())
+		}
+	}
+
+	f := &flakyWriter{fails: 3, err: syscall.EAGAIN}
+
+	if n, err := (&retryWriter{w: f, maxRetries: 2}).Write([]byte("layer")); err != syscall.EAGAIN || n != 3 {
+		t.Fatalf("Write() after 3 failures with 2 retries = %d, %v, want 3 bytes and EAGAIN", n, err)
+	}
+
+	permanent := errors.New("disk full")
+	f = &flakyWriter{fails: 1, err: permanent}
+
+	if _, err := (&retryWriter{w: f, maxRetries: 5}).Write([]byte("layer")); err != permanent || f.fails != 0 || f.buf.Len() != 1 {
+		t.Fatalf("Write() retried the permanent error %v", err)
+	}
+
+	f = &flakyWriter{fails: 1, err: syscall.EAGAIN}
+
+	if _, err := (&retryWriter{w: f}).Write([]byte("layer")); err != syscall.EAGAIN {
+		t.Fatalf("Write() without retries = %v, want EAGAIN", err)
+	}
+
+}
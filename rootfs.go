@@ -0,0 +1,255 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ExtractRootFS writes the merged filesystem of the image to destDir, the way a container started from the
+// image sees it. Paths removed by a whiteout, and everything a lower layer put below a directory an upper layer
+// marked opaque, are left out. Entries that would end up outside destDir are skipped. Options.IncludePaths and
+// Options.ExcludePaths narrow down what is written.
+func (i *Image) ExtractRootFS(destDir string) error {
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("Error extracting root filesystem: Mkdir failed) %s", destDir)
+	}
+
+	r, w := io.Pipe()
+
+	go func() {
+
+		fs, err := i.mergedFS()
+		if err != nil {
+			w.CloseWithError(err)
+			return
+		}
+
+		selected := selectPaths(fs, i.options.IncludePaths, i.options.ExcludePaths)
+		w.CloseWithError(i.writeRootFS(fs, selected, "/", w))
+
+	}()
+
+	_, err := untarReader(r, destDir, i.options)
+	r.CloseWithError(err)
+
+	if err != nil {
+		return fmt.Errorf("Error extracting root filesystem: %s", err)
+	}
+
+	return nil
+
+}
+
+// RootFSTarSubtree writes the paths of the merged filesystem at or below prefix, such as /app, to w as a tar
+// stream. Paths removed by a whiteout are left out. Hard links to files outside the subtree are written as
+// regular files.
+func (i *Image) RootFSTarSubtree(prefix string, w io.Writer) error {
+
+	fs, err := i.mergedFS()
+	if err != nil {
+		return err
+	}
+
+	root := cleanPath(prefix)
+	selected := make(map[string]bool)
+
+	for p := range fs {
+		if below(p, root) {
+			selected[p] = true
+		}
+	}
+
+	return i.writeRootFS(fs, selected, root, w)
+
+}
+
+// writeRootFS writes the selected paths of the merged filesystem fs to w as a tar stream. root names what is
+// written in errors.
+func (i *Image) writeRootFS(fs mergedFS, selected map[string]bool, root string, w io.Writer) error {
+
+	paths := make([]string, 0, len(selected))
+
+	for p := range selected {
+		paths = append(paths, p)
+	}
+
+	sort.Strings(paths)
+
+	tarball := tar.NewWriter(w)
+
+	// directories and links go first so that the files below them have somewhere to go
+	for _, p := range paths {
+
+		e := fs[p]
+
+		switch e.header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			continue
+		case tar.TypeLink:
+			if selected[cleanPath(e.header.Linkname)] {
+				continue
+			}
+		}
+
+		if err := i.writeSubtreeEntry(tarball, fs, p); err != nil {
+			return err
+		}
+
+	}
+
+	// regular files are copied layer by layer, so every layer is read at most once
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return err
+	}
+
+	for _, l := range layers {
+
+		layerId := l.Id
+
+		err := i.walkLayer(layerId, func(header *tar.Header, r io.Reader) error {
+
+			p := cleanPath(header.Name)
+
+			if !selected[p] || fs[p].layer != layerId || (header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA) {
+				return nil
+			}
+
+			if err := tarball.WriteHeader(subtreeHeader(header, p)); err != nil {
+				return err
+			}
+
+			_, err := io.Copy(tarball, r)
+			return err
+
+		})
+
+		if err != nil {
+			return fmt.Errorf("Error writing subtree %s: %s", root, err)
+		}
+
+	}
+
+	// hard links within the subtree need their target to be written first
+	for _, p := range paths {
+
+		e := fs[p]
+
+		if e.header.Typeflag != tar.TypeLink || !selected[cleanPath(e.header.Linkname)] {
+			continue
+		}
+
+		header := subtreeHeader(e.header, p)
+		header.Linkname = strings.TrimPrefix(cleanPath(e.header.Linkname), "/")
+
+		if err := tarball.WriteHeader(header); err != nil {
+			return fmt.Errorf("Error writing subtree %s: %s", root, err)
+		}
+
+	}
+
+	return tarball.Close()
+
+}
+
+// writeSubtreeEntry writes the merged path p to tarball. A hard link is replaced by the file it points to.
+func (i *Image) writeSubtreeEntry(tarball *tar.Writer, fs mergedFS, p string) error {
+
+	e := fs[p]
+
+	if e.header.Typeflag != tar.TypeLink {
+		return tarball.WriteHeader(subtreeHeader(e.header, p))
+	}
+
+	target := cleanPath(e.header.Linkname)
+
+	t, ok := fs[target]
+	if !ok || (t.header.Typeflag != tar.TypeReg && t.header.Typeflag != tar.TypeRegA) {
+		return fmt.Errorf("Hard link %s points to %s, which is not a regular file of the image", p, target)
+	}
+
+	if err := tarball.WriteHeader(subtreeHeader(t.header, p)); err != nil {
+		return err
+	}
+
+	r, err := i.OpenLayerFile(t.layer, target)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(tarball, r)
+
+	return err
+
+}
+
+// subtreeHeader returns a copy of header named after the merged path p
+func subtreeHeader(header *tar.Header, p string) *tar.Header {
+
+	h := *header
+	h.Name = strings.TrimPrefix(p, "/")
+
+	if h.Typeflag == tar.TypeDir {
+		h.Name += "/"
+	}
+
+	return &h
+
+}
+
+// selectPaths returns the paths of fs that match a pattern of include, all of them if include is empty, and no
+// pattern of exclude, together with the directories above them. A pattern matches a path if it matches the path
+// or a directory above it, so /app selects everything below /app.
+func selectPaths(fs mergedFS, include, exclude []string) map[string]bool {
+
+	selected := make(map[string]bool)
+
+	for p := range fs {
+
+		if (len(include) > 0 && !matchesPath(include, p)) || matchesPath(exclude, p) {
+			continue
+		}
+
+		selected[p] = true
+
+		// the directories above a selected path have to exist for it to be extracted
+		for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+			if _, ok := fs[dir]; ok {
+				selected[dir] = true
+			}
+		}
+
+	}
+
+	return selected
+
+}
+
+// matchesPath reports whether one of the glob patterns matches p or a directory above it
+func matchesPath(patterns []string, p string) bool {
+
+	for _, pattern := range patterns {
+
+		pattern = cleanPath(pattern)
+
+		for q := p; ; q = path.Dir(q) {
+			if ok, _ := path.Match(pattern, q); ok {
+				return true
+			}
+			if q == "/" {
+				break
+			}
+		}
+
+	}
+
+	return false
+
+}
@@ -0,0 +1,228 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// tarContents returns the entries of the tarball data, the content of regular files and the target of links
+// keyed by name
+func tarContents(t *testing.T, data []byte) map[string]string {
+
+	t.Helper()
+
+	contents := make(map[string]string)
+	tr := tar.NewReader(bytes.NewReader(data))
+
+	for {
+
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contents[h.Name] = string(body)
+		if h.Linkname != "" {
+			contents[h.Name] = "-> " + h.Linkname
+		}
+	}
+
+	return contents
+
+}
+
+func TestRootFSTarSubtree(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "app/", typeflag: tar.TypeDir},
+			{name: "app/main", body: "v1"},
+			{name: "app/debug.log", body: "log"},
+			{name: "application", body: "not below /app"},
+			{name: "etc/passwd", body: "root"},
+		}},
+		{id: "app", files: []testFile{
+			{name: "app/.wh.debug.log"},
+			{name: "app/main", body: "v2"},
+			{name: "app/passwd", typeflag: tar.TypeLink, linkname: "etc/passwd"},
+			{name: "app/current", typeflag: tar.TypeSymlink, linkname: "main"},
+		}},
+	}}.write(t))
+
+	var buf bytes.Buffer
+	if err := img.RootFSTarSubtree("/app", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hard link target lies outside the subtree, so it is written as the file it links to
+	want := map[string]string{"app/": "", "app/main": "v2", "app/passwd": "root", "app/current": "-> main"}
+	if got := tarContents(t, buf.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("RootFSTarSubtree(/app) wrote %q, want %q", got, want)
+	}
+
+}
+
+func TestOpaqueWhiteouts(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/conf.d/", typeflag: tar.TypeDir},
+			{name: "etc/conf.d/old.conf", body: "old"},
+			{name: "etc/conf.d/nested/", typeflag: tar.TypeDir},
+			{name: "etc/conf.d/nested/deep.conf", body: "deep"},
+			{name: "etc/hosts", body: "hosts"},
+		}},
+		{id: "config", files: []testFile{
+			{name: "etc/conf.d/", typeflag: tar.TypeDir},
+			{name: "etc/conf.d/new.conf", body: "new"},
+			{name: "etc/conf.d/.wh..wh..opq"},
+		}},
+	}}.write(t))
+
+	var paths []string
+	err := img.WalkFS(func(info FileInfo) error {
+		paths = append(paths, info.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+
+	if want := []string{"/etc", "/etc/conf.d", "/etc/conf.d/new.conf", "/etc/hosts"}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("WalkFS() visited %q, want %q", paths, want)
+	}
+
+	for _, p := range []string{"/etc/conf.d/old.conf", "/etc/conf.d/nested/deep.conf"} {
+		if _, err := img.ReadFile(p); err == nil {
+			t.Fatalf("ReadFile(%s) read a file hidden by an opaque directory", p)
+		}
+	}
+
+	if data, err := img.ReadFile("/etc/conf.d/new.conf"); err != nil || string(data) != "new" {
+		t.Fatalf("ReadFile(/etc/conf.d/new.conf) = %q (%v), want new", data, err)
+	}
+
+	target := t.TempDir()
+	if err := img.ExtractRootFS(target); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(target, "etc", "conf.d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != "new.conf" {
+		t.Fatalf("ExtractRootFS() wrote %d entries into /etc/conf.d, want only new.conf", len(entries))
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(target, "etc", "hosts")); err != nil || string(data) != "hosts" {
+		t.Fatalf("ExtractRootFS() wrote /etc/hosts as %q (%v), want hosts", data, err)
+	}
+
+}
+
+func TestExtractRootFSImpliedDirectories(t *testing.T) {
+
+	outside := t.TempDir()
+
+	// layers written by tools other than docker often leave out the entries of directories
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{
+			{name: "app/x.txt", body: "x"},
+			{name: "usr/local/bin/tool", body: "tool", mode: 0755},
+			{name: "redirect", typeflag: tar.TypeSymlink, linkname: outside},
+			{name: "redirect/sub/planted", body: "planted"},
+		}},
+		{id: "app", files: []testFile{{name: "app/data/y.txt", body: "y"}}},
+	}}.write(t))
+
+	dest := t.TempDir()
+	if err := img.ExtractRootFS(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	for p, want := range map[string]string{"app/x.txt": "x", "app/data/y.txt": "y", "usr/local/bin/tool": "tool"} {
+		if data, err := ioutil.ReadFile(filepath.Join(dest, p)); err != nil || string(data) != want {
+			t.Fatalf("ExtractRootFS() wrote %s as %q (%v), want %q", p, data, err, want)
+		}
+	}
+
+	if info, err := os.Stat(filepath.Join(dest, "usr", "local")); err != nil || !info.IsDir() || info.Mode().Perm() != 0755 {
+		t.Fatalf("implied directory /usr/local extracted as %v (%v), want a directory of mode 0755", info, err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(outside, "sub")); err == nil {
+		t.Fatal("ExtractRootFS() created the directories of an entry below a symlink leaving the target")
+	}
+
+}
+
+func TestExtractRootFSIncludeExclude(t *testing.T) {
+
+	path := saveArchive{layers: []testLayer{{id: "base", files: []testFile{
+		{name: "app/", typeflag: tar.TypeDir},
+		{name: "app/main", body: "main"},
+		{name: "app/tmp/", typeflag: tar.TypeDir},
+		{name: "app/tmp/junk", body: "junk"},
+		{name: "app/logs/", typeflag: tar.TypeDir},
+		{name: "app/logs/app.log", body: "log"},
+		{name: "app/logs/keep.txt", body: "keep"},
+		{name: "etc/", typeflag: tar.TypeDir},
+		{name: "etc/app.conf", body: "conf"},
+		{name: "etc/passwd", body: "root:x:0:0::/root:/bin/sh"},
+	}}}}.write(t)
+
+	img := openImageWithOptions(t, path, Options{
+		IncludePaths: []string{"/app", "etc/*.conf"},
+		ExcludePaths: []string{"/app/tmp", "/app/logs/*.log"},
+	})
+
+	dest := t.TempDir()
+	if err := img.ExtractRootFS(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	for p, want := range map[string]bool{
+		"app/main":          true,
+		"app/tmp":           false,
+		"app/tmp/junk":      false,
+		"app/logs/keep.txt": true,
+		"app/logs/app.log":  false,
+		"etc/app.conf":      true,
+		"etc/passwd":        false,
+	} {
+		if _, err := os.Lstat(filepath.Join(dest, p)); (err == nil) != want {
+			t.Fatalf("%s extracted: %v, want %v", p, err == nil, want)
+		}
+	}
+
+	img = openImage(t, path)
+
+	dest = t.TempDir()
+	if err := img.ExtractRootFS(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dest, "etc", "passwd")); err != nil {
+		t.Fatalf("ExtractRootFS() without patterns left out etc/passwd: %v", err)
+	}
+
+}
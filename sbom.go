@@ -0,0 +1,110 @@
+package dockerscope
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	attestationReferenceType = "attestation-manifest"
+	predicateTypeAnnotation  = "in-toto.io/predicate-type"
+)
+
+// sbomFormats maps the in-toto predicate types BuildKit uses for SBOMs to the format of the document
+var sbomFormats = map[string]string{
+	"https://spdx.dev/Document": "spdx",
+	"https://cyclonedx.org/bom": "cyclonedx",
+}
+
+// ErrNoSBOM is returned when the archive carries no SBOM attestation
+var ErrNoSBOM = errors.New("No SBOM")
+
+// inTotoStatement is the envelope BuildKit stores attestations in
+type inTotoStatement struct {
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// SBOM returns the first SBOM document found in the attestation manifests of an OCI archive together with its
+// format, spdx or cyclonedx. ErrNoSBOM is returned if there is none.
+func (i *Image) SBOM() ([]byte, string, error) {
+
+	if err := i.extract(); err != nil {
+		return nil, "", err
+	}
+
+	if !i.isOCI() || i.isDirLayout() {
+		return nil, "", fmt.Errorf("%w: image %s has no attestations", ErrNoSBOM, i.PathToSource)
+	}
+
+	index, err := i.ociIndex()
+	if err != nil {
+		return nil, "", err
+	}
+
+	attestations := make([]*ociManifest, 0)
+
+	if err := i.collectAttestations(index, &attestations, 0); err != nil {
+		return nil, "", err
+	}
+
+	for _, m := range attestations {
+
+		for _, d := range m.Layers {
+
+			if predicate := d.Annotations[predicateTypeAnnotation]; predicate != "" && sbomFormats[predicate] == "" {
+				continue
+			}
+
+			data, err := i.readBlob(d.Digest)
+			if err != nil {
+				return nil, "", err
+			}
+
+			statement := &inTotoStatement{}
+
+			if err := json.Unmarshal(data, statement); err != nil {
+				return nil, "", fmt.Errorf("Unexpected data schema for attestation %s in image %s", d.Digest, i.PathToSource)
+			}
+
+			if format := sbomFormats[statement.PredicateType]; format != "" {
+				return statement.Predicate, format, nil
+			}
+
+		}
+
+	}
+
+	return nil, "", fmt.Errorf("%w: image %s has no SBOM attestation", ErrNoSBOM, i.PathToSource)
+
+}
+
+// collectAttestations appends every attestation manifest listed by the index m, descending into nested indexes
+func (i *Image) collectAttestations(m *ociManifest, attestations *[]*ociManifest, depth int) error {
+
+	if depth > maxLinkDepth {
+		return fmt.Errorf("OCI index nesting too deep in image %s", i.PathToSource)
+	}
+
+	for _, d := range m.Manifests {
+
+		child, err := i.readManifestBlob(d.Digest)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.Annotations[referenceTypeAnnotation] == attestationReferenceType:
+			*attestations = append(*attestations, child)
+		case child.isIndex():
+			if err := i.collectAttestations(child, attestations, depth+1); err != nil {
+				return err
+			}
+		}
+
+	}
+
+	return nil
+
+}
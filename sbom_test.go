@@ -0,0 +1,53 @@
+package dockerscope
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSBOM(t *testing.T) {
+
+	provenance := []byte(`{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://slsa.dev/provenance/v0.2","predicate":{"builder":{}}}`)
+	sbom := []byte(`{"_type":"https://in-toto.io/Statement/v0.1","predicateType":"https://spdx.dev/Document","predicate":{"spdxVersion":"SPDX-2.3"}}`)
+	config := []byte(`{"architecture":"unknown","os":"unknown","rootfs":{"type":"layers","diff_ids":[]}}`)
+
+	layers := []interface{}{descriptor("application/vnd.in-toto+json", provenance), descriptor("application/vnd.in-toto+json", sbom)}
+	layers[0].(map[string]interface{})["annotations"] = map[string]string{"in-toto.io/predicate-type": "https://slsa.dev/provenance/v0.2"}
+	layers[1].(map[string]interface{})["annotations"] = map[string]string{"in-toto.io/predicate-type": "https://spdx.dev/Document"}
+
+	manifest := mustJSON(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        descriptor("application/vnd.oci.image.config.v1+json", config),
+		"layers":        layers,
+	})
+
+	attestation := descriptor("application/vnd.oci.image.manifest.v1+json", manifest)
+	attestation["annotations"] = map[string]string{"vnd.docker.reference.type": "attestation-manifest"}
+
+	img := openImage(t, ociArchive{
+		layers:    [][]testFile{{{name: "app", body: "app"}}},
+		nested:    true,
+		manifests: []map[string]interface{}{attestation},
+		blobs:     [][]byte{provenance, sbom, config, manifest},
+	}.write(t))
+
+	document, format, err := img.SBOM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if format != "spdx" || string(document) != `{"spdxVersion":"SPDX-2.3"}` {
+		t.Fatalf("SBOM() = %s, %q, want the SPDX document", document, format)
+	}
+
+	for _, path := range []string{
+		ociArchive{layers: [][]testFile{{{name: "app"}}}}.write(t),
+		saveArchive{layers: []testLayer{{id: "a"}}, manifest: true}.write(t),
+	} {
+		if _, _, err := openImage(t, path).SBOM(); !errors.Is(err, ErrNoSBOM) {
+			t.Fatalf("SBOM() of an image without attestations = %v, want ErrNoSBOM", err)
+		}
+	}
+
+}
@@ -0,0 +1,57 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+)
+
+// ErrStopScan can be returned by the callback of ScanLayers to stop the scan early. ScanLayers then returns nil.
+var ErrStopScan = errors.New("Stop scan")
+
+// errStopYield stops the walk of a layer once the consumer of its entries has seen enough
+var errStopYield = errors.New("Stop yield")
+
+// ScanLayers calls fn for every layer of the image, base layer first. Calling entries streams the layer tarball
+// and passes its entries to yield until yield returns false, without extracting the layer, so a scan holds no
+// more than one entry in memory at a time and only reads what it asks for. r reads the content of the entry and
+// is only valid until yield returns. Returning ErrStopScan from fn skips the remaining layers, any other error
+// stops the scan and is returned, as is an error reading the layer the entries of fn came from.
+func (i *Image) ScanLayers(fn func(layer *Layer, entries func(yield func(*tar.Header, io.Reader) bool)) error) error {
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return err
+	}
+
+	for _, l := range layers {
+
+		var readErr error
+
+		entries := func(yield func(*tar.Header, io.Reader) bool) {
+			err := i.WalkLayerEntries(l.Id, func(header *tar.Header, r io.Reader) error {
+				if !yield(header, r) {
+					return errStopYield
+				}
+				return nil
+			})
+			if err != nil && err != errStopYield && readErr == nil {
+				readErr = err
+			}
+		}
+
+		if err := fn(l, entries); err == ErrStopScan {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if readErr != nil {
+			return readErr
+		}
+
+	}
+
+	return nil
+
+}
@@ -0,0 +1,70 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestScanLayers(t *testing.T) {
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{{name: "bin/sh"}, {name: "etc/passwd", body: "root:x:0:0"}, {name: "etc/group"}}},
+		{id: "app", files: []testFile{{name: "app"}}},
+	}}.write(t))
+
+	layers, err := img.orderedLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the scan stops before the second layer, reading it would fail
+	if err := ioutil.WriteFile(layers[1].path, []byte("not a tarball"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var scanned, seen []string
+	var passwd string
+
+	err = img.ScanLayers(func(l *Layer, entries func(yield func(*tar.Header, io.Reader) bool)) error {
+
+		scanned = append(scanned, l.Id)
+
+		entries(func(h *tar.Header, r io.Reader) bool {
+
+			seen = append(seen, h.Name)
+
+			if h.Name == "etc/passwd" {
+				data, _ := ioutil.ReadAll(r)
+				passwd = string(data)
+				return false
+			}
+
+			return true
+
+		})
+
+		if passwd != "" {
+			return ErrStopScan
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		t.Fatalf("ScanLayers() = %v, want nil after ErrStopScan", err)
+	}
+
+	if len(scanned) != 1 || len(seen) != 2 || passwd != "root:x:0:0" {
+		t.Fatalf("ScanLayers() scanned layers %q and entries %q, want to stop at etc/passwd of the base layer", scanned, seen)
+	}
+
+	failed := errors.New("scanner failed")
+
+	if err := img.ScanLayers(func(*Layer, func(func(*tar.Header, io.Reader) bool)) error { return failed }); err != failed {
+		t.Fatalf("ScanLayers() = %v, want the error of the scanner", err)
+	}
+
+}
@@ -0,0 +1,111 @@
+package dockerscope
+
+import "fmt"
+
+// ImageSnapshot records the state of an image at one point in time. It marshals to json, so it can be kept
+// between builds instead of the image itself.
+type ImageSnapshot struct {
+	Tags              []string `json:"tags"`
+	LayerDigests      []string `json:"layerDigests"`
+	ConfigFingerprint string   `json:"configFingerprint"`
+	Size              int64    `json:"size"`
+}
+
+// SnapshotDiff describes how an image changed since a snapshot was taken
+type SnapshotDiff struct {
+	// Changed names the fields of ImageSnapshot that differ, in the order ImageSnapshot declares them
+	Changed []string
+	// TagsAdded and TagsRemoved are the tags the image gained and lost, sorted
+	TagsAdded   []string
+	TagsRemoved []string
+	// LayersAdded and LayersRemoved are the layer digests the image gained and lost, base layer first
+	LayersAdded   []string
+	LayersRemoved []string
+	// SizeDelta is the current size minus the size in the snapshot
+	SizeDelta int64
+}
+
+// Snapshot records the tags of the image, the digests of its layer blobs base layer first, the fingerprint of
+// its configuration and its total size, for CompareSnapshot to compare against later
+func (i *Image) Snapshot() (*ImageSnapshot, error) {
+
+	tags, err := i.ListTags()
+	if err != nil {
+		return nil, err
+	}
+
+	digests, err := i.layerBlobDigests()
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint, err := i.ConfigFingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := i.DockerReportedSize()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageSnapshot{Tags: tags, LayerDigests: digests, ConfigFingerprint: fingerprint, Size: size}, nil
+
+}
+
+// CompareSnapshot returns how the image differs from the snapshot prev, taken earlier of the same or of a
+// previous build of the image
+func (i *Image) CompareSnapshot(prev *ImageSnapshot) (*SnapshotDiff, error) {
+
+	if prev == nil {
+		return nil, fmt.Errorf("No snapshot to compare image %s with", i.PathToSource)
+	}
+
+	cur, err := i.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &SnapshotDiff{
+		Changed:       make([]string, 0),
+		TagsAdded:     missingFrom(cur.Tags, prev.Tags),
+		TagsRemoved:   missingFrom(prev.Tags, cur.Tags),
+		LayersAdded:   missingFrom(cur.LayerDigests, prev.LayerDigests),
+		LayersRemoved: missingFrom(prev.LayerDigests, cur.LayerDigests),
+		SizeDelta:     cur.Size - prev.Size,
+	}
+
+	if !equalStrings(cur.Tags, prev.Tags) {
+		diff.Changed = append(diff.Changed, "Tags")
+	}
+
+	if !equalStrings(cur.LayerDigests, prev.LayerDigests) {
+		diff.Changed = append(diff.Changed, "LayerDigests")
+	}
+
+	if cur.ConfigFingerprint != prev.ConfigFingerprint {
+		diff.Changed = append(diff.Changed, "ConfigFingerprint")
+	}
+
+	if cur.Size != prev.Size {
+		diff.Changed = append(diff.Changed, "Size")
+	}
+
+	return diff, nil
+
+}
+
+// missingFrom returns the elements of list that other does not contain, in the order of list
+func missingFrom(list, other []string) []string {
+
+	missing := make([]string, 0)
+
+	for _, e := range list {
+		if !containsString(other, e) {
+			missing = append(missing, e)
+		}
+	}
+
+	return missing
+
+}
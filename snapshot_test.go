@@ -0,0 +1,70 @@
+package dockerscope
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCompareSnapshot(t *testing.T) {
+
+	path := saveArchive{
+		layers: []testLayer{
+			{id: "base", files: []testFile{{name: "bin/sh", body: "sh"}}},
+			{id: "app", files: []testFile{{name: "app/main", body: "main"}}},
+		},
+		repositories: map[string]map[string]string{"app": {"1.0": "app"}},
+		manifest:     true,
+	}.write(t)
+
+	img := openImage(t, path)
+
+	s, err := img.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// snapshots are kept between builds as json
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prev ImageSnapshot
+	if err := json.Unmarshal(data, &prev); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := img.CompareSnapshot(&prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diff.Changed) != 0 {
+		t.Fatalf("CompareSnapshot() of the unchanged image = %+v, want no changes", diff)
+	}
+
+	if err := img.SetLabel("version", "1.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := img.SetName("other"); err != nil {
+		t.Fatal(err)
+	}
+
+	img = openImage(t, path)
+
+	if diff, err = img.CompareSnapshot(&prev); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(diff.Changed, []string{"Tags", "ConfigFingerprint"}) || !reflect.DeepEqual(diff.TagsAdded, []string{"other:1.0"}) ||
+		len(diff.TagsRemoved) != 0 || len(diff.LayersAdded) != 0 || diff.SizeDelta != 0 {
+		t.Fatalf("CompareSnapshot() after a relabel and rename = %+v, want changed tags and config only", diff)
+	}
+
+	if _, err := img.CompareSnapshot(nil); err == nil {
+		t.Fatal("CompareSnapshot(nil) succeeded")
+	}
+
+}
@@ -0,0 +1,514 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/alexflint/go-filemutex"
+)
+
+// squashLayers writes a single layer tarball to w that has the same effect as applying layers in order.
+// Whiteouts are kept so that they still hide files of the layers below. It returns the diff id of the tarball.
+func (i *Image) squashLayers(layers []*Layer, w io.Writer) (string, error) {
+
+	// first pass: find which layer provides the final state of every path
+	provider := make(map[string]int)
+
+	for k, l := range layers {
+
+		err := i.walkLayer(l.Id, func(header *tar.Header, r io.Reader) error {
+
+			name := cleanPath(header.Name)
+			dir, base := path.Split(name)
+
+			switch {
+			case base == opaqueWhiteout:
+				removeProvidedBelow(provider, path.Clean(dir), k)
+			case strings.HasPrefix(base, whiteoutPrefix):
+				hidden := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+				delete(provider, hidden)
+				removeProvidedBelow(provider, hidden, k)
+			}
+
+			provider[name] = k
+
+			return nil
+
+		})
+
+		if err != nil {
+			return "", err
+		}
+
+	}
+
+	// second pass: copy every entry that survived from the layer providing it
+	digest := sha256.New()
+	tarball := tar.NewWriter(io.MultiWriter(w, digest))
+
+	for k, l := range layers {
+
+		err := i.walkLayer(l.Id, func(header *tar.Header, r io.Reader) error {
+
+			if p, ok := provider[cleanPath(header.Name)]; !ok || p != k {
+				return nil
+			}
+
+			if err := tarball.WriteHeader(header); err != nil {
+				return err
+			}
+
+			_, err := io.Copy(tarball, r)
+			return err
+
+		})
+
+		if err != nil {
+			return "", err
+		}
+
+	}
+
+	if err := tarball.Close(); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(digest.Sum(nil)), nil
+
+}
+
+// removeProvidedBelow removes every path below dir provided by a layer lower than layer
+func removeProvidedBelow(provider map[string]int, dir string, layer int) {
+
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	for p, k := range provider {
+		if strings.HasPrefix(p, prefix) && k < layer {
+			delete(provider, p)
+		}
+	}
+
+}
+
+// size returns the size of the stored layer tarball
+func (l *Layer) size() int64 {
+
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+
+}
+
+// CoalesceLayers merges adjacent layers until the image has at most maxLayers layers. The adjacent pair with
+// the smallest combined size is merged first, so large layers are rewritten as rarely as possible.
+func (i *Image) CoalesceLayers(maxLayers int) error {
+
+	if maxLayers < 1 {
+		return fmt.Errorf("Image needs at least one layer, got %d", maxLayers)
+	}
+
+	m, err := filemutex.New(i.lockPath())
+	if err != nil {
+		return fmt.Errorf("Error coalescing image: Setting mutex failed) %s", i.PathToSource)
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return err
+	}
+
+	if len(layers) <= maxLayers {
+		return nil
+	}
+
+	groups := make([][]*Layer, len(layers))
+	sizes := make([]int64, len(layers))
+
+	for k, l := range layers {
+		groups[k] = []*Layer{l}
+		sizes[k] = l.size()
+	}
+
+	for len(groups) > maxLayers {
+
+		smallest := 0
+
+		for k := 1; k < len(groups)-1; k++ {
+			if sizes[k]+sizes[k+1] < sizes[smallest]+sizes[smallest+1] {
+				smallest = k
+			}
+		}
+
+		groups[smallest] = append(groups[smallest], groups[smallest+1]...)
+		sizes[smallest] += sizes[smallest+1]
+		groups = append(groups[:smallest+1], groups[smallest+2:]...)
+		sizes = append(sizes[:smallest+1], sizes[smallest+2:]...)
+
+	}
+
+	if err := i.rewriteLayers(groups); err != nil {
+		return err
+	}
+
+	if err = i.save(); err != nil {
+		return fmt.Errorf("Error creating image: Tar failed) %s", i.pathToWorkingCopy)
+	}
+
+	return nil
+
+}
+
+// SquashTop merges the top n layers of the image into a single layer and leaves the layers below untouched, so
+// they can still be shared with other images built on the same base
+func (i *Image) SquashTop(n int) error {
+
+	m, err := filemutex.New(i.lockPath())
+	if err != nil {
+		return fmt.Errorf("Error squashing image: Setting mutex failed) %s", i.PathToSource)
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return err
+	}
+
+	if n < 1 || n > len(layers) {
+		return fmt.Errorf("Cannot squash the top %d of %d layers", n, len(layers))
+	}
+
+	if n == 1 {
+		return nil
+	}
+
+	base := len(layers) - n
+	groups := make([][]*Layer, 0, base+1)
+
+	for _, l := range layers[:base] {
+		groups = append(groups, []*Layer{l})
+	}
+
+	groups = append(groups, layers[base:])
+
+	if err := i.rewriteLayers(groups); err != nil {
+		return err
+	}
+
+	if err = i.save(); err != nil {
+		return fmt.Errorf("Error creating image: Tar failed) %s", i.pathToWorkingCopy)
+	}
+
+	return nil
+
+}
+
+// rewriteLayers replaces every group of adjacent layers by a single layer. The merged layer keeps the id and
+// metadata of the topmost layer of its group. Layer parents, manifest.json and the image config are updated
+// to match the new stack, for OCI images the image manifest as well.
+func (i *Image) rewriteLayers(groups [][]*Layer) error {
+
+	if i.isOCI() {
+		return i.rewriteOCILayers(groups)
+	}
+
+	diffIds := make([]string, len(groups))
+	parent := ""
+
+	for k, group := range groups {
+
+		top := group[len(group)-1]
+
+		if len(group) > 1 {
+
+			d, err := i.writeLayerTarball(top, func(w io.Writer) (string, error) {
+				return i.squashLayers(group, w)
+			})
+			if err != nil {
+				return err
+			}
+
+			diffIds[k] = d
+
+			for _, l := range group[:len(group)-1] {
+				os.RemoveAll(filepath.Dir(l.path))
+			}
+
+		} else {
+
+			d, err := fileDigest(top.path)
+			if err != nil {
+				return err
+			}
+
+			diffIds[k] = d
+
+		}
+
+		if err := i.setLayerParent(top.Id, parent); err != nil {
+			return err
+		}
+
+		parent = top.Id
+
+	}
+
+	if i.hasManifest() {
+		if err := i.rewriteManifestLayers(groups, diffIds); err != nil {
+			return err
+		}
+	}
+
+	i.Layers = nil
+	i.index = nil
+
+	return i.dropDigestTags()
+
+}
+
+// rewriteOCILayers replaces every group of adjacent layers of an OCI image by a single uncompressed layer blob.
+// Layers left on their own keep their blob and descriptor.
+func (i *Image) rewriteOCILayers(groups [][]*Layer) error {
+
+	if err := i.requireSinglePlatform(); err != nil {
+		return err
+	}
+
+	m, err := i.ociManifest()
+	if err != nil {
+		return err
+	}
+
+	layers := make([]ociDescriptor, len(groups))
+	diffIds := make([]string, len(groups))
+
+	for k, group := range groups {
+
+		top := group[len(group)-1]
+
+		if len(group) == 1 {
+			layers[k] = m.Layers[top.position-1]
+			if diffIds[k], _, err = i.layerContent(top.Id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		d, err := i.writeLayerTarball(top, func(w io.Writer) (string, error) {
+			return i.squashLayers(group, w)
+		})
+		if err != nil {
+			return err
+		}
+
+		if layers[k], err = i.uncompressedLayerDescriptor(top, d); err != nil {
+			return err
+		}
+
+		diffIds[k] = d
+
+	}
+
+	err = i.replaceOCILayers(layers, func(imageConfig map[string]json.RawMessage) error {
+		rewriteConfigLayers(imageConfig, groups, diffIds)
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	i.Layers = nil
+	i.index = nil
+
+	return i.dropDigestTags()
+
+}
+
+// writeLayerTarball replaces the tarball of l by the uncompressed one write produces and returns its diff id.
+// write returns the diff id of what it wrote. Blobs of OCI images are content addressed, so there the tarball
+// is stored under its digest and the blob of l stays until nothing refers to it.
+func (i *Image) writeLayerTarball(l *Layer, write func(w io.Writer) (string, error)) (string, error) {
+
+	tmpPath := l.path + ".tmp"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return "", fmt.Errorf("Error rewriting layers: Layer write failed) %s", tmpPath)
+	}
+
+	diffId, err := write(file)
+	file.Close()
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	target := l.path
+	if i.isOCI() {
+		target = i.blobPath(diffId)
+	}
+
+	if err := os.Rename(tmpPath, target); err != nil {
+		return "", fmt.Errorf("Error rewriting layers: Layer write failed) %s", target)
+	}
+
+	return diffId, nil
+
+}
+
+// uncompressedLayerDescriptor returns the descriptor of the uncompressed blob diffId written in place of l.
+// Docker media types stay docker media types.
+func (i *Image) uncompressedLayerDescriptor(l *Layer, diffId string) (ociDescriptor, error) {
+
+	info, err := os.Stat(i.blobPath(diffId))
+	if err != nil {
+		return ociDescriptor{}, fmt.Errorf("Blob %s not found in image %s", diffId, i.PathToSource)
+	}
+
+	mediaType := ociLayerMediaType
+	if strings.Contains(l.mediaType, "docker") {
+		mediaType = dockerLayerMediaType
+	}
+
+	return ociDescriptor{MediaType: mediaType, Digest: diffId, Size: info.Size()}, nil
+
+}
+
+// setLayerParent points the v1 json of layerId at parent, an empty parent marks the base layer
+func (i *Image) setLayerParent(layerId string, parent string) error {
+
+	layerConfig, err := i.readLayerConfig(layerId)
+	if err != nil {
+		return err
+	}
+
+	if parent == "" {
+		delete(layerConfig, "parent")
+	} else {
+		layerConfig["parent"], _ = json.Marshal(parent)
+	}
+
+	data, err := marshalConfig(layerConfig)
+	if err != nil {
+		return fmt.Errorf("Error merging layers: Json failed %s", layerId)
+	}
+
+	if err := ioutil.WriteFile(i.layerConfigPath(layerId), data, 0644); err != nil {
+		return fmt.Errorf("Error merging layers: Layer config write failed) %s", layerId)
+	}
+
+	return nil
+
+}
+
+// rewriteManifestLayers updates the layer list of manifest.json and the diff ids and history of its config
+// after groups of layers have been merged
+func (i *Image) rewriteManifestLayers(groups [][]*Layer, diffIds []string) error {
+
+	entries, err := i.readManifest()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+
+		layerPaths := make([]string, len(groups))
+
+		for k, group := range groups {
+			top := group[len(group)-1]
+			layerPaths[k] = top.Id + "/" + layerTarFile
+		}
+
+		entry.Layers = layerPaths
+
+		config, err := i.readManifestConfig(entry)
+		if err != nil {
+			return err
+		}
+
+		rewriteConfigLayers(config, groups, diffIds)
+
+		if err := i.writeManifestConfig(entry, config); err != nil {
+			return err
+		}
+
+	}
+
+	return i.writeManifest(entries)
+
+}
+
+// rewriteConfigLayers records diffIds in the rootfs of the image config and marks the history entries of the
+// layers merged away as empty
+func rewriteConfigLayers(config map[string]json.RawMessage, groups [][]*Layer, diffIds []string) {
+
+	var rootfs map[string]interface{}
+	json.Unmarshal(config["rootfs"], &rootfs)
+	if rootfs == nil {
+		rootfs = map[string]interface{}{"type": "layers"}
+	}
+	rootfs["diff_ids"] = diffIds
+	config["rootfs"], _ = json.Marshal(rootfs)
+
+	// history entries of merged away layers no longer produce a layer of their own
+	var history []map[string]interface{}
+	json.Unmarshal(config["history"], &history)
+
+	merged := make([]bool, 0)
+	for _, group := range groups {
+		for k := range group {
+			merged = append(merged, k < len(group)-1)
+		}
+	}
+
+	n := 0
+	for _, h := range history {
+		if empty, _ := h["empty_layer"].(bool); empty {
+			continue
+		}
+		if n < len(merged) && merged[n] {
+			h["empty_layer"] = true
+		}
+		n++
+	}
+
+	if history != nil {
+		config["history"], _ = json.Marshal(history)
+	}
+
+}
+
+// fileDigest returns the sha256 digest of the file at path
+func fileDigest(path string) (string, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	digest := sha256.New()
+
+	if _, err := io.Copy(digest, file); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(digest.Sum(nil)), nil
+
+}
@@ -0,0 +1,346 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mergedContents describes every path of the merged filesystem of img: the content of regular files, the target
+// of links and "dir" for directories
+func mergedContents(t *testing.T, img *Image) map[string]string {
+
+	t.Helper()
+
+	fs, err := img.mergedFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := make(map[string]string)
+
+	for p, e := range fs {
+
+		switch e.header.Typeflag {
+		case tar.TypeDir:
+			contents[p] = "dir"
+		case tar.TypeSymlink, tar.TypeLink:
+			contents[p] = "-> " + e.header.Linkname
+		default:
+			r, err := img.OpenLayerFile(e.layer, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents[p] = string(data)
+		}
+	}
+
+	return contents
+
+}
+
+func TestCoalesceLayers(t *testing.T) {
+
+	path := saveArchive{
+		layers: []testLayer{
+			{id: "l1", files: []testFile{
+				{name: "usr/", typeflag: tar.TypeDir},
+				{name: "usr/lib/libc.so", body: strings.Repeat("c", 64<<10)},
+				{name: "etc/", typeflag: tar.TypeDir},
+				{name: "etc/passwd", body: "root:x:0:0::/root:/bin/sh"},
+			}},
+			{id: "l2", files: []testFile{
+				{name: "etc/passwd", body: "root:x:0:0::/root:/bin/sh\napp:x:1000:1000::/app:/bin/sh"},
+				{name: "tmp/", typeflag: tar.TypeDir},
+				{name: "tmp/cache/a", body: "a"},
+				{name: "tmp/cache/b", body: "b"},
+			}},
+			{id: "l3", files: []testFile{
+				{name: "tmp/cache/.wh..wh..opq"},
+				{name: "tmp/cache/c", body: "c"},
+			}},
+			{id: "l4", files: []testFile{
+				{name: "app/main", body: "v1", mode: 0755},
+				{name: "app/current", typeflag: tar.TypeSymlink, linkname: "main"},
+			}},
+			{id: "l5", config: map[string]interface{}{"Cmd": []string{"/app/current"}}, files: []testFile{
+				{name: "app/main", body: "v2", mode: 0755},
+				{name: "tmp/.wh.cache"},
+			}},
+		},
+		repositories: map[string]map[string]string{"app": {"latest": "l5"}},
+		manifest:     true,
+		config: map[string]interface{}{"history": []map[string]interface{}{
+			{"created_by": "ADD rootfs.tar /"},
+			{"created_by": "RUN adduser app"},
+			{"created_by": "RUN cache"},
+			{"created_by": "ENV MODE=production", "empty_layer": true},
+			{"created_by": "COPY app /app"},
+			{"created_by": "COPY app /app"},
+		}},
+	}.write(t)
+
+	img := openImage(t, path)
+	before := mergedContents(t, img)
+
+	layers, err := img.orderedLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := fileDigest(layers[0].path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := img.CoalesceLayers(2); err != nil {
+		t.Fatal(err)
+	}
+
+	img = openImage(t, path)
+
+	layers, err = img.orderedLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(layers) != 2 || layers[0].Id != "l1" || layers[1].Id != "l5" {
+		t.Fatalf("CoalesceLayers(2) left layers %s and %s, want l1 and l5", layers[0].Id, layers[len(layers)-1].Id)
+	}
+
+	if after := mergedContents(t, img); !reflect.DeepEqual(after, before) {
+		t.Fatalf("merged filesystem after CoalesceLayers(2) = %v, want %v", after, before)
+	}
+
+	if d, err := fileDigest(layers[0].path); err != nil || d != base {
+		t.Fatalf("base layer rewritten to %s, want it left as %s", d, base)
+	}
+
+	c, err := img.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.Cmd) != 1 || c.Cmd[0] != "/app/current" {
+		t.Fatalf("Cmd after CoalesceLayers(2) = %q, want [/app/current]", c.Cmd)
+	}
+
+	entries, err := img.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := img.readManifestConfig(entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rootfs struct {
+		DiffIds []string `json:"diff_ids"`
+	}
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries[0].Layers) != 2 || len(rootfs.DiffIds) != 2 {
+		t.Fatalf("manifest lists %d layers and %d diff ids, want 2", len(entries[0].Layers), len(rootfs.DiffIds))
+	}
+
+	for k, l := range layers {
+		if d, err := fileDigest(l.path); err != nil || d != rootfs.DiffIds[k] {
+			t.Fatalf("diff id %d is %s, layer %s has digest %s", k, rootfs.DiffIds[k], l.Id, d)
+		}
+	}
+
+}
+
+func TestSquashTop(t *testing.T) {
+
+	var layers []testLayer
+	for _, id := range []string{"l1", "l2", "l3", "l4", "l5"} {
+		layers = append(layers, testLayer{id: id, files: []testFile{{name: id, body: id}, {name: "shared", body: id}}})
+	}
+	layers[3].files = append(layers[3].files, testFile{name: "tmp/", typeflag: tar.TypeDir}, testFile{name: "tmp/x", body: "x"})
+	layers[4].files = append(layers[4].files, testFile{name: "tmp/.wh.x"})
+	layers[4].config = map[string]interface{}{"Cmd": []string{"/l5"}}
+
+	path := saveArchive{layers: layers, repositories: map[string]map[string]string{"app": {"latest": "l5"}}, manifest: true}.write(t)
+
+	img := openImage(t, path)
+	before := mergedContents(t, img)
+
+	original, err := img.orderedLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bases []string
+	for _, l := range original[:3] {
+		d, err := fileDigest(l.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bases = append(bases, d)
+	}
+
+	if err := img.SquashTop(2); err != nil {
+		t.Fatal(err)
+	}
+
+	img = openImage(t, path)
+
+	squashed, err := img.orderedLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(squashed) != 4 {
+		t.Fatalf("SquashTop(2) left %d layers, want 4", len(squashed))
+	}
+
+	for k, l := range squashed[:3] {
+		if d, err := fileDigest(l.path); err != nil || l.Id != original[k].Id || d != bases[k] {
+			t.Fatalf("base layer %d is %s with digest %s, want %s untouched with %s", k, l.Id, d, original[k].Id, bases[k])
+		}
+	}
+
+	if after := mergedContents(t, img); !reflect.DeepEqual(after, before) {
+		t.Fatalf("merged filesystem after SquashTop(2) = %v, want %v", after, before)
+	}
+
+	if err := img.Verify(); err != nil {
+		t.Fatalf("Verify() after SquashTop(2) = %v", err)
+	}
+
+	if c, err := img.Config(); err != nil || !reflect.DeepEqual(c.Cmd, []string{"/l5"}) {
+		t.Fatalf("Cmd after SquashTop(2) = %q (%v), want [/l5]", c.Cmd, err)
+	}
+
+	if err := img.SquashTop(5); err == nil {
+		t.Fatal("SquashTop(5) on 4 layers succeeded")
+	}
+
+}
+
+func TestSquashTopOCI(t *testing.T) {
+
+	for name, a := range map[string]ociArchive{
+		"oci": {gzip: true, docker: true},
+		"dir": {gzip: true, dir: true},
+	} {
+
+		a.layers = [][]testFile{
+			{{name: "etc/motd", body: "hi"}},
+			{{name: "tmp/", typeflag: tar.TypeDir}, {name: "tmp/x", body: "x"}, {name: "app", body: "v1"}},
+			{{name: "tmp/.wh.x"}, {name: "app", body: "v2"}},
+			{{name: "app", body: "v3"}},
+		}
+		a.config = map[string]interface{}{"history": []map[string]interface{}{
+			{"created_by": "ADD rootfs.tar /"},
+			{"created_by": "RUN setup"},
+			{"created_by": "ENV MODE=production", "empty_layer": true},
+			{"created_by": "COPY app /app"},
+			{"created_by": "COPY app /app"},
+		}}
+
+		path := a.write(t)
+
+		img := openImage(t, path)
+		before := mergedContents(t, img)
+
+		original, err := img.orderedLayers()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := img.SquashTop(3); err != nil {
+			t.Fatal(name, err)
+		}
+
+		img = openImage(t, path)
+
+		layers, err := img.orderedLayers()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(layers) != 2 || layers[0].Id != original[0].Id || layers[0].mediaType != original[0].mediaType {
+			t.Fatalf("SquashTop(3) of %s left %d layers, want the base layer untouched and one more", name, len(layers))
+		}
+
+		if layers[1].mediaType != ociLayerMediaType {
+			t.Fatalf("squashed layer of %s has media type %s, want %s", name, layers[1].mediaType, ociLayerMediaType)
+		}
+
+		if after := mergedContents(t, img); !reflect.DeepEqual(after, before) {
+			t.Fatalf("merged filesystem of %s after SquashTop(3) = %v, want %v", name, after, before)
+		}
+
+		if err := img.Verify(); err != nil {
+			t.Fatalf("Verify() of %s after SquashTop(3) = %v", name, err)
+		}
+
+		for _, l := range original[1:] {
+			if _, err := os.Stat(img.blobPath("sha256:" + l.Id)); err == nil {
+				t.Fatalf("blob of squashed layer %s of %s left behind", l.Id, name)
+			}
+		}
+
+		m, err := img.ociManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := img.readBlob(m.Config.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := &ociConfig{}
+		if err := json.Unmarshal(data, config); err != nil {
+			t.Fatal(err)
+		}
+
+		var empty []bool
+		for _, h := range config.History {
+			empty = append(empty, h.EmptyLayer)
+		}
+
+		if want := []bool{false, true, true, true, false}; !reflect.DeepEqual(empty, want) {
+			t.Fatalf("empty_layer of the history of %s after SquashTop(3) = %v, want %v", name, empty, want)
+		}
+
+		if name != "oci" {
+			continue
+		}
+
+		checkOCIDigests(t, img)
+
+		entries, err := img.readManifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := []string{"blobs/sha256/" + layers[0].Id, "blobs/sha256/" + layers[1].Id}; !reflect.DeepEqual(entries[0].Layers, want) {
+			t.Fatalf("manifest.json lists layers %q after SquashTop(3), want %q", entries[0].Layers, want)
+		}
+
+		if err := img.CoalesceLayers(1); err != nil {
+			t.Fatal(err)
+		}
+
+		if after := mergedContents(t, openImage(t, path)); !reflect.DeepEqual(after, before) {
+			t.Fatalf("merged filesystem after CoalesceLayers(1) = %v, want %v", after, before)
+		}
+	}
+
+}
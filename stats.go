@@ -0,0 +1,40 @@
+package dockerscope
+
+import (
+	"fmt"
+	"time"
+)
+
+// ExtractStats describes how long the extraction of the image into its working copy took and how much it wrote
+type ExtractStats struct {
+	WallTime     time.Duration
+	BytesWritten int64
+	Files        int
+}
+
+// newExtractStats returns the statistics of an extraction that took wallTime and produced report
+func newExtractStats(report *Report, wallTime time.Duration) *ExtractStats {
+
+	stats := &ExtractStats{WallTime: wallTime}
+
+	if report != nil {
+		stats.BytesWritten = report.TotalBytes
+		stats.Files = report.Files
+	}
+
+	return stats
+
+}
+
+// LastExtractStats returns the statistics of the most recent extraction of the image into its working copy,
+// useful to tune Options.CopyBufferSize. Images are extracted lazily, by the first method that needs the
+// working copy.
+func (i *Image) LastExtractStats() (*ExtractStats, error) {
+
+	if i.stats == nil {
+		return nil, fmt.Errorf("Image %s has not been extracted yet", i.PathToSource)
+	}
+
+	return i.stats, nil
+
+}
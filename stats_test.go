@@ -0,0 +1,39 @@
+package dockerscope
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLastExtractStats(t *testing.T) {
+
+	img := openImageWithOptions(t, saveArchive{layers: []testLayer{
+		{id: "a", files: []testFile{{name: "usr/lib/big", body: strings.Repeat("x", 100<<10)}}},
+	}}.write(t), Options{CopyBufferSize: 4096})
+
+	if _, err := img.LastExtractStats(); err == nil {
+		t.Fatal("LastExtractStats() succeeded before the image was extracted")
+	}
+
+	r, err := img.ExtractReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := img.LastExtractStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := os.Stat(filepath.Join(img.pathToWorkingCopy, "a", "layer.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.WallTime <= 0 || stats.Files != r.Files || stats.BytesWritten != r.TotalBytes || stats.BytesWritten < layer.Size() {
+		t.Fatalf("LastExtractStats() = %+v, want the time taken and the %d files of %d bytes extracted", stats, r.Files, r.TotalBytes)
+	}
+
+}
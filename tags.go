@@ -0,0 +1,512 @@
+package dockerscope
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/alexflint/go-filemutex"
+)
+
+const digestPrefix = "sha256:"
+
+// ErrAmbiguousTag is returned when the same name:tag points to different layers
+var ErrAmbiguousTag = errors.New("Ambiguous tag")
+
+// repositoriesPath returns the location of the repositories file in the working copy
+func (i *Image) repositoriesPath() string {
+	return i.pathToWorkingCopy + string(filepath.Separator) + imageConfigFile
+}
+
+// Repositories returns the content of the repositories file as name to tag to layer id. An image without a
+// repositories file has no repositories.
+func (i *Image) Repositories() (map[string]map[string]string, error) {
+
+	if err := i.extract(); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(i.repositoriesPath())
+	if os.IsNotExist(err) {
+		return map[string]map[string]string{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read docker config for image %s", i.pathToWorkingCopy)
+	}
+
+	return parseRepositories(data)
+
+}
+
+// RepositoriesJSON returns the repositories file as it is stored in the image, for tools that parse it
+// themselves. An image without a repositories file returns no bytes and no error.
+func (i *Image) RepositoriesJSON() ([]byte, error) {
+
+	if err := i.extract(); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(i.repositoriesPath())
+	if os.IsNotExist(err) {
+		return []byte{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read docker config for image %s", i.pathToWorkingCopy)
+	}
+
+	return data, nil
+
+}
+
+// parseRepositories decodes a repositories file token by token, so that a name or tag listed twice is noticed
+// instead of silently keeping the last occurrence. Besides the nested schema {"name": {"tag": "layer id"}}
+// some malformed exports map a name straight to a layer id, {"name": "layer id"}, which is read as the latest
+// tag of the name.
+func parseRepositories(data []byte) (map[string]map[string]string, error) {
+
+	repos := make(map[string]map[string]string)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	schemaErr := fmt.Errorf("Unexpected data schema for repository json")
+
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, schemaErr
+	}
+
+	for dec.More() {
+
+		name, err := stringToken(dec)
+		if err != nil {
+			return nil, schemaErr
+		}
+
+		t, err := dec.Token()
+		if err != nil {
+			return nil, schemaErr
+		}
+
+		if repos[name] == nil {
+			repos[name] = make(map[string]string)
+		}
+
+		if layerId, ok := t.(string); ok {
+
+			if existing, ok := repos[name][defaultTag]; ok && existing != layerId {
+				return nil, fmt.Errorf("%w: %s:%s points to %s and %s", ErrAmbiguousTag, name, defaultTag, existing, layerId)
+			}
+
+			repos[name][defaultTag] = layerId
+			continue
+
+		}
+
+		if t != json.Delim('{') {
+			return nil, schemaErr
+		}
+
+		for dec.More() {
+
+			tag, err := stringToken(dec)
+			if err != nil {
+				return nil, schemaErr
+			}
+
+			layerId, err := stringToken(dec)
+			if err != nil {
+				return nil, schemaErr
+			}
+
+			if existing, ok := repos[name][tag]; ok && existing != layerId {
+				return nil, fmt.Errorf("%w: %s:%s points to %s and %s", ErrAmbiguousTag, name, tag, existing, layerId)
+			}
+
+			repos[name][tag] = layerId
+
+		}
+
+		if _, err := dec.Token(); err != nil {
+			return nil, schemaErr
+		}
+
+	}
+
+	return repos, nil
+
+}
+
+// stringToken reads the next token of dec, which must be a string
+func stringToken(dec *json.Decoder) (string, error) {
+
+	t, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+
+	s, ok := t.(string)
+	if !ok {
+		return "", fmt.Errorf("Expected string, got %v", t)
+	}
+
+	return s, nil
+
+}
+
+// ListTags returns every name:tag the image is known by, collected from the repositories file, manifest.json
+// and the annotations of an OCI index
+func (i *Image) ListTags() ([]string, error) {
+
+	repos, err := i.Repositories()
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool)
+
+	for name, tags := range repos {
+		for tag := range tags {
+			if strings.HasPrefix(tag, digestPrefix) {
+				found[name+"@"+tag] = true
+			} else {
+				found[name+":"+tag] = true
+			}
+		}
+	}
+
+	if i.hasManifest() {
+
+		entries, err := i.readManifest()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			for _, t := range entry.RepoTags {
+				found[t] = true
+			}
+		}
+
+	}
+
+	if i.isOCI() && !i.isDirLayout() {
+
+		index, err := i.ociIndex()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range index.Manifests {
+			if name := d.Annotations[containerdNameAnnotation]; name != "" {
+				found[name] = true
+			}
+		}
+
+	}
+
+	tags := make([]string, 0, len(found))
+
+	for t := range found {
+		tags = append(tags, t)
+	}
+
+	sort.Strings(tags)
+
+	return tags, nil
+
+}
+
+// writeRepositories replaces the repositories file with repos
+func (i *Image) writeRepositories(repos map[string]map[string]string) error {
+
+	data, err := json.Marshal(repos)
+	if err != nil {
+		return fmt.Errorf("Error writing repositories: Json failed %s", i.pathToWorkingCopy)
+	}
+
+	if err := ioutil.WriteFile(i.repositoriesPath(), data, 0644); err != nil {
+		return fmt.Errorf("Error writing repositories: Repository write failed) %s", i.pathToWorkingCopy)
+	}
+
+	return nil
+
+}
+
+// validDigest reports whether digest has the form sha256:<64 lowercase hex digits>
+func validDigest(digest string) bool {
+
+	hexPart := strings.TrimPrefix(digest, digestPrefix)
+	if hexPart == digest || len(hexPart) != 64 || strings.ToLower(hexPart) != hexPart {
+		return false
+	}
+
+	_, err := hex.DecodeString(hexPart)
+
+	return err == nil
+
+}
+
+// imageId returns the id of the image: the digest of its config, or the id of the latest layer for v1 images
+func (i *Image) imageId() (string, error) {
+
+	switch {
+	case i.isOCI():
+		m, err := i.ociManifest()
+		if err != nil {
+			return "", err
+		}
+		return m.Config.Digest, nil
+	case i.hasManifest():
+		entries, err := i.readManifest()
+		if err != nil || len(entries) == 0 {
+			return "", fmt.Errorf("Failed to read manifest of image %s", i.pathToWorkingCopy)
+		}
+		return fileDigest(i.manifestConfigPath(entries[0]))
+	}
+
+	l, err := i.latestLayer()
+	if err != nil {
+		return "", err
+	}
+
+	return digestPrefix + l.Id, nil
+
+}
+
+// AddDigestTag adds the reference name@sha256:<image id> to the image, pinning name to exactly this image, as an
+// additional entry in index.json. Only OCI images can record it: docker load rejects digests in the
+// repositories file and in the RepoTags of manifest.json. Edits that change the image id, such as SetLabel or
+// CoalesceLayers, drop the reference.
+func (i *Image) AddDigestTag(name string) error {
+
+	if name == "" || strings.ContainsAny(name, "@") {
+		return fmt.Errorf("Invalid image name %q", name)
+	}
+
+	m, err := filemutex.New(i.lockPath())
+	if err != nil {
+		return fmt.Errorf("Error tagging image: Setting mutex failed) %s", i.PathToSource)
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	if err := i.loadLayers(); err != nil {
+		return err
+	}
+
+	if !i.isOCI() {
+		return fmt.Errorf("Digest references can only be added to OCI images %s", i.PathToSource)
+	}
+
+	digest, err := i.imageId()
+	if err != nil {
+		return err
+	}
+
+	if !validDigest(digest) {
+		return fmt.Errorf("Image id %s of image %s is not a valid sha256 digest", digest, i.PathToSource)
+	}
+
+	if err := i.addOCIReference(name + "@" + digest); err != nil {
+		return err
+	}
+
+	if err = i.save(); err != nil {
+		return fmt.Errorf("Error creating image: Tar failed) %s", i.pathToWorkingCopy)
+	}
+
+	return nil
+
+}
+
+// dropDigestTags removes the references name@sha256:<digest> that pin an image other than the one the image is
+// now. Edits that change the image id call it: a digest reference promises exactly the content it names, so it
+// is dropped rather than moved to the edited image.
+func (i *Image) dropDigestTags() error {
+
+	id, err := i.imageId()
+	if err != nil {
+		return err
+	}
+
+	repos, err := i.Repositories()
+	if err != nil {
+		return err
+	}
+
+	dropped := false
+
+	for name, tags := range repos {
+		for tag := range tags {
+			if strings.HasPrefix(tag, digestPrefix) && tag != id {
+				delete(tags, tag)
+				dropped = true
+			}
+		}
+		if len(tags) == 0 {
+			delete(repos, name)
+		}
+	}
+
+	if dropped {
+		if err := i.writeRepositories(repos); err != nil {
+			return err
+		}
+	}
+
+	if i.hasManifest() {
+
+		entries, err := i.readManifest()
+		if err != nil {
+			return err
+		}
+
+		dropped = false
+
+		for _, entry := range entries {
+
+			tags := make([]string, 0, len(entry.RepoTags))
+
+			for _, ref := range entry.RepoTags {
+				if k := strings.Index(ref, "@"); k >= 0 && ref[k+1:] != id {
+					dropped = true
+					continue
+				}
+				tags = append(tags, ref)
+			}
+
+			entry.RepoTags = tags
+
+		}
+
+		if dropped {
+			if err := i.writeManifest(entries); err != nil {
+				return err
+			}
+		}
+
+	}
+
+	if i.isOCI() && !i.isDirLayout() {
+		return i.dropOCIDigestReferences(id)
+	}
+
+	return nil
+
+}
+
+// topLayerId returns the id of the topmost layer an entry of manifest.json lists, as the repositories file
+// refers to it
+func topLayerId(entry *manifestEntry) string {
+
+	if len(entry.Layers) == 0 {
+		return ""
+	}
+
+	top := entry.Layers[len(entry.Layers)-1]
+
+	if path.Base(top) == layerTarFile {
+		return path.Base(path.Dir(top))
+	}
+
+	return path.Base(top)
+
+}
+
+// SyncTags makes the repositories file and the RepoTags of manifest.json list the same tags. manifest.json takes
+// precedence, since it is what docker load reads: its tags are written to the repositories file, replacing
+// the layer a tag points to there if the two disagree. Tags only the repositories file lists are added to the
+// manifest.json entry whose topmost layer they point to, tags pointing to no such layer and digest tags are
+// left alone.
+func (i *Image) SyncTags() error {
+
+	m, err := filemutex.New(i.lockPath())
+	if err != nil {
+		return fmt.Errorf("Error tagging image: Setting mutex failed) %s", i.PathToSource)
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	if err := i.extract(); err != nil {
+		return err
+	}
+
+	if !i.hasManifest() {
+		return fmt.Errorf("Image %s has no manifest.json to sync tags with", i.PathToSource)
+	}
+
+	repos, err := i.Repositories()
+	if err != nil {
+		return err
+	}
+
+	entries, err := i.readManifest()
+	if err != nil {
+		return err
+	}
+
+	claimed := make(map[string]bool)
+
+	for _, entry := range entries {
+
+		top := topLayerId(entry)
+
+		for _, ref := range entry.RepoTags {
+
+			name, tag := splitTag(ref)
+			if tag == "" {
+				tag = defaultTag
+			}
+
+			claimed[name+":"+tag] = true
+
+			if repos[name] == nil {
+				repos[name] = make(map[string]string)
+			}
+
+			repos[name][tag] = top
+
+		}
+
+	}
+
+	for name, tags := range repos {
+		for tag, layerId := range tags {
+
+			ref := name + ":" + tag
+			if claimed[ref] || strings.HasPrefix(tag, digestPrefix) {
+				continue
+			}
+
+			for _, entry := range entries {
+				if topLayerId(entry) == layerId {
+					entry.RepoTags = append(entry.RepoTags, ref)
+					break
+				}
+			}
+
+		}
+	}
+
+	for _, entry := range entries {
+		sort.Strings(entry.RepoTags)
+	}
+
+	if err := i.writeRepositories(repos); err != nil {
+		return err
+	}
+
+	if err := i.writeManifest(entries); err != nil {
+		return err
+	}
+
+	if err = i.save(); err != nil {
+		return fmt.Errorf("Error creating image: Tar failed) %s", i.pathToWorkingCopy)
+	}
+
+	return nil
+
+}
@@ -0,0 +1,296 @@
+package dockerscope
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAmbiguousTags(t *testing.T) {
+
+	layers := []testLayer{{id: "base"}, {id: "app"}}
+
+	img := openImage(t, saveArchive{
+		layers:       layers,
+		repositories: json.RawMessage(`{"app":{"1.0":"base"},"app":{"1.0":"app","latest":"app"}}`),
+	}.write(t))
+
+	for _, fn := range []func() error{
+		func() error { _, err := img.Repositories(); return err },
+		func() error { _, err := img.ListTags(); return err },
+	} {
+		if err := fn(); !errors.Is(err, ErrAmbiguousTag) || !strings.Contains(err.Error(), "app:1.0") {
+			t.Fatalf("got %v, want ErrAmbiguousTag naming app:1.0", err)
+		}
+	}
+
+	img = openImage(t, saveArchive{
+		layers:       layers,
+		repositories: json.RawMessage(`{"app":{"1.0":"app"},"app":{"1.0":"app","latest":"app"}}`),
+		manifest:     true,
+	}.write(t))
+
+	tags, err := img.ListTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"app:1.0", "app:latest"}; !reflect.DeepEqual(tags, want) {
+		t.Fatalf("ListTags() = %q, want %q", tags, want)
+	}
+
+}
+
+func TestAddDigestTag(t *testing.T) {
+
+	id := strings.Repeat("3f", 32)
+
+	for name, path := range map[string]string{
+		"oci":        ociArchive{layers: [][]testFile{{{name: "a"}}}}.write(t),
+		"docker oci": ociArchive{layers: [][]testFile{{{name: "a"}}}, docker: true}.write(t),
+	} {
+
+		img := openImage(t, path)
+
+		if err := img.AddDigestTag("registry.example.com/app"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		img = openImage(t, path)
+
+		tags, err := img.ListTags()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		imageId, err := img.imageId()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		found := false
+		for _, tag := range tags {
+			found = found || tag == "registry.example.com/app@"+imageId
+		}
+
+		if !found || !validDigest(imageId) {
+			t.Fatalf("%s: ListTags() = %q, want registry.example.com/app@%s", name, tags, imageId)
+		}
+	}
+
+	// docker load rejects digests as tags of the repositories file and in RepoTags
+	for name, path := range map[string]string{
+		"v1":          saveArchive{layers: []testLayer{{id: id}}, repositories: map[string]map[string]string{"app": {"1.0": id}}}.write(t),
+		"docker save": saveArchive{layers: []testLayer{{id: id}}, repositories: map[string]map[string]string{"app": {"1.0": id}}, manifest: true}.write(t),
+	} {
+
+		if err := openImage(t, path).AddDigestTag("registry.example.com/app"); err == nil {
+			t.Fatalf("AddDigestTag() succeeded for a %s archive", name)
+		}
+
+		if tags, err := openImage(t, path).ListTags(); err != nil || !reflect.DeepEqual(tags, []string{"app:1.0"}) {
+			t.Fatalf("ListTags() of a %s archive after a failed AddDigestTag() = %q (%v), want [app:1.0]", name, tags, err)
+		}
+	}
+
+	img := openImage(t, ociArchive{layers: [][]testFile{{{name: "a"}}}}.write(t))
+
+	if err := img.AddDigestTag("app@sha256:" + id); err == nil {
+		t.Fatal("AddDigestTag() succeeded for a name carrying a digest")
+	}
+
+}
+
+func TestSetNameKeepsDigestTags(t *testing.T) {
+
+	path := ociArchive{layers: [][]testFile{{{name: "a"}}}, annotations: map[string]string{"io.containerd.image.name": "app:1.0"}}.write(t)
+
+	if err := openImage(t, path).AddDigestTag("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := openImage(t, path).SetName("other"); err != nil {
+		t.Fatal(err)
+	}
+
+	img := openImage(t, path)
+
+	tags, err := img.ListTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageId, err := img.imageId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"other:1.0", "other@" + imageId}; !reflect.DeepEqual(tags, want) {
+		t.Fatalf("ListTags() after AddDigestTag and SetName = %q, want %q", tags, want)
+	}
+
+}
+
+func TestEditDropsDigestTags(t *testing.T) {
+
+	for name, path := range map[string]string{
+		"oci":        ociArchive{layers: [][]testFile{{{name: "a"}}}, annotations: map[string]string{"io.containerd.image.name": "app:1.0"}}.write(t),
+		"docker oci": ociArchive{layers: [][]testFile{{{name: "a"}}}, annotations: map[string]string{"io.containerd.image.name": "app:1.0"}, docker: true}.write(t),
+	} {
+
+		if err := openImage(t, path).AddDigestTag("registry.example.com/app"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		if err := openImage(t, path).SetLabel("version", "1.1"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		img := openImage(t, path)
+
+		tags, err := img.ListTags()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		if want := []string{"app:1.0"}; !reflect.DeepEqual(tags, want) {
+			t.Fatalf("%s: ListTags() after SetLabel = %q, want %q", name, tags, want)
+		}
+
+		if err := img.SelfTest(); err != nil {
+			t.Fatalf("%s: SelfTest() after SetLabel = %v", name, err)
+		}
+	}
+
+}
+
+func TestRepositoriesJSON(t *testing.T) {
+
+	repos := map[string]map[string]string{"registry:5000/app": {"latest": "a", "1.0": "a"}}
+	img := openImage(t, saveArchive{layers: []testLayer{{id: "a"}}, repositories: repos}.write(t))
+
+	data, err := img.RepositoriesJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed map[string]map[string]string
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatalf("RepositoriesJSON() = %s, not valid JSON: %v", data, err)
+	}
+
+	if !reflect.DeepEqual(parsed, repos) || !bytes.Equal(data, mustJSON(repos)) {
+		t.Fatalf("RepositoriesJSON() = %s, want the repositories file %s", data, mustJSON(repos))
+	}
+
+	data, err = openImage(t, saveArchive{layers: []testLayer{{id: "a"}}}.write(t)).RepositoriesJSON()
+	if err != nil || len(data) != 0 {
+		t.Fatalf("RepositoriesJSON() without repositories file = %q (%v), want it empty", data, err)
+	}
+
+}
+
+func TestSyncTags(t *testing.T) {
+
+	// RepoTags are only written for a repositories map of type map[string]map[string]string, so the manifest.json
+	// of this archive has none
+	path := saveArchive{
+		layers:       []testLayer{{id: "base"}, {id: "app"}},
+		repositories: map[string]interface{}{"app": map[string]string{"latest": "app", "1.0": "base"}, "base": map[string]string{"1": "base"}},
+		manifest:     true,
+	}.write(t)
+
+	img := openImage(t, path)
+	if err := img.extract(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := img.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries[0].RepoTags = []string{"app:1.0", "registry:5000/app"}
+	if err := img.writeManifest(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := img.SyncTags(); err != nil {
+		t.Fatal(err)
+	}
+
+	img = openImage(t, path)
+	if err := img.extract(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err = img.readManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// base:1 points to a layer no image of manifest.json ends in
+	if want := []string{"app:1.0", "app:latest", "registry:5000/app"}; !reflect.DeepEqual(entries[0].RepoTags, want) {
+		t.Fatalf("RepoTags after SyncTags() = %q, want %q", entries[0].RepoTags, want)
+	}
+
+	repos, err := img.Repositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]string{
+		"app":               {"latest": "app", "1.0": "app"},
+		"registry:5000/app": {"latest": "app"},
+		"base":              {"1": "base"},
+	}
+	if !reflect.DeepEqual(repos, want) {
+		t.Fatalf("Repositories() after SyncTags() = %v, want %v with manifest.json taking precedence", repos, want)
+	}
+
+	if err := openImage(t, saveArchive{layers: []testLayer{{id: "a"}}}.write(t)).SyncTags(); err == nil {
+		t.Fatal("SyncTags() succeeded on an image without manifest.json")
+	}
+
+}
+
+func TestFlatRepositories(t *testing.T) {
+
+	for name, repos := range map[string]interface{}{
+		"nested": map[string]map[string]string{"old": {"latest": "a"}},
+		"flat":   map[string]string{"old": "a"},
+	} {
+
+		path := saveArchive{layers: []testLayer{{id: "a"}}, repositories: repos}.write(t)
+
+		got, err := openImage(t, path).Repositories()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		if want := map[string]map[string]string{"old": {"latest": "a"}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Repositories() of %s repositories = %v, want %v", name, got, want)
+		}
+
+		if tags, err := openImage(t, path).ListTags(); err != nil || !reflect.DeepEqual(tags, []string{"old:latest"}) {
+			t.Fatalf("ListTags() of %s repositories = %q (%v), want [old:latest]", name, tags, err)
+		}
+
+		if err := openImage(t, path).SetName("new"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		got, err = openImage(t, path).Repositories()
+		if err != nil {
+			t.Fatal(name, err)
+		}
+
+		if want := map[string]map[string]string{"new": {"latest": "a"}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Repositories() of %s repositories after SetName(new) = %v, want %v", name, got, want)
+		}
+	}
+
+}
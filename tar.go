@@ -3,12 +3,37 @@ package dockerscope
 import (
 	"os"
 	"archive/tar"
+	"fmt"
 	"io"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func tarit(source, target string) error {
+	return writeTarball(source, target, nil)
+}
+
+// taritNormalized tars source into target like tarit, with every entry modified at t and owned by root, so the
+// same working copy always gives the same archive. filepath.Walk visits the entries in lexical order, which
+// keeps their order stable.
+func taritNormalized(source, target string, t time.Time) error {
+
+	return writeTarball(source, target, func(header *tar.Header) {
+		header.ModTime = t
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.Uid = 0
+		header.Gid = 0
+		header.Uname = ""
+		header.Gname = ""
+	})
+
+}
+
+// writeTarball tars source into target, passing every header through normalize first unless it is nil
+func writeTarball(source, target string, normalize func(header *tar.Header)) error {
 
 	tarfile, err := os.Create(target)
 	if err != nil {
@@ -26,18 +51,29 @@ func tarit(source, target string) error {
 				return err
 			}
 
-			header, err := tar.FileInfoHeader(info, info.Name())
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			}
+
+			header, err := tar.FileInfoHeader(info, link)
 			if err != nil {
 				return err
 			}
 
 			header.Name = strings.TrimPrefix(path, source)
 
+			if normalize != nil {
+				normalize(header)
+			}
+
 			if err := tarball.WriteHeader(header); err != nil {
 				return err
 			}
 
-			if info.IsDir() {
+			if !info.Mode().IsRegular() {
 				return nil
 			}
 
@@ -53,40 +89,253 @@ func tarit(source, target string) error {
 
 
 
-func untar(tarball, target string) error {
+// Report summarizes what the extraction of an image wrote to the working copy
+type Report struct {
+	Files       int
+	TotalBytes  int64
+	LargestFile string
+	LargestSize int64
+	Symlinks    int
+	Skipped     []string
+
+	onSkip func(entry string, reason string)
+}
+
+// skip records that entry was not extracted and why
+func (r *Report) skip(entry string, reason string) {
+	r.Skipped = append(r.Skipped, entry+": "+reason)
+	if r.onSkip != nil {
+		r.onSkip(entry, reason)
+	}
+}
+
+// insideTarget reports whether path stays within target once all symlinks already extracted are followed
+func insideTarget(target, path string) bool {
+
+	if path != target && !strings.HasPrefix(path, target+string(filepath.Separator)) {
+		return false
+	}
+
+	// directories that do not exist yet cannot be redirected by a symlink, the nearest one that exists can
+	dir := filepath.Dir(path)
+	for dir != target {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return false
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		// a dangling symlink could still point anywhere, a missing target holds nothing yet
+		return os.IsNotExist(err) && dir == target
+	}
+
+	root, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return false
+	}
+
+	return resolved == root || strings.HasPrefix(resolved, root+string(filepath.Separator))
+
+}
+
+func untar(tarball, target string, options Options) (*Report, error) {
 	reader, err := os.Open(tarball)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer reader.Close()
+
+	return untarReader(reader, target, options)
+}
+
+// untarReader extracts the tarball read from reader into target, skipping entries that would end up outside it
+func untarReader(reader io.Reader, target string, options Options) (*Report, error) {
 	tarReader := tar.NewReader(reader)
 
+	report := &Report{Skipped: make([]string, 0), onSkip: options.OnSkip}
+	target = filepath.Clean(target)
+	global := map[string]string{}
+	buffer := make([]byte, options.copyBufferSize())
+
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return err
+			return report, err
 		}
 
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			for key, value := range header.PAXRecords {
+				global[key] = value
+			}
+			continue
+		}
+		applyGlobalHeader(header, global)
+
 		path := filepath.Join(target, header.Name)
+		if !insideTarget(target, path) {
+			report.skip(header.Name, "path escapes the extraction directory")
+			continue
+		}
+
 		info := header.FileInfo()
-		if info.IsDir() {
+
+		// layers may leave out the entries of the directories above a file, docker creates them
+		if header.Typeflag != tar.TypeDir {
+			if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return report, err
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
 			if err = os.MkdirAll(path, info.Mode()); err != nil {
-				return err
+				return report, err
+			}
+			continue
+		case tar.TypeSymlink:
+			if err = os.Symlink(header.Linkname, path); err != nil {
+				return report, err
+			}
+			report.Symlinks++
+			continue
+		case tar.TypeLink:
+			linkTarget := filepath.Join(target, header.Linkname)
+			if !insideTarget(target, linkTarget) {
+				report.skip(header.Name, "hard link escapes the extraction directory")
+				continue
 			}
+			if err = os.Link(linkTarget, path); err != nil {
+				return report, err
+			}
+			report.Files++
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			report.skip(header.Name, fmt.Sprintf("unsupported entry type %q", header.Typeflag))
 			continue
 		}
 
-		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
-		if err != nil {
+		var file *os.File
+		err = retry(options.IOMaxRetries, func() (err error) {
+			file, err = os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
 			return err
+		})
+		if err != nil {
+			return report, err
 		}
-		defer file.Close()
-		_, err = io.Copy(file, tarReader)
+		n, err := io.CopyBuffer(&retryWriter{w: file, maxRetries: options.IOMaxRetries}, tarReader, buffer)
+		file.Close()
 		if err != nil {
+			return report, err
+		}
+
+		// keep the modification time, tarit puts it back into the tarball
+		if !header.ModTime.IsZero() {
+			os.Chtimes(path, header.ModTime, header.ModTime)
+		}
+
+		report.Files++
+		report.TotalBytes += n
+		if n > report.LargestSize || report.LargestFile == "" {
+			report.LargestFile = header.Name
+			report.LargestSize = n
+		}
+	}
+	return report, nil
+}
+
+// applyGlobalHeader sets the fields of header that the records of a PAX global header define, unless the
+// header carries a record of its own for them. archive/tar returns global headers as entries of their own and
+// leaves applying them to the entries that follow to the caller.
+func applyGlobalHeader(header *tar.Header, global map[string]string) {
+
+	for key, value := range global {
+
+		if _, local := header.PAXRecords[key]; local {
+			continue
+		}
+
+		switch key {
+		case "mtime":
+			if t, err := parsePAXTime(value); err == nil {
+				header.ModTime = t
+			}
+		case "uid":
+			if id, err := strconv.Atoi(value); err == nil {
+				header.Uid = id
+			}
+		case "gid":
+			if id, err := strconv.Atoi(value); err == nil {
+				header.Gid = id
+			}
+		case "uname":
+			header.Uname = value
+		case "gname":
+			header.Gname = value
+		}
+
+	}
+
+}
+
+// parsePAXTime parses a PAX time record, seconds since the epoch with an optional fraction
+func parsePAXTime(value string) (time.Time, error) {
+
+	secs, frac := value, ""
+	if k := strings.Index(value, "."); k >= 0 {
+		secs, frac = value[:k], value[k+1:]
+	}
+
+	s, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var ns int64
+	if frac != "" {
+		frac = (frac + "000000000")[:9]
+		if ns, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return time.Time{}, err
+		}
+		if strings.HasPrefix(value, "-") {
+			ns = -ns
+		}
+	}
+
+	return time.Unix(s, ns), nil
+
+}
+
+// walkTarReader calls fn for every entry of the tarball read from reader, stopping at the first error
+func walkTarReader(reader io.Reader, fn func(header *tar.Header, r io.Reader) error) error {
+
+	tarReader := tar.NewReader(reader)
+	global := map[string]string{}
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			for key, value := range header.PAXRecords {
+				global[key] = value
+			}
+			continue
+		}
+		applyGlobalHeader(header, global)
+
+		if err := fn(header, tarReader); err != nil {
 			return err
 		}
 	}
-	return nil
 }
@@ -0,0 +1,203 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtractReport(t *testing.T) {
+
+	img := openImage(t, saveArchive{
+		layers: []testLayer{
+			{id: "base", files: []testFile{{name: "usr/lib/big", body: strings.Repeat("x", 8192)}}},
+			{id: "app", files: []testFile{{name: "app/main", body: "main"}}},
+		},
+		repositories: map[string]map[string]string{"app": {"latest": "app"}},
+	}.write(t))
+
+	r, err := img.ExtractReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := os.Stat(filepath.Join(img.pathToWorkingCopy, "base", "layer.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// VERSION, json and layer.tar of both layers and the repositories file
+	if r.Files != 7 || r.Symlinks != 0 || len(r.Skipped) != 0 {
+		t.Fatalf("ExtractReport() = %+v, want 7 files and nothing skipped", r)
+	}
+
+	if r.LargestFile != "base/layer.tar" || r.LargestSize != base.Size() {
+		t.Fatalf("ExtractReport() names %s of %d bytes as largest file, want base/layer.tar of %d", r.LargestFile, r.LargestSize, base.Size())
+	}
+
+}
+
+func TestExtractReportSkippedEntries(t *testing.T) {
+
+	img := openImage(t, writeTar(t, []testFile{
+		{name: "data/", typeflag: tar.TypeDir},
+		{name: "data/large", body: "123456789"},
+		{name: "data/small", body: "1"},
+		{name: "data/current", typeflag: tar.TypeSymlink, linkname: "large"},
+		{name: "escape", typeflag: tar.TypeSymlink, linkname: "/tmp"},
+		{name: "escape/planted", body: "x"},
+		{name: "../outside", body: "x"},
+		{name: "dev/console", typeflag: tar.TypeChar},
+	}))
+
+	r, err := img.ExtractReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Files != 2 || r.TotalBytes != 10 || r.LargestFile != "data/large" || r.Symlinks != 2 {
+		t.Fatalf("ExtractReport() = %+v, want 2 files of 10 bytes, data/large largest and 2 symlinks", r)
+	}
+
+	if len(r.Skipped) != 3 || !strings.HasPrefix(r.Skipped[0], "escape/planted") || !strings.HasPrefix(r.Skipped[1], "../outside") || !strings.HasPrefix(r.Skipped[2], "dev/console") {
+		t.Fatalf("ExtractReport().Skipped = %q, want the escaping entries and the device", r.Skipped)
+	}
+
+}
+
+func TestOnSkip(t *testing.T) {
+
+	path := writeTar(t, []testFile{
+		{name: "../../etc/cron.d/backdoor", body: "* * * * * root sh"},
+		{name: "ok", body: "ok"},
+		{name: "dev/kmem", typeflag: tar.TypeChar},
+	})
+
+	var skipped []string
+	img := openImageWithOptions(t, path, Options{OnSkip: func(entry string, reason string) {
+		skipped = append(skipped, entry+": "+reason)
+	}})
+
+	r, err := img.ExtractReport()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"../../etc/cron.d/backdoor: path escapes the extraction directory", `dev/kmem: unsupported entry type '3'`}
+	if len(skipped) != 2 || skipped[0] != want[0] || skipped[1] != want[1] {
+		t.Fatalf("OnSkip called with %q, want %q", skipped, want)
+	}
+
+	if len(r.Skipped) != 2 {
+		t.Fatalf("ExtractReport().Skipped = %q, want both entries", r.Skipped)
+	}
+
+	if _, err := openImage(t, path).ExtractReport(); err != nil {
+		t.Fatalf("ExtractReport() without OnSkip = %v", err)
+	}
+
+}
+
+// globalHeaderTar returns a tarball starting with a PAX global header that sets the modification time and owner
+// of the entries following it, as git archive and some build tools write them
+func globalHeaderTar(t *testing.T) []byte {
+
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	headers := []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", Format: tar.FormatPAX, PAXRecords: map[string]string{"mtime": "1500000000.5", "uname": "builder"}},
+		{Typeflag: tar.TypeDir, Name: "src/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "src/main.go", Mode: 0644, Size: 4, ModTime: time.Unix(5, 0)},
+		{Typeflag: tar.TypeReg, Name: "src/own.go", Mode: 0644, Size: 4, Format: tar.FormatPAX, ModTime: time.Unix(1600000000, 250000000)},
+	}
+
+	for _, h := range headers {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Size > 0 {
+			tw.Write([]byte("code"))
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+
+}
+
+func TestPAXGlobalHeader(t *testing.T) {
+
+	global := time.Unix(1500000000, 500000000)
+	own := time.Unix(1600000000, 250000000)
+	data := globalHeaderTar(t)
+
+	var names []string
+	err := walkTarReader(bytes.NewReader(data), func(h *tar.Header, r io.Reader) error {
+
+		if h.Typeflag == tar.TypeDir {
+			return nil
+		}
+		names = append(names, h.Name)
+
+		if want := map[string]time.Time{"src/main.go": global, "src/own.go": own}[h.Name]; !h.ModTime.Equal(want) || h.Uname != "builder" {
+			t.Fatalf("%s modified %v by %s, want %v by builder", h.Name, h.ModTime, h.Uname, want)
+		}
+
+		return nil
+
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != 2 {
+		t.Fatalf("walkTarReader() visited %q, want the files without the global header", names)
+	}
+
+	target := t.TempDir()
+
+	r, err := untarReader(bytes.NewReader(data), target, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Skipped) != 0 || r.Files != 2 {
+		t.Fatalf("untarReader() = %+v, want 2 files and the global header not skipped", r)
+	}
+
+	info, err := os.Stat(filepath.Join(target, "src", "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.ModTime().Unix() != global.Unix() {
+		t.Fatalf("src/main.go extracted with modification time %v, want %v of the global header", info.ModTime(), global)
+	}
+
+	path := filepath.Join(t.TempDir(), "layer.tar")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := indexLayer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("indexLayer() indexed %d entries, want 3", len(entries))
+	}
+
+}
@@ -0,0 +1,237 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/alexflint/go-filemutex"
+)
+
+// now returns the current time as Options.Now reports it
+func (i *Image) now() time.Time {
+
+	if i.options.Now != nil {
+		return i.options.Now()
+	}
+
+	return time.Now()
+
+}
+
+// NormalizeTimestamps sets the modification time of every entry of every layer, the creation time of the layers
+// and the creation and history times of the image config to t, so that building the same content always
+// produces the same archive, as SOURCE_DATE_EPOCH does for builds. The entries of the archive itself are stamped
+// with t and owned by root. t is rounded down to whole seconds, a zero t means now. The content of the layers
+// changes, so their diff ids are updated. The layers of OCI images are stored uncompressed afterwards.
+// Multi-platform images are not supported.
+func (i *Image) NormalizeTimestamps(t time.Time) error {
+
+	if t.IsZero() {
+		t = i.now()
+	}
+
+	t = t.UTC().Truncate(time.Second)
+
+	m, err := filemutex.New(i.lockPath())
+	if err != nil {
+		return fmt.Errorf("Error normalizing image: Setting mutex failed) %s", i.PathToSource)
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return err
+	}
+
+	if i.isOCI() {
+		if err := i.requireSinglePlatform(); err != nil {
+			return err
+		}
+	}
+
+	created, _ := json.Marshal(t)
+	groups := make([][]*Layer, len(layers))
+	diffIds := make([]string, len(layers))
+	ociLayers := make([]ociDescriptor, len(layers))
+
+	for k, l := range layers {
+
+		groups[k] = []*Layer{l}
+
+		diffIds[k], err = i.writeLayerTarball(l, func(w io.Writer) (string, error) {
+			return i.writeLayerTimes(l, t, w)
+		})
+		if err != nil {
+			return err
+		}
+
+		if i.isOCI() {
+			if ociLayers[k], err = i.uncompressedLayerDescriptor(l, diffIds[k]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		layerConfig, err := i.readLayerConfig(l.Id)
+		if err != nil {
+			return err
+		}
+
+		layerConfig["created"] = created
+
+		data, err := marshalConfig(layerConfig)
+		if err != nil {
+			return fmt.Errorf("Error normalizing image: Json failed %s", l.Id)
+		}
+
+		if err := ioutil.WriteFile(i.layerConfigPath(l.Id), data, 0644); err != nil {
+			return fmt.Errorf("Error normalizing image: Layer config write failed) %s", l.Id)
+		}
+
+	}
+
+	if i.isOCI() {
+
+		err := i.replaceOCILayers(ociLayers, func(imageConfig map[string]json.RawMessage) error {
+			rewriteConfigLayers(imageConfig, groups, diffIds)
+			return setHistoryTimes(imageConfig, created)
+		})
+
+		if err != nil {
+			return err
+		}
+
+	} else if i.hasManifest() {
+
+		if err := i.rewriteManifestLayers(groups, diffIds); err != nil {
+			return err
+		}
+
+		err := i.editV1Config(func(imageConfig map[string]json.RawMessage) error {
+			return setHistoryTimes(imageConfig, created)
+		})
+
+		if err != nil {
+			return err
+		}
+
+	}
+
+	i.Layers = nil
+	i.index = nil
+
+	if err := i.dropDigestTags(); err != nil {
+		return err
+	}
+
+	if err = i.saveNormalized(t); err != nil {
+		return fmt.Errorf("Error creating image: Tar failed) %s", i.pathToWorkingCopy)
+	}
+
+	return nil
+
+}
+
+// writeLayerTimes writes an uncompressed copy of the tarball of l to w whose entries are all modified at t and
+// returns its diff id
+func (i *Image) writeLayerTimes(l *Layer, t time.Time, w io.Writer) (string, error) {
+
+	digest := sha256.New()
+	tarball := tar.NewWriter(io.MultiWriter(w, digest))
+
+	err := i.walkLayer(l.Id, func(header *tar.Header, r io.Reader) error {
+
+		h := *header
+		h.ModTime = t
+		h.AccessTime = time.Time{}
+		h.ChangeTime = time.Time{}
+		h.PAXRecords = make(map[string]string)
+
+		// the times are also kept as PAX records, which take precedence over the header fields
+		for key, value := range header.PAXRecords {
+			if key != "mtime" && key != "atime" && key != "ctime" {
+				h.PAXRecords[key] = value
+			}
+		}
+
+		if err := tarball.WriteHeader(&h); err != nil {
+			return err
+		}
+
+		_, err := io.Copy(tarball, r)
+		return err
+
+	})
+
+	if err == nil {
+		err = tarball.Close()
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("Error normalizing layer %s: %s", l.Id, err)
+	}
+
+	return "sha256:" + hex.EncodeToString(digest.Sum(nil)), nil
+
+}
+
+// setHistoryTimes sets the creation time of imageConfig and of every step of its history to created
+func setHistoryTimes(imageConfig map[string]json.RawMessage, created json.RawMessage) error {
+
+	imageConfig["created"] = created
+
+	raw, found := imageConfig["history"]
+	if !found || string(raw) == "null" {
+		return nil
+	}
+
+	var history []map[string]json.RawMessage
+
+	if err := json.Unmarshal(raw, &history); err != nil {
+		return fmt.Errorf("Unexpected schema for `history` field in image config")
+	}
+
+	for _, h := range history {
+		h["created"] = created
+	}
+
+	data, err := json.Marshal(history)
+	if err != nil {
+		return fmt.Errorf("Error normalizing image: Json failed for `history` field")
+	}
+
+	imageConfig["history"] = data
+
+	return nil
+
+}
+
+// DetectTimestomping returns the ids of the layers whose creation time is exactly the Unix epoch or lies in the
+// future, base layer first. Both are signs of timestamps that were rewritten, by a reproducible build setting
+// SOURCE_DATE_EPOCH to 0 or by tampering, so the creation times of these layers cannot be trusted.
+func (i *Image) DetectTimestomping() ([]string, error) {
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return nil, err
+	}
+
+	now := i.now()
+	suspicious := make([]string, 0)
+
+	for _, l := range layers {
+		if l.Created.Equal(time.Unix(0, 0)) || l.Created.After(now) {
+			suspicious = append(suspicious, l.Id)
+		}
+	}
+
+	return suspicious, nil
+
+}
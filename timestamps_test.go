@@ -0,0 +1,170 @@
+package dockerscope
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTimestamps(t *testing.T) {
+
+	epoch := time.Unix(1700000000, 0).UTC()
+
+	build := func(built time.Time) string {
+		return saveArchive{layers: []testLayer{
+			{id: "base", created: built, files: []testFile{{name: "etc/", typeflag: tar.TypeDir, modTime: built}, {name: "etc/motd", body: "hi", modTime: built}}},
+			{id: "app", created: built.Add(time.Hour), files: []testFile{{name: "app", body: "app", modTime: built.Add(time.Minute)}}},
+		}, manifest: true}.write(t)
+	}
+
+	var archives [][]byte
+
+	for _, built := range []time.Time{day(1), day(20)} {
+
+		path := build(built)
+
+		// the working copies differ in their times as if extracted at different times
+		img := openImage(t, path)
+		if err := img.extract(); err != nil {
+			t.Fatal(err)
+		}
+
+		err := filepath.Walk(img.pathToWorkingCopy, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Chtimes(p, built, built)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := img.NormalizeTimestamps(epoch.Add(time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+
+		img = openImage(t, path)
+
+		if err := img.Verify(); err != nil {
+			t.Fatalf("Verify() after NormalizeTimestamps() = %v", err)
+		}
+
+		layers, err := img.orderedLayers()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, l := range layers {
+			if !l.Created.Equal(epoch) {
+				t.Fatalf("layer %s created %v after NormalizeTimestamps(), want %v", l.Id, l.Created, epoch)
+			}
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives = append(archives, data)
+	}
+
+	if !bytes.Equal(archives[0], archives[1]) {
+		t.Fatal("NormalizeTimestamps() of the same image built on different days gave different archives")
+	}
+
+	path := saveArchive{layers: []testLayer{{id: "a", files: []testFile{{name: "a", modTime: day(3)}}}}}.write(t)
+
+	if err := openImageWithOptions(t, path, Options{Now: func() time.Time { return epoch }}).NormalizeTimestamps(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := openImage(t, path).WalkLayerEntries("a", func(h *tar.Header, r io.Reader) error {
+		if !h.ModTime.Equal(epoch) {
+			t.Fatalf("NormalizeTimestamps() of a zero time set %s to %v, want Options.Now %v", h.Name, h.ModTime, epoch)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+}
+
+func TestNormalizeTimestampsOCI(t *testing.T) {
+
+	epoch := time.Unix(1700000000, 0).UTC()
+
+	path := ociArchive{
+		layers: [][]testFile{
+			{{name: "etc/", typeflag: tar.TypeDir, modTime: day(1)}, {name: "etc/motd", body: "hi", modTime: day(1)}},
+			{{name: "app", body: "app", modTime: day(2)}},
+		},
+		gzip:   true,
+		docker: true,
+		config: map[string]interface{}{"history": []map[string]interface{}{
+			{"created": day(1), "created_by": "ADD rootfs.tar /"},
+			{"created": day(2), "created_by": "COPY app /app"},
+		}},
+	}.write(t)
+
+	if err := openImage(t, path).NormalizeTimestamps(epoch); err != nil {
+		t.Fatal(err)
+	}
+
+	img := openImage(t, path)
+
+	if err := img.Verify(); err != nil {
+		t.Fatalf("Verify() after NormalizeTimestamps() = %v", err)
+	}
+
+	layers, err := img.orderedLayers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkOCIDigests(t, img)
+
+	for _, l := range layers {
+
+		if !l.Created.Equal(epoch) || l.mediaType != ociLayerMediaType {
+			t.Fatalf("layer %s created %v with media type %s after NormalizeTimestamps(), want %v uncompressed", l.Id, l.Created, l.mediaType, epoch)
+		}
+
+		err := img.WalkLayerEntries(l.Id, func(h *tar.Header, r io.Reader) error {
+			if !h.ModTime.Equal(epoch) {
+				t.Fatalf("%s of layer %s modified %v, want %v", h.Name, l.Id, h.ModTime, epoch)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+}
+
+func TestDetectTimestomping(t *testing.T) {
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	img := openImageWithOptions(t, saveArchive{layers: []testLayer{
+		{id: "epoch", created: time.Unix(0, 0)},
+		{id: "past", created: now.Add(-time.Hour)},
+		{id: "future", created: now.Add(24 * time.Hour)},
+	}}.write(t), Options{Now: func() time.Time { return now }})
+
+	suspicious, err := img.DetectTimestomping()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"epoch", "future"}; !reflect.DeepEqual(suspicious, want) {
+		t.Fatalf("DetectTimestomping() = %q, want %q", suspicious, want)
+	}
+
+}
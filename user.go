@@ -0,0 +1,66 @@
+package dockerscope
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const passwdFile = "/etc/passwd"
+
+// EffectiveUID returns the numeric uid processes of a container started from the image run as. A user given by
+// name is looked up in /etc/passwd of the merged filesystem, an empty user means root.
+func (i *Image) EffectiveUID() (int, error) {
+
+	c, err := i.Config()
+	if err != nil {
+		return 0, err
+	}
+
+	// the user may carry a group as user:group
+	user := strings.SplitN(c.User, ":", 2)[0]
+
+	if user == "" || user == "root" {
+		return 0, nil
+	}
+
+	if uid, err := strconv.Atoi(user); err == nil {
+		return uid, nil
+	}
+
+	passwd, err := i.ReadFile(passwdFile)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot resolve user %s without %s in image %s", user, passwdFile, i.PathToSource)
+	}
+
+	return lookupUID(passwd, user)
+
+}
+
+// lookupUID returns the uid of user in the content of a passwd file
+func lookupUID(passwd []byte, user string) (int, error) {
+
+	scanner := bufio.NewScanner(bytes.NewReader(passwd))
+
+	for scanner.Scan() {
+
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] != user {
+			continue
+		}
+
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, fmt.Errorf("Unexpected uid %q for user %s in %s", fields[2], user, passwdFile)
+		}
+
+		return uid, nil
+
+	}
+
+	return 0, fmt.Errorf("No user %s found in %s", user, passwdFile)
+
+}
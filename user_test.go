@@ -0,0 +1,41 @@
+package dockerscope
+
+import "testing"
+
+func TestEffectiveUID(t *testing.T) {
+
+	passwd := "root:x:0:0:root:/root:/bin/sh\nnobody:x:65534:65534::/nonexistent:/sbin/nologin\napp:x:1000:1000::/app:/bin/sh\n"
+
+	for user, want := range map[string]int{
+		"":           0,
+		"root":       0,
+		"1001":       1001,
+		"1001:1001":  1001,
+		"app":        1000,
+		"nobody:app": 65534,
+	} {
+
+		img := openImage(t, saveArchive{layers: []testLayer{
+			{id: "base", files: []testFile{{name: "etc/passwd", body: passwd}}},
+			{id: "app", config: map[string]interface{}{"User": user}},
+		}}.write(t))
+
+		uid, err := img.EffectiveUID()
+		if err != nil {
+			t.Fatalf("EffectiveUID() for user %q: %v", user, err)
+		}
+
+		if uid != want {
+			t.Fatalf("EffectiveUID() for user %q = %d, want %d", user, uid, want)
+		}
+	}
+
+	img := openImage(t, saveArchive{layers: []testLayer{
+		{id: "base", files: []testFile{{name: "etc/passwd", body: passwd}}, config: map[string]interface{}{"User": "ghost"}},
+	}}.write(t))
+
+	if _, err := img.EffectiveUID(); err == nil {
+		t.Fatal("EffectiveUID() of a user missing from /etc/passwd succeeded")
+	}
+
+}
@@ -0,0 +1,214 @@
+package dockerscope
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrDigestMismatch is returned when a blob does not match the digest it is stored under
+	ErrDigestMismatch = errors.New("Digest mismatch")
+	// ErrDiffIdOrder is returned when the diff ids of the config list the right layers in the wrong order
+	ErrDiffIdOrder = errors.New("Diff ids out of layer order")
+	// ErrDiffIdMismatch is returned when a diff id of the config does not match the content of its layer
+	ErrDiffIdMismatch = errors.New("Diff id mismatch")
+)
+
+// rootfs is the part of an image config that lists the diff ids of the layers
+type rootfs struct {
+	Type    string   `json:"type"`
+	DiffIds []string `json:"diff_ids"`
+}
+
+// diffIds returns the diff ids the image config lists, ok is false for v1 images whose config has none
+func (i *Image) diffIds() (diffIds []string, ok bool, err error) {
+
+	var imageConfig map[string]json.RawMessage
+
+	switch {
+	case i.isOCI():
+		imageConfig, err = i.imageConfig()
+	case i.hasManifest():
+		var entries []*manifestEntry
+		if entries, err = i.readManifest(); err == nil && len(entries) > 0 {
+			imageConfig, err = i.readManifestConfig(entries[0])
+		}
+	}
+
+	if err != nil || imageConfig == nil {
+		return nil, false, err
+	}
+
+	r := &rootfs{}
+
+	if raw, found := imageConfig["rootfs"]; !found || json.Unmarshal(raw, r) != nil {
+		return nil, false, fmt.Errorf("Unexpected schema for `rootfs` field in image config of %s", i.PathToSource)
+	}
+
+	return r.DiffIds, true, nil
+
+}
+
+// Verify checks that the content addressed parts of the image match their digests. Blobs of OCI images must
+// match the digest they are stored under and the diff ids of the config must match the uncompressed layers in
+// stack order. Diff ids listing the right layers in the wrong order are reported as ErrDiffIdOrder, diff ids
+// that match no layer as ErrDiffIdMismatch.
+func (i *Image) Verify() error {
+
+	if err := i.extract(); err != nil {
+		return err
+	}
+
+	if i.isOCI() {
+		if err := i.verifyBlobs(); err != nil {
+			return err
+		}
+	}
+
+	expected, ok, err := i.diffIds()
+	if err != nil || !ok {
+		return err
+	}
+
+	layers, err := i.orderedLayers()
+	if err != nil {
+		return err
+	}
+
+	actual, err := i.layerDiffIds()
+	if err != nil {
+		return err
+	}
+
+	if len(expected) != len(actual) {
+		return fmt.Errorf("%w: config lists %d diff ids for %d layers", ErrDiffIdMismatch, len(expected), len(actual))
+	}
+
+	if equalStrings(expected, actual) {
+		return nil
+	}
+
+	// the same diff ids in a different order are an ordering problem, anything else is a content problem
+	present := make(map[string]int)
+
+	for _, d := range actual {
+		present[d]++
+	}
+
+	for _, d := range expected {
+		present[d]--
+	}
+
+	for k, d := range actual {
+		if present[d] != 0 {
+			return fmt.Errorf("%w: layer %s has diff id %s, config lists %s", ErrDiffIdMismatch, layers[k].Id, d, expected[k])
+		}
+	}
+
+	for k, d := range expected {
+		if d != actual[k] {
+			return fmt.Errorf("%w: layer %d of the stack is %s, config lists %s", ErrDiffIdOrder, k+1, actual[k], d)
+		}
+	}
+
+	return nil
+
+}
+
+// verifyBlobs checks the config and layer blobs of the image manifest against their digests
+func (i *Image) verifyBlobs() error {
+
+	m, err := i.ociManifest()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range append([]ociDescriptor{m.Config}, m.Layers...) {
+
+		actual, err := fileDigest(i.blobPath(d.Digest))
+		if err != nil {
+			return fmt.Errorf("No blob %s found in image %s", d.Digest, i.PathToSource)
+		}
+
+		if !strings.EqualFold(actual, d.Digest) {
+			return fmt.Errorf("%w: blob %s has digest %s", ErrDigestMismatch, d.Digest, actual)
+		}
+
+	}
+
+	return nil
+
+}
+
+// SelfTest loads the image archive afresh from PathToSource and checks that it is internally consistent: its
+// repositories, manifest.json and config parse, everything they reference exists and the content matches its
+// digests as Verify checks it. It is a cheap sanity check after editing an image.
+func (i *Image) SelfTest() error {
+
+	var fresh *Image
+	var err error
+
+	if i.inPlace {
+		fresh, err = NewImageFromDirLayout(i.PathToSource)
+	} else {
+		fresh, err = NewImageWithOptions(i.PathToSource, i.options)
+	}
+
+	if err != nil {
+		return err
+	}
+	defer fresh.Close()
+
+	if err := fresh.loadLayers(); err != nil {
+		return err
+	}
+
+	repos, err := fresh.Repositories()
+	if err != nil {
+		return err
+	}
+
+	if !fresh.isOCI() {
+		for name, tags := range repos {
+			for tag, layerId := range tags {
+				if _, err := fresh.layer(layerId); err != nil {
+					return fmt.Errorf("Tag %s:%s points to missing layer %s in image %s", name, tag, layerId, i.PathToSource)
+				}
+			}
+		}
+	}
+
+	if fresh.hasManifest() {
+
+		entries, err := fresh.readManifest()
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+
+			if _, err := fresh.readManifestConfig(entry); err != nil {
+				return err
+			}
+
+			for _, l := range entry.Layers {
+				if _, err := os.Stat(filepath.Join(fresh.pathToWorkingCopy, filepath.FromSlash(l))); err != nil {
+					return fmt.Errorf("Manifest lists missing layer %s in image %s", l, i.PathToSource)
+				}
+			}
+
+		}
+
+	}
+
+	if _, err := fresh.Config(); err != nil {
+		return err
+	}
+
+	return fresh.Verify()
+
+}
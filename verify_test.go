@@ -0,0 +1,79 @@
+package dockerscope
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerifyDiffIds(t *testing.T) {
+
+	base := []testFile{{name: "etc/os-release", body: "ID=alpine"}}
+	app := []testFile{{name: "app/main", body: "main"}}
+	layers := []testLayer{{id: "base", files: base}, {id: "app", files: app}}
+	baseId, appId := digestOf(layerTar(base)), digestOf(layerTar(app))
+
+	rootfs := func(diffIds ...string) map[string]interface{} {
+		return map[string]interface{}{"rootfs": map[string]interface{}{"type": "layers", "diff_ids": diffIds}}
+	}
+
+	for name, tc := range map[string]struct {
+		path string
+		want error
+	}{
+		"docker save":                   {saveArchive{layers: layers, manifest: true}.write(t), nil},
+		"docker save reordered":         {saveArchive{layers: layers, manifest: true, config: rootfs(appId, baseId)}.write(t), ErrDiffIdOrder},
+		"docker save wrong content":     {saveArchive{layers: layers, manifest: true, config: rootfs(baseId, baseId)}.write(t), ErrDiffIdMismatch},
+		"oci gzip":                      {ociArchive{layers: [][]testFile{base, app}, gzip: true}.write(t), nil},
+		"oci gzip reordered":            {ociArchive{layers: [][]testFile{base, app}, gzip: true, config: rootfs(appId, baseId)}.write(t), ErrDiffIdOrder},
+		"oci compressed digest as diff": {ociArchive{layers: [][]testFile{base}, gzip: true, config: rootfs(digestOf(gzipped(layerTar(base))))}.write(t), ErrDiffIdMismatch},
+		"v1 without diff ids":           {saveArchive{layers: layers}.write(t), nil},
+	} {
+
+		err := openImage(t, tc.path).Verify()
+
+		if tc.want == nil && err != nil {
+			t.Fatalf("%s: Verify() = %v, want no error", name, err)
+		}
+
+		if tc.want != nil && !errors.Is(err, tc.want) {
+			t.Fatalf("%s: Verify() = %v, want %v", name, err, tc.want)
+		}
+
+		if tc.want == ErrDiffIdMismatch && errors.Is(err, ErrDiffIdOrder) {
+			t.Fatalf("%s: Verify() reports a content mismatch as %v", name, err)
+		}
+	}
+
+}
+
+func TestSelfTest(t *testing.T) {
+
+	layers := []testLayer{{id: "base", files: []testFile{{name: "etc/motd", body: "hi"}}}, {id: "app", files: []testFile{{name: "app", body: "app"}}}}
+	repos := map[string]map[string]string{"app": {"latest": "app"}}
+
+	for name, path := range map[string]string{
+		"docker save": saveArchive{layers: layers, repositories: repos, manifest: true}.write(t),
+		"oci":         ociArchive{layers: [][]testFile{layers[0].files, layers[1].files}}.write(t),
+	} {
+
+		img := openImage(t, path)
+
+		if err := img.SetLabel("org.opencontainers.image.version", "1.2.3"); err != nil {
+			t.Fatal(name, err)
+		}
+
+		if err := img.SelfTest(); err != nil {
+			t.Fatalf("SelfTest() of %s after SetLabel() = %v", name, err)
+		}
+	}
+
+	for name, path := range map[string]string{
+		"dangling tag":      saveArchive{layers: layers, repositories: map[string]map[string]string{"app": {"latest": "gone"}}}.write(t),
+		"mismatching layer": saveArchive{layers: layers, manifest: true, config: map[string]interface{}{"rootfs": map[string]interface{}{"type": "layers", "diff_ids": []string{digestOf(nil), digestOf(nil)}}}}.write(t),
+	} {
+		if err := openImage(t, path).SelfTest(); err == nil {
+			t.Fatalf("SelfTest() of an image with a %s succeeded", name)
+		}
+	}
+
+}